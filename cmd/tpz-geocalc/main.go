@@ -2,25 +2,30 @@ package main
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"os"
 	"os/exec"
 	"os/signal"
 	"path"
-	"strconv"
 	"syscall"
 	"time"
 
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
 	radix "github.com/mediocregopher/radix.v3"
 
+	"github.com/bamarb/aws-pipeline-go/pkg/file"
+	"github.com/bamarb/aws-pipeline-go/pkg/metrics"
+	"github.com/bamarb/aws-pipeline-go/pkg/sink"
+	"github.com/bamarb/aws-pipeline-go/pkg/tracing"
 	"github.com/bamarb/aws-pipeline-go/pkg/trapyz"
 
 	"github.com/BurntSushi/toml"
 	"github.com/bamarb/aws-pipeline-go/pkg/task"
 	_ "github.com/go-sql-driver/mysql"
 	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 var (
@@ -29,10 +34,18 @@ var (
 	runCount     = 0
 	fromDateHour time.Time
 	toDateHour   time.Time
+	cacheMgr     *trapyz.CacheManager
+	runReport    *trapyz.RunReport
+	metricsSrv   *metrics.Server
+	stopTraces   tracing.ShutdownFunc
+	runState     *trapyz.RunState
+	maxCatchup   time.Duration
+	showHistory  bool
 )
 
 func init() {
 	flag.StringVar(&cfgFile, "f", "config.toml", "# Path to cfg file (.toml)")
+	flag.BoolVar(&showHistory, "history", false, "Print the recorded runs and exit")
 }
 
 func configLogging(logCfg trapyz.OutputInfo) *os.File {
@@ -63,53 +76,70 @@ func CleanUpS3DumpDir(cfg *trapyz.Config) {
 	os.MkdirAll(dumpDir, 0755)
 }
 
-func writer(records chan trapyz.GeoLocOutput, outFile *os.File) {
-	for rec := range records {
-		if rec.UID == "" {
-			fmt.Printf("Error Rec:%+v\n", rec)
-			continue
-		}
-		jstr, err := json.Marshal(rec)
-		if err != nil {
-			log.Errorf("Error jsonify record %+v : %s", rec, err)
-		}
-		outFile.WriteString(string(jstr) + "\n")
+//runPipeline runs the window from, to
+func runPipeline(ctx context.Context, config *trapyz.Config, from, to time.Time) {
+	runReport = newRunReport(from, to)
+	if err := runState.Begin(runReport); err != nil {
+		log.Errorf("Error saving run state: %s", err)
 	}
-}
-
-func runPipeline(ctx context.Context, config *trapyz.Config) {
+	ctx = trapyz.ContextWithReport(ctx, runReport)
+	ctx, span := tracing.Start(ctx, "pipeline.run",
+		attribute.String("from", from.Format(trapyz.DateHourFormat)),
+		attribute.String("to", to.Format(trapyz.DateHourFormat)))
+	defer span.End()
 	//Cleanup Old data
+	done := runReport.StartStage("cleanup")
 	cleanup()
+	done()
 	connMgr := trapyz.NewConnMgr(config)
-	//log.Debugf("SQL Conn str [%s]\n", sqlConnStr)
-	db := connMgr.MustConnectMysql()
 	redisPool := connMgr.MustConnectRedis()
-	/* Rebuild Cache */
-	log.Infoln("Rebuilding Redis store and in memory caches")
-	cache, err := trapyz.MakeCache(db, redisPool, config)
-	if err != nil {
-		redisPool.Close()
-		db.Close()
+	/* Take a cache snapshot for this run */
+	done = runReport.StartStage("cache")
+	cache := cacheMgr.Get()
+	if cache == nil {
+		log.Infoln("No cache available, rebuilding Redis store and in memory caches")
+		if err := cacheMgr.Refresh(); err != nil {
+			log.Fatalln(err)
+		}
+		cache = cacheMgr.Get()
+	}
+	//the cleanup flushed the geo indexes when the local redis is the
+	//redis the cache was built in, restore them for this run
+	if err := cache.EnsureGeoIndexes(ctx, redisPool, config); err != nil {
 		log.Fatalln(err)
 	}
+	done()
 	/* Download S3 Files */
 	/* Calculate the time windows to down load */
 	log.Infof("Starting S3 file download for range: [%s] - [%s]",
-		fromDateHour.Format(time.Stamp), toDateHour.Format(time.Stamp))
+		from.Format(time.Stamp), to.Format(time.Stamp))
+	done = runReport.StartStage("s3_fetch")
 	s3pool := task.New(2)
+	s3pool.Observe(metrics.PoolDepth("s3"))
 	s3pool.Start()
-	trapyz.S3FetchOnRange(ctx, config, s3pool, fromDateHour, toDateHour)
+	trapyz.S3FetchOnRange(ctx, config, s3pool, from, to)
 	s3pool.Stop()
+	done()
 	/* Start The Log Writer */
-	ofile := path.Join(config.Output.Directory, config.Output.File)
-	log.Infof("Creating outputfile %s", ofile)
-	outPutFile, err := os.Create(ofile)
+	//a window is only caught up if it wrote nothing, sinks append
+	if err := runState.OutputStarted(runReport); err != nil {
+		log.Fatalf("Error saving run state before writing output: %s", err)
+	}
+	out, err := sink.FromConfig(config, connMgr.MustConnectRedisUniques())
 	if err != nil {
-		log.Fatalf("Error unable to create outputfile:%s", err)
+		log.Fatalf("Error unable to create output sinks:%s", err)
 	}
-	defer outPutFile.Close()
+	//device profiles are derived from the records as they are written
+	out = append(out, sink.Counted(sink.NameProfiles, sink.NewProfileSink(config,
+		connMgr.MustConnectRedisProfiles(), connMgr.MustConnectDynamo())))
+	out.SetWindow(from, to)
 	outchan := make(chan trapyz.GeoLocOutput)
-	go writer(outchan, outPutFile)
+	writerDone := make(chan struct{})
+	go func() {
+		written, failed := sink.Consume(outchan, out)
+		log.Infof("Output records written:%d failed:%d", written, failed)
+		close(writerDone)
+	}()
 	/* Start the GeoStore workers and wait for them to finish */
 	var nw = 4
 	if config.Nworkers > 0 {
@@ -117,16 +147,125 @@ func runPipeline(ctx context.Context, config *trapyz.Config) {
 	}
 	workerPool := task.New(nw)
 	workerPool.Start()
-	trapyz.FillGeoStores(config, cache, redisPool, workerPool, outchan).Wait()
+	done = runReport.StartStage("geocalc")
+	trapyz.FillGeoStores(ctx, config, cache, redisPool, workerPool, outchan).Wait()
 	close(outchan)
+	<-writerDone
+	done()
+	done = runReport.StartStage("sinks_close")
+	closeErr := out.Close()
+	if closeErr != nil {
+		log.Errorf("Error closing output sinks:%s", closeErr)
+	}
+	done()
+	out.Report(runReport)
+	done = runReport.StartStage("upload")
+	uploadErr := uploadOutputs(ctx, config, out)
+	done()
 	workerPool.Stop()
 	log.Infof("Fill Geo stores complete: [%s] - [%s]",
-		fromDateHour.Format(time.Stamp), toDateHour.Format(time.Stamp))
+		from.Format(time.Stamp), to.Format(time.Stamp))
+	done = runReport.StartStage("extras")
+	_, espan := tracing.Start(ctx, "extras")
 	runExtras()
+	espan.End()
+	done()
+	//outputs that failed to close or upload fail the run
+	if closeErr == nil {
+		closeErr = uploadErr
+	}
+	writeReport(closeErr)
+}
+
+//newRunReport starts the run report for the window from, to
+func newRunReport(from, to time.Time) *trapyz.RunReport {
+	report := trapyz.NewRunReport("tpz-geocalc", from, to)
+	hash, err := trapyz.ConfigHash(cfgFile)
+	if err != nil {
+		log.Errorf("Error hashing config file: %s", err)
+	}
+	report.ConfigHash = hash
+	return report
+}
+
+//writeReport finishes the current run report with err and writes it to
+//the report directory
+func writeReport(err error) {
+	if runReport == nil {
+		return
+	}
+	runReport.Finish(err)
+	metrics.RunFinished(config.Schedule, runReport.Status, runReport.To,
+		runReport.Finished.Sub(runReport.Started))
+	name, err := runReport.WriteFile(trapyz.ReportDir(config))
+	if err != nil {
+		log.Errorf("Error writing run report: %s", err)
+		name = ""
+	} else {
+		log.Infof("Run report written to %s status:%s", name, runReport.Status)
+	}
+	if err := runState.End(runReport, name); err != nil {
+		log.Errorf("Error saving run state: %s", err)
+	}
+}
+
+//loadRunState reads the run state and resumes the schedule after the
+//latest window run. Without a usable state the schedule starts from
+//the current hour and runs are not recorded
+func loadRunState() {
+	file := trapyz.StateFile(config)
+	state, err := trapyz.LoadRunState(file, config.State.History)
+	if err != nil {
+		log.Errorf("Error loading run state %s, runs won't be recorded: %s", file, err)
+		return
+	}
+	runState = state
+	if config.State.MaxCatchup != "" {
+		if maxCatchup, err = time.ParseDuration(config.State.MaxCatchup); err != nil {
+			log.Errorf("Invalid max_catchup [%s], catching up all windows: %s", config.State.MaxCatchup, err)
+		}
+	}
+	fromDateHour, toDateHour = runState.ResumeWindow(time.Now(), maxCatchup)
+	if !toDateHour.IsZero() {
+		log.Infof("Resuming schedule after window [%s - %s]",
+			fromDateHour.Format(trapyz.DateHourFormat), toDateHour.Format(trapyz.DateHourFormat))
+	}
+}
+
+//printHistory prints the recorded runs
+func printHistory() {
+	state, err := trapyz.LoadRunState(trapyz.StateFile(config), config.State.History)
+	if err != nil {
+		fmt.Printf("Error loading run state: %s\n", err)
+		os.Exit(1)
+	}
+	for _, rr := range state.Runs() {
+		fmt.Printf("%s - %s  %-8s attempts:%d output:%t started:%s finished:%s %s\n",
+			rr.From.Format(trapyz.DateHourFormat), rr.To.Format(trapyz.DateHourFormat), rr.Status,
+			rr.Attempts, rr.Output, rr.Started.Format(time.Stamp), rr.Finished.Format(time.Stamp), rr.Error)
+	}
+}
+
+//uploadOutputs copies the finished output partitions to the upload
+//destination, a failed upload leaves the local partitions in place to be
+//retried by the next run and fails this one
+func uploadOutputs(ctx context.Context, config *trapyz.Config, out sink.FanOut) error {
+	var conn s3iface.S3API
+	if file.IsS3(config.Output.Upload.Destination) {
+		conn = trapyz.NewConnMgr(config).MustConnectS3()
+	}
+	n, err := sink.Upload(ctx, config, out, conn)
+	if err != nil {
+		log.Errorf("Error uploading output partitions: %s", err)
+	}
+	if n > 0 {
+		log.Infof("Uploaded %d output files to %s", n, config.Output.Upload.Destination)
+	}
+	return err
 }
 
 func runExtras() {
-	log.Infoln("Populating dynamo DB and elasticsearch")
+	log.Infoln("Populating elasticsearch")
 	if curDir, err := os.Getwd(); err == nil {
 
 		log.Infof("current working directory:[%s]", curDir)
@@ -139,27 +278,13 @@ func runExtras() {
 		return
 	}
 	log.Infoln("Changed working dir to :/home/ubuntu/varunplay")
-	redisLocalKey := trapyz.CfgKey(config, "redis-local")
-	redisCfg := config.Db[redisLocalKey]
-	redisLocalPort := redisCfg.Port
-	outDirName := config.Output.Directory + "/"
-	numRecords := strconv.Itoa(config.NumRecords)
-	redisDirCache := config.Output.Redisdir
-	log.Infoln("Executing python3 GenerateDerivedAttributesInteractive.py ", outDirName,
-		"--localRedisPort", redisLocalPort, "--intermediateCache ", redisDirCache, "--linesToBeProcessed", numRecords)
-
-	cmd := exec.Command("python3", "GenerateDerivedAttributesInteractive.py", outDirName,
-		"--localRedisPort", redisLocalPort, "--intermediateCache", redisDirCache, "--linesToBeProcessed", numRecords)
-	err = cmd.Run()
-	if err != nil {
-		log.Errorf("Error Executing GenerateDerivedAttributesInteractive.py: %s", err)
-	}
-
-	log.Infoln("Executing python3 ElasticSearchAnalytics.py ")
-	cmdEs := exec.Command("python3", "ElasticSearchAnalytics.py")
-	err = cmdEs.Run()
-	if err != nil {
-		log.Errorf("Error executing ElasticSearchAnalytics.py: %s", err)
+	if !sink.Enabled(config, sink.NameElastic) {
+		log.Infoln("Executing python3 ElasticSearchAnalytics.py ")
+		cmdEs := exec.Command("python3", "ElasticSearchAnalytics.py")
+		err = cmdEs.Run()
+		if err != nil {
+			log.Errorf("Error executing ElasticSearchAnalytics.py: %s", err)
+		}
 	}
 	log.Infof("Pipeline run complete")
 }
@@ -179,8 +304,14 @@ func cleanup() {
 	redisConnStr := fmt.Sprintf("%s:%s", redisCfg.Server, redisCfg.Port)
 	redisPool, err := radix.NewPool("tcp", redisConnStr, 1)
 	if err == nil {
-		log.Infof("FLUSHING local redis")
-		redisPool.Do(radix.Cmd(nil, "FLUSHALL"))
+		flushed, err := trapyz.FlushRunData(redisPool, config)
+		if err != nil {
+			log.Errorf("Cleanup: error flushing local redis %s: %s", redisConnStr, err)
+		} else if flushed {
+			log.Infof("Cleanup: FLUSHED db 0 of local redis %s", redisConnStr)
+		} else {
+			log.Warnf("Cleanup: not flushing local redis %s, profiles share db 0", redisConnStr)
+		}
 		redisPool.Close()
 	}
 	os.Remove(pydir + "derive_stdin_stdout_log.log")
@@ -195,11 +326,68 @@ func cleanup() {
 	}
 }
 
+//startCacheManager builds the initial cache and starts the background
+//refresher, a SIGHUP triggers an immediate refresh
+func startCacheManager(ctx context.Context) {
+	var interval time.Duration
+	if config.CacheRefresh != "" {
+		d, err := time.ParseDuration(config.CacheRefresh)
+		if err != nil {
+			log.Errorf("Invalid cache_refresh [%s], periodic refresh disabled: %s", config.CacheRefresh, err)
+		}
+		interval = d
+	}
+	cacheMgr = trapyz.NewCacheManager(func() (*trapyz.Cache, error) {
+		return trapyz.BuildCache(ctx, config)
+	}, interval)
+	log.Infoln("Building Redis store and in memory caches")
+	if err := cacheMgr.Refresh(); err != nil {
+		log.Fatalf("Error building the initial cache: %s", err)
+	}
+	cacheMgr.Start(ctx)
+	hupSignals := make(chan os.Signal, 1)
+	signal.Notify(hupSignals, syscall.SIGHUP)
+	go func() {
+		for range hupSignals {
+			log.Infoln("Cache refresh requested on SIGHUP")
+			cacheMgr.Trigger()
+		}
+	}()
+}
+
+var errCacheNotReady = errors.New("Error lookup cache not built")
+
+//startMetrics serves the metrics and health endpoints if configured,
+//the process is ready once the lookup cache is built
+func startMetrics() {
+	if config.Metrics.Listen == "" {
+		return
+	}
+	srv := metrics.NewServer(config.Metrics.Listen, func() error {
+		if cacheMgr == nil || cacheMgr.Get() == nil {
+			return errCacheNotReady
+		}
+		return nil
+	})
+	if err := srv.Start(); err != nil {
+		log.Errorf("Error starting metrics server on %s: %s", config.Metrics.Listen, err)
+		return
+	}
+	log.Infof("Serving metrics on %s", srv.Addr())
+	metricsSrv = srv
+}
+
 func main() {
 	flag.Parse()
 	ctx := context.Background()
 	osSignals := make(chan os.Signal, 1)
 	signal.Notify(osSignals, os.Interrupt, syscall.SIGTERM)
+	log.RegisterExitHandler(func() {
+		writeReport(trapyz.ErrorRunAborted)
+		if stopTraces != nil {
+			stopTracing(stopTraces)
+		}
+	})
 	var logFile *os.File
 	for {
 		/* Read the config */
@@ -207,29 +395,82 @@ func main() {
 			fmt.Printf("FATAL error parsing cfg file: %s ", err)
 			os.Exit(1)
 		}
+		if showHistory {
+			printHistory()
+			return
+		}
 		if logFile != nil {
 			//Close the previous log file if any
 			logFile.Close()
 		}
-		//Calculate Next run date times
-		fromDateHour, toDateHour = trapyz.GetStartEndTime(config.Schedule, fromDateHour, toDateHour)
 		//Configure a New logfile for this run
 		logFile = configLogging(config.Output)
-		nextDur := trapyz.NextTimeAdaptive(fromDateHour, toDateHour, time.Now())
+		if runState == nil && toDateHour.IsZero() {
+			loadRunState()
+		}
+		if metricsSrv == nil {
+			startMetrics()
+		}
+		if stopTraces == nil {
+			stopTraces = startTracing(ctx)
+		}
+		if cacheMgr == nil {
+			startCacheManager(ctx)
+		}
+		//Calculate Next run date times, windows that didn't complete are
+		//run again before the schedule moves on
+		var runFrom, runTo time.Time
+		var nextDur time.Duration
+		if pending := runState.PendingWindows(time.Now(), maxCatchup, config.State.MaxAttempts); len(pending) > 0 {
+			runFrom, runTo = pending[0].From, pending[0].To
+			nextDur = 2 * time.Second
+			log.Infof("Catching up window [%s - %s] status:%s attempts:%d", runFrom.Format(trapyz.DateHourFormat),
+				runTo.Format(trapyz.DateHourFormat), pending[0].Status, pending[0].Attempts)
+		} else {
+			fromDateHour, toDateHour = trapyz.GetStartEndTime(config.Schedule, fromDateHour, toDateHour)
+			runFrom, runTo = fromDateHour, toDateHour
+			nextDur = trapyz.NextTimeAdaptive(fromDateHour, toDateHour, time.Now())
+		}
 		log.Infof("Next schedule @ %s: For Range [%s - %s]",
 			time.Now().Add(nextDur).Format(time.Stamp),
-			fromDateHour.Format(trapyz.DateHourFormat),
-			toDateHour.Format(trapyz.DateHourFormat))
+			runFrom.Format(trapyz.DateHourFormat),
+			runTo.Format(trapyz.DateHourFormat))
 		nextTimer := time.NewTimer(nextDur)
 
 		select {
 		case <-osSignals:
 			log.Infof("Main Shutting down on user signal...")
 			nextTimer.Stop()
+			if metricsSrv != nil {
+				sctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+				metricsSrv.Shutdown(sctx)
+				cancel()
+			}
+			stopTracing(stopTraces)
 			return
 		case <-nextTimer.C:
 			log.Infof("Starting Pipeline Run")
-			runPipeline(ctx, config)
+			runPipeline(ctx, config, runFrom, runTo)
 		}
 	}
 }
+
+//startTracing installs the configured span exporter, tracing stays
+//disabled if it can't be set up
+func startTracing(ctx context.Context) tracing.ShutdownFunc {
+	shutdown, err := tracing.Setup(ctx, trapyz.TracingConfig(config, "tpz-geocalc"))
+	if err != nil {
+		log.Errorf("Error setting up tracing: %s", err)
+		return func(context.Context) error { return nil }
+	}
+	return shutdown
+}
+
+//stopTracing flushes the pending spans
+func stopTracing(shutdown tracing.ShutdownFunc) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := shutdown(ctx); err != nil {
+		log.Errorf("Error flushing trace spans: %s", err)
+	}
+}
@@ -2,23 +2,26 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"flag"
 	"fmt"
 	"os"
 	"os/exec"
 	"path"
-	"strconv"
 	"time"
 
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
 	radix "github.com/mediocregopher/radix.v3"
 
+	"github.com/bamarb/aws-pipeline-go/pkg/file"
+	"github.com/bamarb/aws-pipeline-go/pkg/sink"
+	"github.com/bamarb/aws-pipeline-go/pkg/tracing"
 	"github.com/bamarb/aws-pipeline-go/pkg/trapyz"
 
 	"github.com/BurntSushi/toml"
 	"github.com/bamarb/aws-pipeline-go/pkg/task"
 	_ "github.com/go-sql-driver/mysql"
 	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 var (
@@ -30,6 +33,9 @@ var (
 	skipS3       bool
 	skipDB       bool
 	repopKey     = "repopulate"
+	snapshotIn   string
+	snapshotOut  string
+	runReport    *trapyz.RunReport
 )
 
 func init() {
@@ -38,6 +44,8 @@ func init() {
 	flag.StringVar(&toDateHour, "tdh", "", "To date hour in the form YYYY/MM/DD or YYYY/MM/DD/HH")
 	flag.BoolVar(&skipS3, "s", false, "Skip make cache and s3 download steps")
 	flag.BoolVar(&skipDB, "t", false, "Download files from s3 and process them, but skip upload to DB and ES")
+	flag.StringVar(&snapshotIn, "snapshot-in", "", "Build the cache from this snapshot file instead of mysql")
+	flag.StringVar(&snapshotOut, "snapshot-out", "", "Save a snapshot of the cache to this file")
 }
 
 //CleanUpS3DumpDir removes the s3 dump directory if it exists and recreates it
@@ -67,9 +75,14 @@ func cleanup() {
 	redisConnStr := fmt.Sprintf("%s:%s", redisCfg.Server, redisCfg.Port)
 	redisPool, err := radix.NewPool("tcp", redisConnStr, 1)
 	if err == nil {
-
-		log.Infof("Cleanup: FLUSHING local on redis %s", redisConnStr)
-		redisPool.Do(radix.Cmd(nil, "FLUSHALL"))
+		flushed, err := trapyz.FlushRunData(redisPool, config)
+		if err != nil {
+			log.Errorf("Cleanup: error flushing local redis %s: %s", redisConnStr, err)
+		} else if flushed {
+			log.Infof("Cleanup: FLUSHED db 0 of local redis %s", redisConnStr)
+		} else {
+			log.Warnf("Cleanup: not flushing local redis %s, profiles share db 0", redisConnStr)
+		}
 		redisPool.Close()
 	}
 	os.Remove(pydir + "derive_stdin_stdout_log.log")
@@ -104,21 +117,7 @@ func configLogging(logCfg trapyz.OutputInfo) *os.File {
 	return f
 }
 
-func writer(records chan trapyz.GeoLocOutput, outFile *os.File) {
-	for rec := range records {
-		if rec.UID == "" {
-			fmt.Printf("Error Rec:%+v\n", rec)
-			continue
-		}
-		jstr, err := json.Marshal(rec)
-		if err != nil {
-			log.Errorf("Error jsonify record %+v : %s", rec, err)
-		}
-		outFile.WriteString(string(jstr) + "\n")
-	}
-}
-
-func validateAndSetDates(cfg *trapyz.Config) {
+func validateAndSetDates(cfg *trapyz.Config) (time.Time, time.Time) {
 	var start, end time.Time
 	var err error
 	if start, err = trapyz.ParseDate(fromDateHour); err != nil {
@@ -140,56 +139,113 @@ func validateAndSetDates(cfg *trapyz.Config) {
 	awsCfgInfo.DateFrom = fromDateHour
 	awsCfgInfo.DateTo = toDateHour
 	cfg.Aws[dbKey] = awsCfgInfo
+	return start, end
 }
 
-func runPipeline(ctx context.Context, config *trapyz.Config) {
+//runPipeline processes the window, the returned error fails the run
+func runPipeline(ctx context.Context, config *trapyz.Config) error {
 	fmt.Printf("%s :Run Pipeline started\n", time.Now())
+	done := runReport.StartStage("cleanup")
 	cleanup()
+	done()
 	connMgr := trapyz.NewConnMgr(config)
 	var nw = 4
 	if config.Nworkers > 0 {
 		nw = config.Nworkers
 	}
-	//log.Debugf("SQL Conn str [%s]\n", sqlConnStr)
-	db := connMgr.MustConnectMysql()
 	redisPool := connMgr.MustConnectRedis()
 	/* Rebuild Cache */
 	fmt.Printf("%s :Populating Redis Cache\n", time.Now())
-	cache, err := trapyz.MakeCache(db, redisPool, config)
+	done = runReport.StartStage("cache")
+	var cache *trapyz.Cache
+	var err error
+	if snapshotIn != "" {
+		cache, err = trapyz.LoadCacheSnapshot(ctx, redisPool, config, snapshotIn)
+	} else {
+		if snapshotOut != "" {
+			config.Snapshot.File = snapshotOut
+			config.Snapshot.Save = true
+		}
+		cache, err = trapyz.BuildCache(ctx, config)
+	}
 	if err != nil {
 		redisPool.Close()
-		db.Close()
 		log.Fatalln(err)
 	}
+	done()
 	/* Download S3 Files */
+	done = runReport.StartStage("s3_fetch")
 	s3pool := task.New(1)
 	s3pool.Start()
 	dbKey := trapyz.CfgKey(config, "s3")
 	fmt.Printf("%s :Fetching S3 Files from %s to %s\n", time.Now(), config.Aws[dbKey].DateFrom, config.Aws[dbKey].DateTo)
 	trapyz.S3FetchOnTimeRange(ctx, config, s3pool).Wait()
 	s3pool.Stop()
+	done()
 	/* Start The Log Writer */
-	os.MkdirAll(config.Output.Directory, 0755)
-	ofile := path.Join(config.Output.Directory, config.Output.File)
-	log.Infof("Creating outputfile %s", ofile)
-	outPutFile, err := os.Create(ofile)
+	out, err := sink.FromConfig(config, connMgr.MustConnectRedisUniques())
 	if err != nil {
-		log.Fatalf("Error unable to create outputfile:%s", err)
+		log.Fatalf("Error unable to create output sinks:%s", err)
 	}
-	defer outPutFile.Close()
+	//device profiles are derived from the records as they are written
+	out = append(out, sink.Counted(sink.NameProfiles, sink.NewProfileSink(config,
+		connMgr.MustConnectRedisProfiles(), connMgr.MustConnectDynamo())))
+	out.SetWindow(runReport.From, runReport.To)
 	outchan := make(chan trapyz.GeoLocOutput)
-	go writer(outchan, outPutFile)
+	writerDone := make(chan struct{})
+	go func() {
+		written, failed := sink.Consume(outchan, out)
+		log.Infof("Output records written:%d failed:%d", written, failed)
+		close(writerDone)
+	}()
 	/* Start the GeoStore workers and wait for them to finish */
 	workerPool := task.New(nw)
 	workerPool.Start()
 	fmt.Printf("%s :Processing json filling Geo stores data\n", time.Now())
-	trapyz.FillGeoStores(config, cache, redisPool, workerPool, outchan).Wait()
+	done = runReport.StartStage("geocalc")
+	trapyz.FillGeoStores(ctx, config, cache, redisPool, workerPool, outchan).Wait()
 	close(outchan)
+	<-writerDone
+	done()
+	done = runReport.StartStage("sinks_close")
+	closeErr := out.Close()
+	if closeErr != nil {
+		log.Errorf("Error closing output sinks:%s", closeErr)
+	}
+	done()
+	out.Report(runReport)
+	done = runReport.StartStage("upload")
+	uploadErr := uploadOutputs(ctx, config, out)
+	done()
 	workerPool.Stop()
+	//outputs that failed to close or upload fail the run
+	if closeErr == nil {
+		closeErr = uploadErr
+	}
+	return closeErr
+}
+
+//uploadOutputs copies the finished output partitions to the upload
+//destination, a failed upload leaves the local partitions in place to be
+//retried by the next run and fails this one
+func uploadOutputs(ctx context.Context, config *trapyz.Config, out sink.FanOut) error {
+	var conn s3iface.S3API
+	if file.IsS3(config.Output.Upload.Destination) {
+		conn = trapyz.NewConnMgr(config).MustConnectS3()
+	}
+	n, err := sink.Upload(ctx, config, out, conn)
+	if err != nil {
+		log.Errorf("Error uploading output partitions: %s", err)
+	}
+	if n > 0 {
+		log.Infof("Uploaded %d output files to %s", n, config.Output.Upload.Destination)
+	}
+	return err
 }
 
 func runExtras() {
-	log.Infoln("Populating dynamo DB and elasticsearch")
+	defer runReport.StartStage("extras")()
+	log.Infoln("Populating elasticsearch")
 	if curDir, err := os.Getwd(); err == nil {
 
 		log.Infof("current working directory:[%s]", curDir)
@@ -202,27 +258,13 @@ func runExtras() {
 		return
 	}
 	log.Infoln("Changed working dir to :/home/ubuntu/varunplay")
-	redisLocalKey := trapyz.CfgKey(config, "redis-local")
-	redisCfg := config.Db[redisLocalKey]
-	redisLocalPort := redisCfg.Port
-	outDirName := config.Output.Directory + "/"
-	numRecords := strconv.Itoa(config.NumRecords)
-	redisDirCache := config.Output.Redisdir
-	log.Infoln("Executing python3 GenerateDerivedAttributesInteractive.py ", outDirName,
-		"--localRedisPort", redisLocalPort, "--intermediateCache ", redisDirCache, "--linesToBeProcessed", numRecords)
-
-	cmd := exec.Command("python3", "GenerateDerivedAttributesInteractive.py", outDirName,
-		"--localRedisPort", redisLocalPort, "--intermediateCache", redisDirCache, "--linesToBeProcessed", numRecords)
-	err = cmd.Run()
-	if err != nil {
-		log.Errorf("Error Executing GenerateDerivedAttributesInteractive.py: %s", err)
-	}
-
-	log.Infoln("Executing python3 ElasticSearchAnalytics.py ")
-	cmdEs := exec.Command("python3", "ElasticSearchAnalytics.py")
-	err = cmdEs.Run()
-	if err != nil {
-		log.Errorf("Error executing ElasticSearchAnalytics.py: %s", err)
+	if !sink.Enabled(config, sink.NameElastic) {
+		log.Infoln("Executing python3 ElasticSearchAnalytics.py ")
+		cmdEs := exec.Command("python3", "ElasticSearchAnalytics.py")
+		err = cmdEs.Run()
+		if err != nil {
+			log.Errorf("Error executing ElasticSearchAnalytics.py: %s", err)
+		}
 	}
 	log.Infof("Pipeline run complete")
 }
@@ -236,18 +278,76 @@ func main() {
 		fmt.Printf("FATAL error parsing cfg file: %s ", err)
 		os.Exit(1)
 	}
-	validateAndSetDates(config)
+	from, to := validateAndSetDates(config)
 	if logFile != nil {
 		//Close the previous log file if any
 		logFile.Close()
 	}
 	//Configure a New logfile for this run
 	logFile = configLogging(config.Output)
+	runReport = newRunReport(from, to)
+	shutdown := startTracing(ctx)
+	log.RegisterExitHandler(func() {
+		writeReport(trapyz.ErrorRunAborted)
+		stopTracing(shutdown)
+	})
+	ctx = trapyz.ContextWithReport(ctx, runReport)
+	ctx, span := tracing.Start(ctx, "pipeline.run", attribute.String("from", fromDateHour),
+		attribute.String("to", toDateHour))
+	var runErr error
 	if !skipS3 {
-		runPipeline(ctx, config)
+		runErr = runPipeline(ctx, config)
 	}
 	if !skipDB {
+		_, espan := tracing.Start(ctx, "extras")
 		runExtras()
+		espan.End()
 	}
+	tracing.End(span, runErr)
+	writeReport(runErr)
+	stopTracing(shutdown)
 	logFile.Close()
 }
+
+//startTracing installs the configured span exporter, tracing stays
+//disabled if it can't be set up
+func startTracing(ctx context.Context) tracing.ShutdownFunc {
+	shutdown, err := tracing.Setup(ctx, trapyz.TracingConfig(config, "tpz-ipipeline"))
+	if err != nil {
+		log.Errorf("Error setting up tracing: %s", err)
+		return func(context.Context) error { return nil }
+	}
+	return shutdown
+}
+
+//stopTracing flushes the pending spans
+func stopTracing(shutdown tracing.ShutdownFunc) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := shutdown(ctx); err != nil {
+		log.Errorf("Error flushing trace spans: %s", err)
+	}
+}
+
+//newRunReport starts the run report for the window from, to
+func newRunReport(from, to time.Time) *trapyz.RunReport {
+	report := trapyz.NewRunReport("tpz-ipipeline", from, to)
+	hash, err := trapyz.ConfigHash(cfgFile)
+	if err != nil {
+		log.Errorf("Error hashing config file: %s", err)
+	}
+	report.ConfigHash = hash
+	return report
+}
+
+//writeReport finishes the run report with err and writes it to the
+//report directory
+func writeReport(err error) {
+	runReport.Finish(err)
+	name, err := runReport.WriteFile(trapyz.ReportDir(config))
+	if err != nil {
+		log.Errorf("Error writing run report: %s", err)
+		return
+	}
+	log.Infof("Run report written to %s status:%s", name, runReport.Status)
+}
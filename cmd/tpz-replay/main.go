@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/bamarb/aws-pipeline-go/pkg/sink"
+	"github.com/bamarb/aws-pipeline-go/pkg/task"
+	"github.com/bamarb/aws-pipeline-go/pkg/trapyz"
+	_ "github.com/go-sql-driver/mysql"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	cfgFile     string
+	classes     string
+	reasons     string
+	replayDir   string
+	outFile     string
+	snapshotIn  string
+	keepReplays bool
+)
+
+func init() {
+	flag.StringVar(&cfgFile, "f", "config.toml", "# Path to cfg file (.toml)")
+	flag.StringVar(&classes, "class", "lookup", "Comma separated error classes to replay: parse, validation, lookup")
+	flag.StringVar(&reasons, "reason", "", "Comma separated rejection reasons to replay, empty replays all")
+	flag.StringVar(&replayDir, "dir", "", "New or empty directory for the replay input files, kept after the replay. Defaults to a temporary directory")
+	flag.StringVar(&outFile, "o", "replay.out", "Output file name, replaces the configured output file")
+	flag.StringVar(&snapshotIn, "snapshot-in", "", "Build the cache from this snapshot file instead of mysql")
+	flag.BoolVar(&keepReplays, "keep", false, "Keep the replay input files in the temporary directory")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [flags] deadletter.ndjson...\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+}
+
+func set(list string) map[string]bool {
+	s := make(map[string]bool)
+	for _, v := range strings.Split(list, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			s[v] = true
+		}
+	}
+	return s
+}
+
+//replay runs the replay input files through the geo calculator and the
+//configured sinks. Records rejected again go to a new dead letter file
+func replay(ctx context.Context, config *trapyz.Config, dir string) error {
+	connMgr := trapyz.NewConnMgr(config)
+	redisPool := connMgr.MustConnectRedis()
+	var cache *trapyz.Cache
+	var err error
+	if snapshotIn != "" {
+		cache, err = trapyz.LoadCacheSnapshot(ctx, redisPool, config, snapshotIn)
+	} else {
+		cache, err = trapyz.BuildCache(ctx, config)
+	}
+	if err != nil {
+		return err
+	}
+	out, err := sink.FromConfig(config, connMgr.MustConnectRedisUniques())
+	if err != nil {
+		return err
+	}
+	outchan := make(chan trapyz.GeoLocOutput)
+	writerDone := make(chan struct{})
+	go func() {
+		written, failed := sink.Consume(outchan, out)
+		log.Infof("Replayed output records written:%d failed:%d", written, failed)
+		close(writerDone)
+	}()
+	var nw = 4
+	if config.Nworkers > 0 {
+		nw = config.Nworkers
+	}
+	workerPool := task.New(nw)
+	workerPool.Start()
+	trapyz.FillGeoStoresFrom(ctx, dir, config, cache, redisPool, workerPool, outchan).Wait()
+	close(outchan)
+	<-writerDone
+	workerPool.Stop()
+	return out.Close()
+}
+
+func main() {
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(1)
+	}
+	var config *trapyz.Config
+	if _, err := toml.DecodeFile(cfgFile, &config); err != nil {
+		fmt.Printf("FATAL error parsing cfg file: %s ", err)
+		os.Exit(1)
+	}
+	classSet, reasonSet := set(classes), set(reasons)
+	keep := func(dl trapyz.DeadLetter) bool {
+		return classSet[dl.Class] && (len(reasonSet) == 0 || reasonSet[dl.Reason])
+	}
+	//only a temporary directory created here is removed, a -dir given
+	//must be new or empty and is kept
+	dir := replayDir
+	cleanup := func() {}
+	if dir == "" {
+		tmp, err := ioutil.TempDir("", "tpz-replay")
+		if err != nil {
+			log.Fatalln(err)
+		}
+		dir = tmp
+		if !keepReplays {
+			cleanup = func() { os.RemoveAll(tmp) }
+		}
+	}
+	defer cleanup()
+	//replay lines carry createdAt in milliseconds whatever the source format
+	s3Key := trapyz.CfgKey(config, "s3")
+	s3Cfg := config.Aws[s3Key]
+	n, err := trapyz.WriteReplayInput(flag.Args(), dir, keep, s3Cfg.ScaleTime)
+	if err != nil {
+		log.Errorln(err)
+		cleanup()
+		os.Exit(1)
+	}
+	log.Infof("Replaying %d dead lettered records from %s", n, dir)
+	if n == 0 {
+		return
+	}
+	//replay files are json lines whatever the original format, the
+	//replayed output must not replace the last run's output files or
+	//take over the visits it left open
+	config.Input.Format = "ndjson"
+	config.Input.Prefixes = nil
+	s3Cfg.ScaleTime = false
+	config.Aws[s3Key] = s3Cfg
+	config.Output.File = outFile
+	if config.Output.VisitsFile == "" {
+		config.Output.VisitsFile = "visits.out"
+	}
+	config.Output.VisitsFile = "replay-" + config.Output.VisitsFile
+	config.Visits.OpenFile = ""
+	if err := replay(context.Background(), config, dir); err != nil {
+		log.Errorf("Replay failed: %s", err)
+		cleanup()
+		os.Exit(1)
+	}
+	log.Infof("Replay complete, output in %s", config.Output.File)
+}
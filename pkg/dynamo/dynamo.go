@@ -0,0 +1,227 @@
+//Package dynamo writes records to a DynamoDB table with BatchWriteItem,
+//or with conditional PutItem calls for idempotent re-runs
+package dynamo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+//BatchSize the most items BatchWriteItem accepts in one call
+const BatchSize = 25
+
+//Defaults used when the config leaves a value unset
+const (
+	DefaultMaxRetries = 5
+	DefaultRetryWait  = 100 * time.Millisecond
+)
+
+//Item a DynamoDB item
+type Item map[string]*dynamodb.AttributeValue
+
+//Config table and write settings. In conditional mode an item is only
+//written if it is new or its VersionAttr is greater than the stored one,
+//so re-running a window does not overwrite newer data
+type Config struct {
+	Table       string
+	HashKey     string
+	RangeKey    string
+	Conditional bool
+	VersionAttr string
+	MaxRetries  int
+	RetryWait   time.Duration
+}
+
+//Stats counts of items handled by the writer
+type Stats struct {
+	Written     uint64
+	Skipped     uint64
+	Retried     uint64
+	Unprocessed uint64
+	Calls       uint64
+}
+
+//Writer buffers items and writes them in batches. It is not safe for
+//concurrent use
+type Writer struct {
+	api     dynamodbiface.DynamoDBAPI
+	cfg     Config
+	ctx     context.Context
+	pending []*dynamodb.WriteRequest
+	stats   Stats
+}
+
+//NewWriter constructs a writer for the configured table
+func NewWriter(ctx context.Context, api dynamodbiface.DynamoDBAPI, cfg Config) (*Writer, error) {
+	if cfg.Table == "" || cfg.HashKey == "" {
+		return nil, errors.New("dynamo: table and hash_key are required")
+	}
+	if cfg.Conditional && cfg.VersionAttr == "" {
+		return nil, errors.New("dynamo: conditional mode requires version_attr")
+	}
+	if cfg.MaxRetries == 0 {
+		cfg.MaxRetries = DefaultMaxRetries
+	}
+	if cfg.RetryWait == 0 {
+		cfg.RetryWait = DefaultRetryWait
+	}
+	return &Writer{api: api, cfg: cfg, ctx: ctx}, nil
+}
+
+//Write queues an item, a full batch is written immediately
+func (w *Writer) Write(item Item) error {
+	if err := w.checkKeys(item); err != nil {
+		return err
+	}
+	if w.cfg.Conditional {
+		return w.putConditional(item)
+	}
+	w.pending = append(w.pending, &dynamodb.WriteRequest{PutRequest: &dynamodb.PutRequest{Item: item}})
+	if len(w.pending) >= BatchSize {
+		return w.Flush()
+	}
+	return nil
+}
+
+//Flush writes the queued items. On error the items not written are
+//counted as unprocessed and dropped
+func (w *Writer) Flush() error {
+	for len(w.pending) > 0 {
+		n := len(w.pending)
+		if n > BatchSize {
+			n = BatchSize
+		}
+		batch := w.pending[:n]
+		w.pending = w.pending[n:]
+		if err := w.batchWrite(batch); err != nil {
+			w.stats.Unprocessed += uint64(len(w.pending))
+			w.pending = nil
+			return err
+		}
+	}
+	return nil
+}
+
+//Close flushes the queued items
+func (w *Writer) Close() error {
+	return w.Flush()
+}
+
+//Stats returns the counts so far
+func (w *Writer) Stats() Stats {
+	return w.stats
+}
+
+func (w *Writer) checkKeys(item Item) error {
+	if item[w.cfg.HashKey] == nil {
+		return fmt.Errorf("dynamo: item without hash key %s", w.cfg.HashKey)
+	}
+	if w.cfg.RangeKey != "" && item[w.cfg.RangeKey] == nil {
+		return fmt.Errorf("dynamo: item without range key %s", w.cfg.RangeKey)
+	}
+	return nil
+}
+
+//batchWrite writes a batch resending unprocessed items with a growing
+//wait, the items of a failed batch are counted as unprocessed
+func (w *Writer) batchWrite(batch []*dynamodb.WriteRequest) error {
+	for attempt := 0; ; attempt++ {
+		w.stats.Calls++
+		out, err := w.api.BatchWriteItemWithContext(w.ctx, &dynamodb.BatchWriteItemInput{
+			RequestItems: map[string][]*dynamodb.WriteRequest{w.cfg.Table: batch},
+		})
+		var unprocessed []*dynamodb.WriteRequest
+		if err != nil {
+			if !retryable(err) {
+				w.stats.Unprocessed += uint64(len(batch))
+				return err
+			}
+			unprocessed = batch
+		} else if out != nil {
+			unprocessed = out.UnprocessedItems[w.cfg.Table]
+		}
+		w.stats.Written += uint64(len(batch) - len(unprocessed))
+		if len(unprocessed) == 0 {
+			return nil
+		}
+		if attempt >= w.cfg.MaxRetries {
+			w.stats.Unprocessed += uint64(len(unprocessed))
+			return fmt.Errorf("dynamo: %d items unprocessed after %d retries", len(unprocessed), attempt)
+		}
+		w.stats.Retried += uint64(len(unprocessed))
+		batch = unprocessed
+		if err := w.wait(attempt); err != nil {
+			w.stats.Unprocessed += uint64(len(batch))
+			return err
+		}
+	}
+}
+
+//putConditional writes an item unless the stored copy has the same or
+//a newer version
+func (w *Writer) putConditional(item Item) error {
+	in := &dynamodb.PutItemInput{
+		TableName:           aws.String(w.cfg.Table),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(#h) OR #v < :v"),
+		ExpressionAttributeNames: map[string]*string{
+			"#h": aws.String(w.cfg.HashKey),
+			"#v": aws.String(w.cfg.VersionAttr),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{":v": item[w.cfg.VersionAttr]},
+	}
+	if item[w.cfg.VersionAttr] == nil {
+		return fmt.Errorf("dynamo: item without version %s", w.cfg.VersionAttr)
+	}
+	for attempt := 0; ; attempt++ {
+		w.stats.Calls++
+		_, err := w.api.PutItemWithContext(w.ctx, in)
+		if err == nil {
+			w.stats.Written++
+			return nil
+		}
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+			w.stats.Skipped++
+			return nil
+		}
+		if !retryable(err) || attempt >= w.cfg.MaxRetries {
+			w.stats.Unprocessed++
+			return err
+		}
+		w.stats.Retried++
+		if err := w.wait(attempt); err != nil {
+			w.stats.Unprocessed++
+			return err
+		}
+	}
+}
+
+func (w *Writer) wait(attempt int) error {
+	select {
+	case <-time.After(w.cfg.RetryWait << uint(attempt)):
+		return nil
+	case <-w.ctx.Done():
+		return w.ctx.Err()
+	}
+}
+
+//retryable throttling errors
+func retryable(err error) bool {
+	aerr, ok := err.(awserr.Error)
+	if !ok {
+		return false
+	}
+	switch aerr.Code() {
+	case dynamodb.ErrCodeProvisionedThroughputExceededException, "ThrottlingException",
+		"RequestLimitExceeded", "InternalServerError":
+		return true
+	}
+	return false
+}
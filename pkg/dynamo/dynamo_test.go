@@ -0,0 +1,167 @@
+package dynamo
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/bamarb/aws-pipeline-go/pkg/profile"
+	"github.com/stretchr/testify/assert"
+)
+
+//fakeDynamo an in memory table keyed on gid. BatchWriteItem leaves
+//the last item of each call unprocessed the first time it is seen
+type fakeDynamo struct {
+	dynamodbiface.DynamoDBAPI
+	fail    error
+	items   map[string]Item
+	seen    map[string]bool
+	batches []int
+}
+
+func newFakeDynamo() *fakeDynamo {
+	return &fakeDynamo{items: make(map[string]Item), seen: make(map[string]bool)}
+}
+
+func (f *fakeDynamo) BatchWriteItemWithContext(ctx aws.Context, in *dynamodb.BatchWriteItemInput,
+	opts ...request.Option) (*dynamodb.BatchWriteItemOutput, error) {
+	if f.fail != nil {
+		return nil, f.fail
+	}
+	out := &dynamodb.BatchWriteItemOutput{UnprocessedItems: map[string][]*dynamodb.WriteRequest{}}
+	for table, reqs := range in.RequestItems {
+		f.batches = append(f.batches, len(reqs))
+		for i, r := range reqs {
+			gid := aws.StringValue(r.PutRequest.Item["gid"].S)
+			if i == len(reqs)-1 && !f.seen[gid] {
+				f.seen[gid] = true
+				out.UnprocessedItems[table] = append(out.UnprocessedItems[table], r)
+				continue
+			}
+			f.items[gid] = r.PutRequest.Item
+		}
+	}
+	return out, nil
+}
+
+func (f *fakeDynamo) PutItemWithContext(ctx aws.Context, in *dynamodb.PutItemInput,
+	opts ...request.Option) (*dynamodb.PutItemOutput, error) {
+	gid := aws.StringValue(in.Item["gid"].S)
+	if prev, ok := f.items[gid]; ok && in.ConditionExpression != nil {
+		vattr := aws.StringValue(in.ExpressionAttributeNames["#v"])
+		stored, _ := strconv.ParseInt(aws.StringValue(prev[vattr].N), 10, 64)
+		next, _ := strconv.ParseInt(aws.StringValue(in.ExpressionAttributeValues[":v"].N), 10, 64)
+		if stored >= next {
+			return nil, awserr.New(dynamodb.ErrCodeConditionalCheckFailedException, "condition failed", nil)
+		}
+	}
+	f.items[gid] = in.Item
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+func testProfile(gid string, lastSeen int64) *profile.Profile {
+	p := profile.New(gid)
+	p.LastSeen = lastSeen
+	return p
+}
+
+func TestBatchWrite(t *testing.T) {
+	assert := assert.New(t)
+	fake := newFakeDynamo()
+	w, err := NewWriter(context.Background(), fake, Config{Table: "profiles", HashKey: "gid",
+		RetryWait: time.Millisecond})
+	assert.Nil(err)
+	for i := 0; i < 30; i++ {
+		assert.Nil(w.Write(ProfileItem(testProfile("g"+strconv.Itoa(i), 1), "gid")))
+	}
+	assert.Nil(w.Close())
+	assert.Len(fake.items, 30)
+	//25, the unprocessed retry of 1, then the remaining 5 and its retry
+	assert.Equal([]int{25, 1, 5, 1}, fake.batches)
+	assert.Equal(Stats{Written: 30, Retried: 2, Calls: 4}, w.Stats())
+
+	assert.Error(w.Write(Item{"other": S("x")}))
+	_, err = NewWriter(context.Background(), fake, Config{Table: "profiles"})
+	assert.Error(err)
+}
+
+func TestBatchWriteError(t *testing.T) {
+	assert := assert.New(t)
+	fake := newFakeDynamo()
+	fake.fail = awserr.New("ValidationException", "no such table", nil)
+	w, err := NewWriter(context.Background(), fake, Config{Table: "profiles", HashKey: "gid",
+		RetryWait: time.Millisecond})
+	assert.Nil(err)
+	for i := 0; i < 10; i++ {
+		assert.Nil(w.Write(ProfileItem(testProfile("g"+strconv.Itoa(i), 1), "gid")))
+	}
+	//the failed items are counted, not silently dropped
+	assert.Error(w.Close())
+	assert.Equal(Stats{Unprocessed: 10, Calls: 1}, w.Stats())
+	assert.Empty(fake.items)
+}
+
+func TestConditionalWrite(t *testing.T) {
+	assert := assert.New(t)
+	fake := newFakeDynamo()
+	w, err := NewWriter(context.Background(), fake, Config{Table: "profiles", HashKey: "gid",
+		Conditional: true, VersionAttr: "last_seen"})
+	assert.Nil(err)
+	assert.Nil(w.Write(ProfileItem(testProfile("g1", 100), "gid")))
+	//a re-run of the same window and an older profile are skipped
+	assert.Nil(w.Write(ProfileItem(testProfile("g1", 100), "gid")))
+	assert.Nil(w.Write(ProfileItem(testProfile("g1", 50), "gid")))
+	assert.Nil(w.Write(ProfileItem(testProfile("g1", 200), "gid")))
+	assert.Equal("200", aws.StringValue(fake.items["g1"]["last_seen"].N))
+	assert.Equal(uint64(2), w.Stats().Written)
+	assert.Equal(uint64(2), w.Stats().Skipped)
+}
+
+//TestDynamoLocal runs against DynamoDB Local when DYNAMODB_ENDPOINT is set,
+//eg: docker run -p 8000:8000 amazon/dynamodb-local
+func TestDynamoLocal(t *testing.T) {
+	endpoint := os.Getenv("DYNAMODB_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("DYNAMODB_ENDPOINT not set")
+	}
+	assert := assert.New(t)
+	ctx := context.Background()
+	sess, err := session.NewSessionWithOptions(session.Options{
+		Config: aws.Config{Region: aws.String("us-east-1"), Endpoint: aws.String(endpoint)},
+	})
+	assert.Nil(err)
+	api := dynamodb.New(sess)
+	table := "profiles_test_" + strconv.FormatInt(time.Now().UnixNano(), 10)
+	_, err = api.CreateTableWithContext(ctx, &dynamodb.CreateTableInput{
+		TableName: aws.String(table),
+		AttributeDefinitions: []*dynamodb.AttributeDefinition{
+			{AttributeName: aws.String("gid"), AttributeType: aws.String("S")}},
+		KeySchema: []*dynamodb.KeySchemaElement{
+			{AttributeName: aws.String("gid"), KeyType: aws.String("HASH")}},
+		ProvisionedThroughput: &dynamodb.ProvisionedThroughput{
+			ReadCapacityUnits: aws.Int64(5), WriteCapacityUnits: aws.Int64(5)},
+	})
+	if !assert.Nil(err) {
+		return
+	}
+	defer api.DeleteTableWithContext(ctx, &dynamodb.DeleteTableInput{TableName: aws.String(table)})
+
+	w, err := NewWriter(ctx, api, Config{Table: table, HashKey: "gid", Conditional: true, VersionAttr: "last_seen"})
+	assert.Nil(err)
+	assert.Nil(w.Write(ProfileItem(testProfile("g1", 100), "gid")))
+	assert.Nil(w.Write(ProfileItem(testProfile("g1", 100), "gid")))
+	assert.Equal(uint64(1), w.Stats().Skipped)
+
+	out, err := api.GetItemWithContext(ctx, &dynamodb.GetItemInput{TableName: aws.String(table),
+		Key: Item{"gid": S("g1")}})
+	assert.Nil(err)
+	assert.Equal("100", aws.StringValue(out.Item["last_seen"].N))
+}
@@ -0,0 +1,51 @@
+package dynamo
+
+import (
+	"strconv"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/bamarb/aws-pipeline-go/pkg/profile"
+	"github.com/bamarb/aws-pipeline-go/pkg/trapyz"
+)
+
+//S a string attribute
+func S(s string) *dynamodb.AttributeValue {
+	return &dynamodb.AttributeValue{S: aws.String(s)}
+}
+
+//N an integer attribute
+func N(n int64) *dynamodb.AttributeValue {
+	return &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(n, 10))}
+}
+
+//F a float attribute
+func F(f float64) *dynamodb.AttributeValue {
+	return &dynamodb.AttributeValue{N: aws.String(strconv.FormatFloat(f, 'f', -1, 64))}
+}
+
+//ProfileItem a device profile keyed on hashKey, last_seen is the version
+//used in conditional mode
+func ProfileItem(p *profile.Profile, hashKey string) Item {
+	cats := make([]*dynamodb.AttributeValue, len(p.TopCats))
+	for i, c := range p.TopCats {
+		cats[i] = S(c.String())
+	}
+	return Item{
+		hashKey:           S(p.Gid),
+		"top_cats":        {L: cats},
+		"home_city":       S(p.HomeCity.String()),
+		"pings":           N(p.Pings),
+		"visits":          N(int64(p.Visits)),
+		"visits_per_week": F(p.Frequency),
+		"recency_days":    N(int64(p.Recency)),
+		"first_seen":      N(p.FirstSeen),
+		"last_seen":       N(p.LastSeen),
+	}
+}
+
+//ConfigFrom converts an [aws.dynamo-*] config section
+func ConfigFrom(info trapyz.AwsS3Info) Config {
+	return Config{Table: info.Table, HashKey: info.HashKey, RangeKey: info.RangeKey,
+		Conditional: info.Conditional, VersionAttr: info.VersionAttr}
+}
@@ -0,0 +1,354 @@
+//Package elastic streams documents to the elasticsearch _bulk api
+package elastic
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bamarb/aws-pipeline-go/pkg/batcher"
+	log "github.com/sirupsen/logrus"
+)
+
+//Defaults used when the config leaves a value unset
+const (
+	DefaultDateFormat    = "2006.01.02"
+	DefaultMaxItems      = 1000
+	DefaultMaxBytes      = 5 * 1024 * 1024
+	DefaultFlushInterval = 5 * time.Second
+	DefaultMaxRetries    = 3
+	DefaultRetryWait     = time.Second
+)
+
+//Config bulk sink settings
+type Config struct {
+	URL           string
+	Username      string
+	Password      string
+	IndexPrefix   string
+	DateFormat    string
+	DocType       string
+	TemplateName  string
+	TemplateFile  string
+	MaxItems      uint
+	MaxBytes      uint
+	FlushInterval time.Duration
+	MaxRetries    int
+	RetryWait     time.Duration
+}
+
+func (c *Config) setDefaults() {
+	if c.DateFormat == "" {
+		c.DateFormat = DefaultDateFormat
+	}
+	if c.MaxItems == 0 {
+		c.MaxItems = DefaultMaxItems
+	}
+	if c.MaxBytes == 0 {
+		c.MaxBytes = DefaultMaxBytes
+	}
+	if c.FlushInterval == 0 {
+		c.FlushInterval = DefaultFlushInterval
+	}
+	if c.MaxRetries == 0 {
+		c.MaxRetries = DefaultMaxRetries
+	}
+	if c.RetryWait == 0 {
+		c.RetryWait = DefaultRetryWait
+	}
+	c.URL = strings.TrimRight(c.URL, "/")
+}
+
+//bulkItem a document ready to send, the action line and source
+type bulkItem struct {
+	index string
+	id    string
+	body  []byte
+}
+
+func itemBytes(i interface{}) uint {
+	return uint(len(i.(*bulkItem).body))
+}
+
+//Stats counts of documents handled by the sink
+type Stats struct {
+	Indexed  uint64
+	Retried  uint64
+	Rejected uint64
+	Batches  uint64
+}
+
+//BulkSink batches documents by count and bytes and sends them to _bulk
+//from a background goroutine. Documents rejected with a retryable status
+//are resent up to MaxRetries times
+type BulkSink struct {
+	cfg     Config
+	client  *http.Client
+	batch   batcher.Batcher
+	pending sync.WaitGroup
+	done    chan struct{}
+	lock    sync.Mutex
+	stats   Stats
+	err     error
+}
+
+//NewBulkSink constructs a sink and installs the index template if
+//one is configured
+func NewBulkSink(cfg Config, client *http.Client) (*BulkSink, error) {
+	cfg.setDefaults()
+	if cfg.URL == "" {
+		return nil, errors.New("elastic: url is required")
+	}
+	if client == nil {
+		client = &http.Client{Timeout: time.Minute}
+	}
+	b, err := batcher.New(cfg.FlushInterval, cfg.MaxItems, cfg.MaxBytes, 4, itemBytes)
+	if err != nil {
+		return nil, err
+	}
+	es := &BulkSink{cfg: cfg, client: client, batch: b, done: make(chan struct{})}
+	if cfg.TemplateFile != "" {
+		if err := es.PutTemplate(); err != nil {
+			return nil, err
+		}
+	}
+	go es.run()
+	return es, nil
+}
+
+//IndexName returns the dated index a document created at t goes to
+func (es *BulkSink) IndexName(t time.Time) string {
+	return es.cfg.IndexPrefix + "-" + t.UTC().Format(es.cfg.DateFormat)
+}
+
+//PutTemplate installs the template from TemplateFile. If the template
+//has no index_patterns it is applied to all indices of the prefix
+func (es *BulkSink) PutTemplate() error {
+	data, err := ioutil.ReadFile(es.cfg.TemplateFile)
+	if err != nil {
+		return err
+	}
+	var tmpl map[string]interface{}
+	if err := json.Unmarshal(data, &tmpl); err != nil {
+		return fmt.Errorf("elastic: invalid template %s: %s", es.cfg.TemplateFile, err)
+	}
+	if _, ok := tmpl["index_patterns"]; !ok {
+		tmpl["index_patterns"] = []string{es.cfg.IndexPrefix + "-*"}
+	}
+	if data, err = json.Marshal(tmpl); err != nil {
+		return err
+	}
+	name := es.cfg.TemplateName
+	if name == "" {
+		name = es.cfg.IndexPrefix
+	}
+	resp, err := es.do("PUT", "/_template/"+name, "application/json", data)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("elastic: put template %s: %s %s", name, resp.Status, body)
+	}
+	return nil
+}
+
+//Write queues a document for the index of its creation time, an empty
+//id lets elasticsearch assign one
+func (es *BulkSink) Write(id string, created time.Time, doc interface{}) error {
+	body, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	es.pending.Add(1)
+	if err := es.batch.Put(&bulkItem{index: es.IndexName(created), id: id, body: body}); err != nil {
+		es.pending.Done()
+		return err
+	}
+	return nil
+}
+
+//Flush sends the documents queued so far and waits for them. It returns
+//an error if any document was dropped since the last Flush. Write may be
+//called from several goroutines but not concurrently with Flush
+func (es *BulkSink) Flush() error {
+	if err := es.batch.Flush(); err != nil {
+		return err
+	}
+	es.pending.Wait()
+	es.lock.Lock()
+	defer es.lock.Unlock()
+	err := es.err
+	es.err = nil
+	return err
+}
+
+//Close flushes and stops the sink
+func (es *BulkSink) Close() error {
+	err := es.Flush()
+	es.batch.Dispose()
+	<-es.done
+	return err
+}
+
+//Stats returns the counts so far
+func (es *BulkSink) Stats() Stats {
+	es.lock.Lock()
+	defer es.lock.Unlock()
+	return es.stats
+}
+
+func (es *BulkSink) run() {
+	defer close(es.done)
+	for {
+		items, err := es.batch.Get()
+		if err == batcher.ErrDisposed {
+			return
+		}
+		if len(items) == 0 {
+			continue
+		}
+		batch := make([]*bulkItem, len(items))
+		for i, it := range items {
+			batch[i] = it.(*bulkItem)
+		}
+		es.send(batch)
+		es.pending.Add(-len(items))
+	}
+}
+
+//send posts a batch, resending the items rejected with a retryable status
+func (es *BulkSink) send(batch []*bulkItem) {
+	for attempt := 0; len(batch) > 0; attempt++ {
+		if attempt > 0 {
+			if attempt > es.cfg.MaxRetries {
+				es.reject(len(batch), fmt.Errorf("elastic: %d documents dropped after %d retries", len(batch), es.cfg.MaxRetries))
+				return
+			}
+			es.count(func(s *Stats) { s.Retried += uint64(len(batch)) })
+			time.Sleep(es.cfg.RetryWait * time.Duration(attempt))
+		}
+		retry, err := es.post(batch)
+		if err != nil {
+			log.Errorf("Elastic bulk request failed: %s", err)
+			continue
+		}
+		batch = retry
+	}
+}
+
+func (es *BulkSink) count(fn func(s *Stats)) {
+	es.lock.Lock()
+	fn(&es.stats)
+	es.lock.Unlock()
+}
+
+func (es *BulkSink) reject(n int, err error) {
+	es.lock.Lock()
+	es.stats.Rejected += uint64(n)
+	if es.err == nil {
+		es.err = err
+	}
+	es.lock.Unlock()
+	log.Errorln(err)
+}
+
+type bulkResponse struct {
+	Errors bool `json:"errors"`
+	Items  []map[string]struct {
+		Status int             `json:"status"`
+		Error  json.RawMessage `json:"error"`
+	} `json:"items"`
+}
+
+//retryable statuses, the cluster was busy or failed on that shard
+func retryable(status int) bool {
+	return status == http.StatusTooManyRequests || status >= 500
+}
+
+//post sends one bulk request and returns the items to retry. An error
+//means the whole request should be retried
+func (es *BulkSink) post(batch []*bulkItem) ([]*bulkItem, error) {
+	var buf bytes.Buffer
+	for _, it := range batch {
+		meta := map[string]string{"_index": it.index}
+		if it.id != "" {
+			meta["_id"] = it.id
+		}
+		if es.cfg.DocType != "" {
+			meta["_type"] = es.cfg.DocType
+		}
+		action, _ := json.Marshal(map[string]map[string]string{"index": meta})
+		buf.Write(action)
+		buf.WriteByte('\n')
+		buf.Write(it.body)
+		buf.WriteByte('\n')
+	}
+	resp, err := es.do("POST", "/_bulk", "application/x-ndjson", buf.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500 {
+		return nil, fmt.Errorf("bulk status %s", resp.Status)
+	}
+	if resp.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		es.reject(len(batch), fmt.Errorf("elastic: %d documents rejected: %s %s", len(batch), resp.Status, body))
+		return nil, nil
+	}
+	var br bulkResponse
+	if err := json.NewDecoder(resp.Body).Decode(&br); err != nil {
+		return nil, err
+	}
+	es.count(func(s *Stats) { s.Batches++ })
+	if !br.Errors {
+		es.count(func(s *Stats) { s.Indexed += uint64(len(batch)) })
+		return nil, nil
+	}
+	var retry []*bulkItem
+	var indexed, failed int
+	var firstErr json.RawMessage
+	for i, res := range br.Items {
+		if i >= len(batch) {
+			break
+		}
+		for _, r := range res {
+			switch {
+			case r.Status/100 == 2:
+				indexed++
+			case retryable(r.Status):
+				retry = append(retry, batch[i])
+			default:
+				failed++
+				if firstErr == nil {
+					firstErr = r.Error
+				}
+			}
+		}
+	}
+	es.count(func(s *Stats) { s.Indexed += uint64(indexed) })
+	if failed > 0 {
+		es.reject(failed, fmt.Errorf("elastic: %d documents rejected: %s", failed, firstErr))
+	}
+	return retry, nil
+}
+
+func (es *BulkSink) do(method, path, contentType string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest(method, es.cfg.URL+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	if es.cfg.Username != "" {
+		req.SetBasicAuth(es.cfg.Username, es.cfg.Password)
+	}
+	return es.client.Do(req)
+}
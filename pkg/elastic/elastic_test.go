@@ -0,0 +1,133 @@
+package elastic
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bamarb/aws-pipeline-go/pkg/trapyz"
+	"github.com/stretchr/testify/assert"
+)
+
+//fakeES records bulk requests, the first time it sees a document listed
+//in busy it rejects it with 429 and documents in bad are always rejected
+type fakeES struct {
+	lock      sync.Mutex
+	template  map[string]interface{}
+	indexed   map[string]string
+	requests  int
+	busy, bad map[string]bool
+}
+
+func newFakeES() *fakeES {
+	return &fakeES{indexed: make(map[string]string), busy: make(map[string]bool), bad: make(map[string]bool)}
+}
+
+func (f *fakeES) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	switch {
+	case r.Method == "PUT" && strings.HasPrefix(r.URL.Path, "/_template/"):
+		json.NewDecoder(r.Body).Decode(&f.template)
+		fmt.Fprint(w, `{"acknowledged":true}`)
+	case r.Method == "POST" && r.URL.Path == "/_bulk":
+		f.requests++
+		var items []string
+		hasErrors := false
+		scanner := bufio.NewScanner(r.Body)
+		for scanner.Scan() {
+			var action map[string]map[string]string
+			json.Unmarshal(scanner.Bytes(), &action)
+			scanner.Scan()
+			meta := action["index"]
+			id := meta["_id"]
+			status := 201
+			if f.busy[id] {
+				delete(f.busy, id)
+				status = 429
+			} else if f.bad[id] {
+				status = 400
+			} else {
+				f.indexed[id] = meta["_index"]
+			}
+			if status != 201 {
+				hasErrors = true
+			}
+			items = append(items, fmt.Sprintf(`{"index":{"_id":"%s","status":%d}}`, id, status))
+		}
+		fmt.Fprintf(w, `{"took":1,"errors":%t,"items":[%s]}`, hasErrors, strings.Join(items, ","))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func rec(gid string, at time.Time) trapyz.GeoLocOutput {
+	return trapyz.GeoLocOutput{Gid: gid, UID: "s1", Lat: "12.9", Lng: "77.6",
+		Createdat: fmt.Sprint(at.UnixNano() / int64(time.Millisecond))}
+}
+
+func TestBulkSink(t *testing.T) {
+	assert := assert.New(t)
+	fake := newFakeES()
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	tmpl, err := ioutil.TempFile("", "template")
+	assert.Nil(err)
+	defer os.Remove(tmpl.Name())
+	tmpl.WriteString(`{"mappings":{"_doc":{"properties":{"location":{"type":"geo_point"}}}}}`)
+	tmpl.Close()
+
+	day1 := time.Date(2018, 9, 6, 23, 30, 0, 0, time.UTC)
+	day2 := day1.Add(time.Hour)
+	fake.busy[RecordID(rec("g3", day1))] = true
+	fake.bad[RecordID(rec("g4", day2))] = true
+
+	es, err := NewBulkSink(Config{URL: srv.URL, IndexPrefix: "geoloc", TemplateFile: tmpl.Name(),
+		MaxItems: 2, RetryWait: time.Millisecond}, nil)
+	assert.Nil(err)
+	assert.Equal([]interface{}{"geoloc-*"}, fake.template["index_patterns"])
+
+	for _, gid := range []string{"g1", "g2", "g3"} {
+		assert.Nil(es.WriteRecord(rec(gid, day1)))
+	}
+	assert.Nil(es.WriteRecord(rec("g4", day2)))
+	assert.Nil(es.WriteRecord(rec("g5", day2)))
+	err = es.Close()
+	assert.Error(err)
+
+	assert.Len(fake.indexed, 4)
+	assert.Equal("geoloc-2018.09.06", fake.indexed[RecordID(rec("g3", day1))])
+	assert.Equal("geoloc-2018.09.07", fake.indexed[RecordID(rec("g5", day2))])
+	stats := es.Stats()
+	assert.Equal(uint64(4), stats.Indexed)
+	assert.Equal(uint64(1), stats.Retried)
+	assert.Equal(uint64(1), stats.Rejected)
+}
+
+func TestBulkSinkRetryExhausted(t *testing.T) {
+	assert := assert.New(t)
+	var calls int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+	es, err := NewBulkSink(Config{URL: srv.URL, IndexPrefix: "geoloc", MaxRetries: 2,
+		RetryWait: time.Millisecond}, nil)
+	assert.Nil(err)
+	assert.Nil(es.Write("1", time.Now(), map[string]string{"a": "b"}))
+	assert.Error(es.Flush())
+	assert.Equal(3, calls)
+	assert.Equal(uint64(1), es.Stats().Rejected)
+	//the error is reported once
+	assert.Nil(es.Close())
+}
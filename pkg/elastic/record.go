@@ -0,0 +1,46 @@
+package elastic
+
+import (
+	"time"
+
+	"github.com/bamarb/aws-pipeline-go/pkg/trapyz"
+)
+
+//recordDoc a GeoLocOutput with a timestamp and a geo_point for kibana
+type recordDoc struct {
+	trapyz.GeoLocOutput
+	Timestamp time.Time `json:"@timestamp"`
+	Location  string    `json:"location"`
+}
+
+//RecordID the document id of a record, a record written again on a
+//re-run replaces the earlier copy
+func RecordID(rec trapyz.GeoLocOutput) string {
+	return rec.Gid + "-" + rec.UID + "-" + rec.Createdat
+}
+
+//WriteRecord queues a GeoLocOutput record for the index of its
+//creation day
+func (es *BulkSink) WriteRecord(rec trapyz.GeoLocOutput) error {
+	at, err := trapyz.CreatedAtTime(rec.Createdat)
+	if err != nil {
+		return err
+	}
+	return es.Write(RecordID(rec), at, recordDoc{rec, at.UTC(), rec.Lat + "," + rec.Lng})
+}
+
+//ConfigFrom converts the elastic config section
+func ConfigFrom(info trapyz.ElasticInfo) (Config, error) {
+	cfg := Config{URL: info.URL, Username: info.Username, Password: info.Password,
+		IndexPrefix: info.IndexPrefix, DateFormat: info.DateFormat, DocType: info.DocType,
+		TemplateName: info.TemplateName, TemplateFile: info.TemplateFile,
+		MaxItems: info.MaxItems, MaxBytes: info.MaxBytes, MaxRetries: info.MaxRetries}
+	if info.FlushInterval != "" {
+		d, err := time.ParseDuration(info.FlushInterval)
+		if err != nil {
+			return cfg, err
+		}
+		cfg.FlushInterval = d
+	}
+	return cfg, nil
+}
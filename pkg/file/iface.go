@@ -2,9 +2,13 @@ package file
 
 import (
 	"context"
+	"errors"
 	"io"
 )
 
+//ErrorChecksumMismatch the uploaded copy does not match its source
+var ErrorChecksumMismatch = errors.New("Error uploaded file checksum mismatch")
+
 //File interface for working with both s3 and local files
 type File interface {
 	Relative() string
@@ -15,4 +19,5 @@ type File interface {
 	String() string
 	IsDirectory() bool
 	Download(context context.Context, destDir string) error
+	Upload(context context.Context, src string) error
 }
@@ -0,0 +1,130 @@
+package file
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+//LocalFile type helps dealing with files on the local file system
+type LocalFile struct {
+	path string
+	md5  []byte
+}
+
+//NewLocalFile a LocalFile constructor, the file need not exist yet
+func NewLocalFile(path string) *LocalFile {
+	return &LocalFile{path: path}
+}
+
+//Relative returns the file name
+func (lf *LocalFile) Relative() string {
+	return filepath.Base(lf.path)
+}
+
+//Size returns the size of the file, 0 if it does not exist
+func (lf *LocalFile) Size() int64 {
+	info, err := os.Stat(lf.path)
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
+
+//IsDirectory returns true if the file is a directory
+func (lf *LocalFile) IsDirectory() bool {
+	info, err := os.Stat(lf.path)
+	return err == nil && info.IsDir()
+}
+
+//MD5 returns the md5 sum of the file contents, nil if it can't be read
+func (lf *LocalFile) MD5() []byte {
+	if lf.md5 == nil {
+		lf.md5, _ = fileMD5(lf.path)
+	}
+	return lf.md5
+}
+
+//Reader returns a local file reader
+func (lf *LocalFile) Reader() (io.ReadCloser, error) {
+	return os.Open(lf.path)
+}
+
+//Download copies the file into destDir
+func (lf *LocalFile) Download(ctx context.Context, destDir string) error {
+	return copyFile(lf.path, filepath.Join(destDir, lf.Relative()))
+}
+
+//Upload copies src to this file, the copy is written under a temporary
+//name and renamed into place once its md5 matches the source
+func (lf *LocalFile) Upload(ctx context.Context, src string) error {
+	if err := os.MkdirAll(filepath.Dir(lf.path), 0755); err != nil {
+		return err
+	}
+	tmp := filepath.Join(filepath.Dir(lf.path), "."+lf.Relative()+".tmp")
+	if err := copyFile(src, tmp); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	want, err := fileMD5(src)
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	got, err := fileMD5(tmp)
+	if err != nil || !bytes.Equal(want, got) {
+		os.Remove(tmp)
+		if err == nil {
+			err = ErrorChecksumMismatch
+		}
+		return err
+	}
+	lf.md5 = want
+	return os.Rename(tmp, lf.path)
+}
+
+//Delete deletes the file
+func (lf *LocalFile) Delete() error {
+	return os.Remove(lf.path)
+}
+
+func (lf *LocalFile) String() string {
+	return lf.path
+}
+
+func fileMD5(name string) ([]byte, error) {
+	fh, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+	h := md5.New()
+	if _, err := io.Copy(h, fh); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+func copyFile(src, dest string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
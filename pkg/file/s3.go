@@ -2,6 +2,8 @@ package file
 
 import (
 	"context"
+	"crypto/md5"
+	"encoding/base64"
 	"encoding/hex"
 	"fmt"
 	"io"
@@ -16,19 +18,39 @@ import (
 	"github.com/aws/aws-sdk-go/service/s3/s3iface"
 )
 
+//Multipart upload part sizes, files larger than the part size are
+//uploaded in parts. S3 rejects parts smaller than MinPartSize
+const (
+	MinPartSize     = 5 * 1024 * 1024
+	DefaultPartSize = 64 * 1024 * 1024
+)
+
 //S3File type helps dealing with S3Files
 type S3File struct {
-	conn   s3iface.S3API
-	bucket string
-	object *s3.Object
-	path   string
-	md5    []byte
+	conn     s3iface.S3API
+	bucket   string
+	object   *s3.Object
+	path     string
+	md5      []byte
+	partSize int64
 }
 
 //NewS3File an S3File constructor
 func NewS3File(conn s3iface.S3API, bucket string, obj *s3.Object) *S3File {
 	_, f := path.Split(*obj.Key)
-	return &S3File{conn, bucket, obj, f, nil}
+	return &S3File{conn, bucket, obj, f, nil, DefaultPartSize}
+}
+
+//NewS3Dest an S3File constructor for an object that is to be uploaded,
+//partSize below MinPartSize is raised to it
+func NewS3Dest(conn s3iface.S3API, bucket, key string, partSize int64) *S3File {
+	if partSize < MinPartSize {
+		partSize = MinPartSize
+	}
+	obj := &s3.Object{Key: aws.String(key), Size: aws.Int64(0)}
+	s3f := NewS3File(conn, bucket, obj)
+	s3f.partSize = partSize
+	return s3f
 }
 
 //Relative returns the s3 file name
@@ -89,6 +111,152 @@ func (s3f *S3File) Download(ctx context.Context, destDir string) error {
 	return err
 }
 
+//Upload uploads src to this object. S3 checks each request body against
+//its Content-MD5, the returned ETag is also compared with the local md5.
+//Files larger than the part size use a multipart upload, which is
+//aborted on failure so no orphan parts are left behind
+func (s3f *S3File) Upload(ctx context.Context, src string) error {
+	fh, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+	info, err := fh.Stat()
+	if err != nil {
+		return err
+	}
+	var sum []byte
+	if info.Size() > s3f.partSize {
+		sum, err = s3f.uploadParts(ctx, fh, info.Size())
+	} else {
+		sum, err = s3f.uploadSingle(ctx, fh)
+	}
+	if err != nil {
+		return err
+	}
+	s3f.object.Size = aws.Int64(info.Size())
+	s3f.md5 = sum
+	return nil
+}
+
+func (s3f *S3File) uploadSingle(ctx context.Context, body io.ReadSeeker) ([]byte, error) {
+	sum, err := readerMD5(body)
+	if err != nil {
+		return nil, err
+	}
+	out, err := s3f.conn.PutObjectWithContext(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(s3f.bucket),
+		Key:         s3f.object.Key,
+		Body:        body,
+		ContentMD5:  aws.String(base64.StdEncoding.EncodeToString(sum)),
+		ContentType: aws.String(guessMimeType(s3f.path)),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := checkETag(out.ETag, out.ServerSideEncryption, hex.EncodeToString(sum)); err != nil {
+		return nil, err
+	}
+	s3f.object.ETag = out.ETag
+	return sum, nil
+}
+
+//uploadParts the multipart ETag is the md5 of the part md5s followed
+//by the number of parts
+func (s3f *S3File) uploadParts(ctx context.Context, fh *os.File, size int64) ([]byte, error) {
+	created, err := s3f.conn.CreateMultipartUploadWithContext(ctx, &s3.CreateMultipartUploadInput{
+		Bucket:      aws.String(s3f.bucket),
+		Key:         s3f.object.Key,
+		ContentType: aws.String(guessMimeType(s3f.path)),
+	})
+	if err != nil {
+		return nil, err
+	}
+	abort := func(err error) ([]byte, error) {
+		s3f.conn.AbortMultipartUploadWithContext(ctx, &s3.AbortMultipartUploadInput{
+			Bucket:   aws.String(s3f.bucket),
+			Key:      s3f.object.Key,
+			UploadId: created.UploadId,
+		})
+		return nil, err
+	}
+	whole := md5.New()
+	var partSums []byte
+	var parts []*s3.CompletedPart
+	for off, num := int64(0), int64(1); off < size; off, num = off+s3f.partSize, num+1 {
+		n := s3f.partSize
+		if size-off < n {
+			n = size - off
+		}
+		section := io.NewSectionReader(fh, off, n)
+		ph := md5.New()
+		if _, err := io.Copy(io.MultiWriter(ph, whole), section); err != nil {
+			return abort(err)
+		}
+		sum := ph.Sum(nil)
+		if _, err := section.Seek(0, io.SeekStart); err != nil {
+			return abort(err)
+		}
+		out, err := s3f.conn.UploadPartWithContext(ctx, &s3.UploadPartInput{
+			Bucket:        aws.String(s3f.bucket),
+			Key:           s3f.object.Key,
+			UploadId:      created.UploadId,
+			PartNumber:    aws.Int64(num),
+			Body:          section,
+			ContentLength: aws.Int64(n),
+			ContentMD5:    aws.String(base64.StdEncoding.EncodeToString(sum)),
+		})
+		if err != nil {
+			return abort(err)
+		}
+		if err := checkETag(out.ETag, out.ServerSideEncryption, hex.EncodeToString(sum)); err != nil {
+			return abort(err)
+		}
+		partSums = append(partSums, sum...)
+		parts = append(parts, &s3.CompletedPart{ETag: out.ETag, PartNumber: aws.Int64(num)})
+	}
+	done, err := s3f.conn.CompleteMultipartUploadWithContext(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(s3f.bucket),
+		Key:             s3f.object.Key,
+		UploadId:        created.UploadId,
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: parts},
+	})
+	if err != nil {
+		return abort(err)
+	}
+	combined := md5.Sum(partSums)
+	want := fmt.Sprintf("%s-%d", hex.EncodeToString(combined[:]), len(parts))
+	if err := checkETag(done.ETag, done.ServerSideEncryption, want); err != nil {
+		return nil, err
+	}
+	s3f.object.ETag = done.ETag
+	return whole.Sum(nil), nil
+}
+
+//checkETag compares an ETag with the expected value. A missing ETag or
+//an SSE-KMS encrypted object, whose ETag isn't an md5 of the data, is
+//accepted since S3 already checked the Content-MD5
+func checkETag(etag, sse *string, want string) error {
+	if etag == nil || aws.StringValue(sse) == s3.ServerSideEncryptionAwsKms {
+		return nil
+	}
+	if strings.Trim(*etag, `"`) != want {
+		return ErrorChecksumMismatch
+	}
+	return nil
+}
+
+func readerMD5(r io.ReadSeeker) ([]byte, error) {
+	h := md5.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return nil, err
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
 //Delete deletes and s3 file
 func (s3f *S3File) Delete() error {
 	input := s3.DeleteObjectInput{
@@ -0,0 +1,69 @@
+package file
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+//ErrorNoS3Conn an s3 target was given without an S3API client
+var ErrorNoS3Conn = errors.New("Error s3 upload target without an s3 connection")
+
+//Target an upload destination, either a local directory or an
+//s3://bucket/prefix url. Files under it are interchangeable File values
+type Target struct {
+	conn     s3iface.S3API
+	base     string
+	bucket   string
+	prefix   string
+	partSize int64
+}
+
+//NewTarget parses the destination, conn is only needed for s3 urls
+func NewTarget(conn s3iface.S3API, dest string, partSize int64) (*Target, error) {
+	t := &Target{conn: conn, base: dest, partSize: partSize}
+	if !IsS3(dest) {
+		return t, nil
+	}
+	u, err := url.Parse(dest)
+	if err != nil {
+		return nil, err
+	}
+	if u.Host == "" {
+		return nil, errors.New("Error no bucket in s3 upload target " + dest)
+	}
+	if conn == nil {
+		return nil, ErrorNoS3Conn
+	}
+	t.bucket = u.Host
+	t.prefix = strings.Trim(u.Path, "/")
+	return t, nil
+}
+
+//IsS3 returns true if the target is an s3 url
+func IsS3(dest string) bool {
+	return strings.HasPrefix(dest, "s3://")
+}
+
+//File returns the target file at the slash separated relative path
+func (t *Target) File(rel string) File {
+	if t.bucket != "" {
+		return NewS3Dest(t.conn, t.bucket, path.Join(t.prefix, rel), t.partSize)
+	}
+	return NewLocalFile(filepath.Join(t.base, filepath.FromSlash(rel)))
+}
+
+//Upload uploads the local file src to rel under the target
+func (t *Target) Upload(ctx context.Context, src, rel string) (File, error) {
+	f := t.File(rel)
+	return f, f.Upload(ctx, src)
+}
+
+func (t *Target) String() string {
+	return t.base
+}
@@ -0,0 +1,197 @@
+package file
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/stretchr/testify/assert"
+)
+
+//fakeS3 keeps uploaded objects in memory and checks Content-MD5 like S3.
+//badETag makes it return a wrong ETag, kms marks the objects SSE-KMS
+//encrypted
+type fakeS3 struct {
+	s3iface.S3API
+	objects map[string][]byte
+	parts   map[int64][]byte
+	aborted int
+	badETag bool
+	kms     bool
+}
+
+func newFakeS3() *fakeS3 {
+	return &fakeS3{objects: make(map[string][]byte), parts: make(map[int64][]byte)}
+}
+
+func (f *fakeS3) etag(sum []byte) *string {
+	if f.badETag {
+		return aws.String(`"00000000000000000000000000000000"`)
+	}
+	return aws.String(`"` + hex.EncodeToString(sum) + `"`)
+}
+
+func (f *fakeS3) sse() *string {
+	if f.kms {
+		return aws.String(s3.ServerSideEncryptionAwsKms)
+	}
+	return nil
+}
+
+func checkMD5(body []byte, contentMD5 *string) ([]byte, error) {
+	sum := md5.Sum(body)
+	if base64.StdEncoding.EncodeToString(sum[:]) != aws.StringValue(contentMD5) {
+		return nil, fmt.Errorf("BadDigest")
+	}
+	return sum[:], nil
+}
+
+func (f *fakeS3) PutObjectWithContext(ctx aws.Context, in *s3.PutObjectInput,
+	opts ...request.Option) (*s3.PutObjectOutput, error) {
+	body, _ := ioutil.ReadAll(in.Body)
+	sum, err := checkMD5(body, in.ContentMD5)
+	if err != nil {
+		return nil, err
+	}
+	f.objects[*in.Bucket+"/"+*in.Key] = body
+	return &s3.PutObjectOutput{ETag: f.etag(sum), ServerSideEncryption: f.sse()}, nil
+}
+
+func (f *fakeS3) CreateMultipartUploadWithContext(ctx aws.Context, in *s3.CreateMultipartUploadInput,
+	opts ...request.Option) (*s3.CreateMultipartUploadOutput, error) {
+	return &s3.CreateMultipartUploadOutput{UploadId: aws.String("upload-1")}, nil
+}
+
+func (f *fakeS3) UploadPartWithContext(ctx aws.Context, in *s3.UploadPartInput,
+	opts ...request.Option) (*s3.UploadPartOutput, error) {
+	body, _ := ioutil.ReadAll(in.Body)
+	sum, err := checkMD5(body, in.ContentMD5)
+	if err != nil {
+		return nil, err
+	}
+	f.parts[*in.PartNumber] = body
+	return &s3.UploadPartOutput{ETag: aws.String(`"` + hex.EncodeToString(sum) + `"`),
+		ServerSideEncryption: f.sse()}, nil
+}
+
+func (f *fakeS3) CompleteMultipartUploadWithContext(ctx aws.Context, in *s3.CompleteMultipartUploadInput,
+	opts ...request.Option) (*s3.CompleteMultipartUploadOutput, error) {
+	var body, sums []byte
+	for _, p := range in.MultipartUpload.Parts {
+		part := f.parts[*p.PartNumber]
+		sum := md5.Sum(part)
+		body = append(body, part...)
+		sums = append(sums, sum[:]...)
+	}
+	f.objects[*in.Bucket+"/"+*in.Key] = body
+	combined := md5.Sum(sums)
+	etag := fmt.Sprintf(`"%s-%d"`, hex.EncodeToString(combined[:]), len(in.MultipartUpload.Parts))
+	if f.badETag {
+		etag = `"0-1"`
+	}
+	return &s3.CompleteMultipartUploadOutput{ETag: aws.String(etag), ServerSideEncryption: f.sse()}, nil
+}
+
+func (f *fakeS3) AbortMultipartUploadWithContext(ctx aws.Context, in *s3.AbortMultipartUploadInput,
+	opts ...request.Option) (*s3.AbortMultipartUploadOutput, error) {
+	f.aborted++
+	return &s3.AbortMultipartUploadOutput{}, nil
+}
+
+func writeTemp(t *testing.T, dir string, size int) (string, []byte) {
+	data := bytes.Repeat([]byte("0123456789abcdef"), size/16+1)[:size]
+	name := filepath.Join(dir, "part-0000.ndjson")
+	if err := ioutil.WriteFile(name, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return name, data
+}
+
+func TestS3Upload(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "upload")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+	src, data := writeTemp(t, dir, 1000)
+	sum := md5.Sum(data)
+
+	conn := newFakeS3()
+	dest := NewS3Dest(conn, "out", "geocalc/part-0000.ndjson", 0)
+	assert.Nil(dest.Upload(context.Background(), src))
+	assert.Equal(data, conn.objects["out/geocalc/part-0000.ndjson"])
+	assert.Equal(sum[:], dest.MD5())
+	assert.Equal(int64(1000), dest.Size())
+	assert.Empty(conn.parts)
+
+	conn.badETag = true
+	assert.Equal(ErrorChecksumMismatch, dest.Upload(context.Background(), src))
+	//SSE-KMS ETags aren't md5s of the data
+	conn.kms = true
+	assert.Nil(dest.Upload(context.Background(), src))
+}
+
+func TestS3UploadMultipart(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "upload")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+	src, data := writeTemp(t, dir, 2500)
+	sum := md5.Sum(data)
+
+	conn := newFakeS3()
+	dest := NewS3Dest(conn, "out", "big.ndjson", 0)
+	dest.partSize = 1000
+	assert.Nil(dest.Upload(context.Background(), src))
+	assert.Len(conn.parts, 3)
+	assert.Len(conn.parts[3], 500)
+	assert.Equal(data, conn.objects["out/big.ndjson"])
+	assert.Equal(sum[:], dest.MD5())
+	assert.Equal(0, conn.aborted)
+
+	conn.badETag = true
+	assert.Equal(ErrorChecksumMismatch, dest.Upload(context.Background(), src))
+	assert.Equal(0, conn.aborted)
+	conn.kms = true
+	assert.Nil(dest.Upload(context.Background(), src))
+	assert.Equal(sum[:], dest.MD5())
+}
+
+func TestTarget(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "upload")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+	src, data := writeTemp(t, dir, 100)
+
+	_, err = NewTarget(nil, "s3://bucket/prefix", 0)
+	assert.Equal(ErrorNoS3Conn, err)
+	conn := newFakeS3()
+	s3t, err := NewTarget(conn, "s3://bucket/prefix/", 0)
+	assert.Nil(err)
+	f, err := s3t.Upload(context.Background(), src, "dt=2018-09-06/part-0000.ndjson")
+	assert.Nil(err)
+	assert.Equal("s3://bucket/prefix/dt=2018-09-06/part-0000.ndjson", f.String())
+	assert.Equal(data, conn.objects["bucket/prefix/dt=2018-09-06/part-0000.ndjson"])
+
+	local, err := NewTarget(nil, filepath.Join(dir, "archive"), 0)
+	assert.Nil(err)
+	f, err = local.Upload(context.Background(), src, "dt=2018-09-06/part-0000.ndjson")
+	assert.Nil(err)
+	got, err := ioutil.ReadFile(filepath.Join(dir, "archive", "dt=2018-09-06", "part-0000.ndjson"))
+	assert.Nil(err)
+	assert.Equal(data, got)
+	assert.Equal(int64(100), f.Size())
+	sum := md5.Sum(data)
+	assert.Equal(sum[:], f.MD5())
+}
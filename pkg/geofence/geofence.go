@@ -0,0 +1,156 @@
+//Package geofence store catchments, either a radius or a polygon
+package geofence
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/bamarb/aws-pipeline-go/pkg/geomath"
+)
+
+//ErrorBadGeometry is returned when a geofence cannot be parsed
+var ErrorBadGeometry = errors.New("Invalid geofence geometry")
+
+//Polygon a list of closed rings, the first ring is the outer
+//boundary and the remaining rings are holes
+type Polygon [][]geomath.Point
+
+//Fence the catchment of a store. If Polygon is set it takes precedence
+//over Radius, a zero Radius means use the configured default
+type Fence struct {
+	Radius  float64
+	Polygon Polygon
+}
+
+//IsPolygon returns true if the fence has a polygon
+func (f Fence) IsPolygon() bool {
+	return len(f.Polygon) > 0 && len(f.Polygon[0]) >= 3
+}
+
+//Reach returns the distance in meters from the store location beyond
+//which the fence cannot match. For polygons this is the diagonal of the
+//bounding box since we don't know where the store sits inside it
+func (f Fence) Reach() float64 {
+	if !f.IsPolygon() {
+		return f.Radius
+	}
+	minLat, minLng := math.MaxFloat64, math.MaxFloat64
+	maxLat, maxLng := -math.MaxFloat64, -math.MaxFloat64
+	for _, p := range f.Polygon[0] {
+		minLat, maxLat = math.Min(minLat, p.Lat), math.Max(maxLat, p.Lat)
+		minLng, maxLng = math.Min(minLng, p.Lng), math.Max(maxLng, p.Lng)
+	}
+	return geomath.Haversine(geomath.Point{Lat: minLat, Lng: minLng}, geomath.Point{Lat: maxLat, Lng: maxLng})
+}
+
+//Contains returns true if the point lies inside the outer ring
+//and outside all holes
+func (p Polygon) Contains(pt geomath.Point) bool {
+	if len(p) == 0 || !ringContains(p[0], pt.Lat, pt.Lng) {
+		return false
+	}
+	for _, hole := range p[1:] {
+		if ringContains(hole, pt.Lat, pt.Lng) {
+			return false
+		}
+	}
+	return true
+}
+
+//ringContains ray casting point in polygon test
+func ringContains(ring []geomath.Point, lat, lng float64) bool {
+	in := false
+	for i, j := 0, len(ring)-1; i < len(ring); j, i = i, i+1 {
+		a, b := ring[i], ring[j]
+		if (a.Lat > lat) != (b.Lat > lat) &&
+			lng < (b.Lng-a.Lng)*(lat-a.Lat)/(b.Lat-a.Lat)+a.Lng {
+			in = !in
+		}
+	}
+	return in
+}
+
+//Parse parses a polygon in either WKT or GeoJSON format
+func Parse(s string) (Polygon, error) {
+	s = strings.TrimSpace(s)
+	if strings.HasPrefix(s, "{") {
+		return ParseGeoJSON(s)
+	}
+	return ParseWKT(s)
+}
+
+//ParseWKT parses a WKT POLYGON, coordinates are in lng lat order
+func ParseWKT(s string) (Polygon, error) {
+	s = strings.TrimSpace(s)
+	if !strings.HasPrefix(strings.ToUpper(s), "POLYGON") {
+		return nil, ErrorBadGeometry
+	}
+	body := strings.TrimSpace(s[len("POLYGON"):])
+	if !strings.HasPrefix(body, "((") || !strings.HasSuffix(body, "))") {
+		return nil, ErrorBadGeometry
+	}
+	body = body[2 : len(body)-2]
+	var poly Polygon
+	for _, rs := range strings.Split(body, "),") {
+		rs = strings.Trim(strings.TrimSpace(rs), "()")
+		var ring []geomath.Point
+		for _, ps := range strings.Split(rs, ",") {
+			fields := strings.Fields(ps)
+			if len(fields) < 2 {
+				return nil, ErrorBadGeometry
+			}
+			lng, err := strconv.ParseFloat(fields[0], 64)
+			if err != nil {
+				return nil, ErrorBadGeometry
+			}
+			lat, err := strconv.ParseFloat(fields[1], 64)
+			if err != nil {
+				return nil, ErrorBadGeometry
+			}
+			ring = append(ring, geomath.Point{Lat: lat, Lng: lng})
+		}
+		if len(ring) < 3 {
+			return nil, ErrorBadGeometry
+		}
+		poly = append(poly, ring)
+	}
+	return poly, nil
+}
+
+type geoJSON struct {
+	Type        string        `json:"type"`
+	Coordinates [][][]float64 `json:"coordinates"`
+	Geometry    *geoJSON      `json:"geometry"`
+}
+
+//ParseGeoJSON parses a GeoJSON Polygon geometry or a Feature holding one
+func ParseGeoJSON(s string) (Polygon, error) {
+	var g geoJSON
+	if err := json.Unmarshal([]byte(s), &g); err != nil {
+		return nil, ErrorBadGeometry
+	}
+	if g.Type == "Feature" && g.Geometry != nil {
+		g = *g.Geometry
+	}
+	if g.Type != "Polygon" || len(g.Coordinates) == 0 {
+		return nil, ErrorBadGeometry
+	}
+	poly := make(Polygon, 0, len(g.Coordinates))
+	for _, rc := range g.Coordinates {
+		if len(rc) < 3 {
+			return nil, ErrorBadGeometry
+		}
+		ring := make([]geomath.Point, 0, len(rc))
+		for _, c := range rc {
+			if len(c) < 2 {
+				return nil, ErrorBadGeometry
+			}
+			ring = append(ring, geomath.Point{Lat: c[1], Lng: c[0]})
+		}
+		poly = append(poly, ring)
+	}
+	return poly, nil
+}
@@ -0,0 +1,56 @@
+package geofence
+
+import (
+	"testing"
+
+	"github.com/bamarb/aws-pipeline-go/pkg/geomath"
+	"github.com/stretchr/testify/assert"
+)
+
+const squareWKT = "POLYGON ((77.0 12.0, 77.1 12.0, 77.1 12.1, 77.0 12.1, 77.0 12.0))"
+
+const squareWithHoleWKT = `POLYGON ((77.0 12.0, 77.1 12.0, 77.1 12.1, 77.0 12.1, 77.0 12.0),
+	(77.04 12.04, 77.06 12.04, 77.06 12.06, 77.04 12.06, 77.04 12.04))`
+
+const squareGeoJSON = `{"type":"Feature","geometry":{"type":"Polygon",
+	"coordinates":[[[77.0,12.0],[77.1,12.0],[77.1,12.1],[77.0,12.1],[77.0,12.0]]]}}`
+
+func TestParse(t *testing.T) {
+	assert := assert.New(t)
+	wkt, err := Parse(squareWKT)
+	assert.Nil(err)
+	assert.Len(wkt, 1)
+	assert.Len(wkt[0], 5)
+	assert.Equal(geomath.Point{Lat: 12.1, Lng: 77.1}, wkt[0][2])
+
+	gj, err := Parse(squareGeoJSON)
+	assert.Nil(err)
+	assert.Equal(wkt, gj)
+
+	holed, err := Parse(squareWithHoleWKT)
+	assert.Nil(err)
+	assert.Len(holed, 2)
+
+	for _, bad := range []string{"", "POINT (77 12)", "POLYGON ((77 12, 78 x, 77 13))",
+		`{"type":"Point","coordinates":[77,12]}`, "{bad json"} {
+		_, err := Parse(bad)
+		assert.Equal(ErrorBadGeometry, err, bad)
+	}
+}
+
+func TestContains(t *testing.T) {
+	assert := assert.New(t)
+	poly, err := ParseWKT(squareWithHoleWKT)
+	assert.Nil(err)
+	assert.True(poly.Contains(geomath.Point{Lat: 12.02, Lng: 77.02}))
+	assert.False(poly.Contains(geomath.Point{Lat: 12.05, Lng: 77.05}), "point in hole")
+	assert.False(poly.Contains(geomath.Point{Lat: 12.2, Lng: 77.05}), "point outside")
+}
+
+func TestReach(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal(250.0, Fence{Radius: 250}.Reach())
+	poly, _ := ParseWKT(squareWKT)
+	//0.1 degree square near the equator has a diagonal of roughly 15.5km
+	assert.InDelta(15500, Fence{Polygon: poly}.Reach(), 500)
+}
@@ -0,0 +1,136 @@
+//Package geomath distances, bearings and bounding boxes on the earth
+package geomath
+
+import (
+	"math"
+)
+
+//EarthRadius mean earth radius in meters
+const EarthRadius = 6371008.8
+
+//WGS84 ellipsoid parameters used by Vincenty
+const (
+	wgs84A = 6378137.0
+	wgs84F = 1 / 298.257223563
+	wgs84B = wgs84A * (1 - wgs84F)
+)
+
+//Point a lat lng pair in degrees
+type Point struct {
+	Lat float64
+	Lng float64
+}
+
+//Valid returns true if the point is within lat lng range
+func (p Point) Valid() bool {
+	return p.Lat >= -90 && p.Lat <= 90 && p.Lng >= -180 && p.Lng <= 180
+}
+
+//Box a lat lng bounding box
+type Box struct {
+	Min Point
+	Max Point
+}
+
+//Contains returns true if the point lies in the box
+func (b Box) Contains(p Point) bool {
+	return p.Lat >= b.Min.Lat && p.Lat <= b.Max.Lat && p.Lng >= b.Min.Lng && p.Lng <= b.Max.Lng
+}
+
+func toRad(deg float64) float64 {
+	return deg * math.Pi / 180
+}
+
+func toDeg(rad float64) float64 {
+	return rad * 180 / math.Pi
+}
+
+//Haversine returns the great circle distance in meters on a spherical earth
+func Haversine(a, b Point) float64 {
+	lat1, lat2 := toRad(a.Lat), toRad(b.Lat)
+	dLat := lat2 - lat1
+	dLng := toRad(b.Lng - a.Lng)
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLng/2)*math.Sin(dLng/2)
+	return 2 * EarthRadius * math.Asin(math.Min(1, math.Sqrt(h)))
+}
+
+//Vincenty returns the distance in meters on the WGS84 ellipsoid. The
+//iteration can fail to converge for nearly antipodal points, in which
+//case the haversine distance is returned
+func Vincenty(a, b Point) float64 {
+	L := toRad(b.Lng - a.Lng)
+	U1 := math.Atan((1 - wgs84F) * math.Tan(toRad(a.Lat)))
+	U2 := math.Atan((1 - wgs84F) * math.Tan(toRad(b.Lat)))
+	sinU1, cosU1 := math.Sincos(U1)
+	sinU2, cosU2 := math.Sincos(U2)
+	lambda := L
+	var sinSigma, cosSigma, sigma, cos2Alpha, cos2SigmaM float64
+	for i := 0; i < 200; i++ {
+		sinLambda, cosLambda := math.Sincos(lambda)
+		sinSigma = math.Sqrt((cosU2*sinLambda)*(cosU2*sinLambda) +
+			(cosU1*sinU2-sinU1*cosU2*cosLambda)*(cosU1*sinU2-sinU1*cosU2*cosLambda))
+		if sinSigma == 0 {
+			//coincident points
+			return 0
+		}
+		cosSigma = sinU1*sinU2 + cosU1*cosU2*cosLambda
+		sigma = math.Atan2(sinSigma, cosSigma)
+		sinAlpha := cosU1 * cosU2 * sinLambda / sinSigma
+		cos2Alpha = 1 - sinAlpha*sinAlpha
+		cos2SigmaM = 0
+		if cos2Alpha != 0 {
+			//points on the equator have cos2Alpha of zero
+			cos2SigmaM = cosSigma - 2*sinU1*sinU2/cos2Alpha
+		}
+		C := wgs84F / 16 * cos2Alpha * (4 + wgs84F*(4-3*cos2Alpha))
+		prev := lambda
+		lambda = L + (1-C)*wgs84F*sinAlpha*
+			(sigma+C*sinSigma*(cos2SigmaM+C*cosSigma*(-1+2*cos2SigmaM*cos2SigmaM)))
+		if math.Abs(lambda-prev) < 1e-12 {
+			uSq := cos2Alpha * (wgs84A*wgs84A - wgs84B*wgs84B) / (wgs84B * wgs84B)
+			A := 1 + uSq/16384*(4096+uSq*(-768+uSq*(320-175*uSq)))
+			B := uSq / 1024 * (256 + uSq*(-128+uSq*(74-47*uSq)))
+			deltaSigma := B * sinSigma * (cos2SigmaM + B/4*(cosSigma*(-1+2*cos2SigmaM*cos2SigmaM)-
+				B/6*cos2SigmaM*(-3+4*sinSigma*sinSigma)*(-3+4*cos2SigmaM*cos2SigmaM)))
+			return wgs84B * A * (sigma - deltaSigma)
+		}
+	}
+	return Haversine(a, b)
+}
+
+//Bearing returns the initial bearing in degrees clockwise from north
+//for the great circle path from a to b
+func Bearing(a, b Point) float64 {
+	lat1, lat2 := toRad(a.Lat), toRad(b.Lat)
+	dLng := toRad(b.Lng - a.Lng)
+	y := math.Sin(dLng) * math.Cos(lat2)
+	x := math.Cos(lat1)*math.Sin(lat2) - math.Sin(lat1)*math.Cos(lat2)*math.Cos(dLng)
+	return math.Mod(toDeg(math.Atan2(y, x))+360, 360)
+}
+
+//Destination returns the point reached travelling dist meters
+//from p on the given initial bearing
+func Destination(p Point, bearing, dist float64) Point {
+	lat1, lng1 := toRad(p.Lat), toRad(p.Lng)
+	brng := toRad(bearing)
+	ad := dist / EarthRadius
+	lat2 := math.Asin(math.Sin(lat1)*math.Cos(ad) + math.Cos(lat1)*math.Sin(ad)*math.Cos(brng))
+	lng2 := lng1 + math.Atan2(math.Sin(brng)*math.Sin(ad)*math.Cos(lat1), math.Cos(ad)-math.Sin(lat1)*math.Sin(lat2))
+	return Point{toDeg(lat2), math.Mod(toDeg(lng2)+540, 360) - 180}
+}
+
+//BoundingBox returns the box enclosing the circle of radius meters around p.
+//Boxes crossing a pole or the antimeridian are clamped to the valid range
+func BoundingBox(p Point, radius float64) Box {
+	dLat := toDeg(radius / EarthRadius)
+	minLat, maxLat := p.Lat-dLat, p.Lat+dLat
+	if minLat <= -90 || maxLat >= 90 {
+		return Box{Point{math.Max(minLat, -90), -180}, Point{math.Min(maxLat, 90), 180}}
+	}
+	dLng := toDeg(math.Asin(math.Sin(radius/EarthRadius) / math.Cos(toRad(p.Lat))))
+	return Box{
+		Point{minLat, math.Max(p.Lng-dLng, -180)},
+		Point{maxLat, math.Min(p.Lng+dLng, 180)},
+	}
+}
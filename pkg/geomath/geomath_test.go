@@ -0,0 +1,60 @@
+package geomath
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var (
+	bangalore = Point{12.9716, 77.5946}
+	mumbai    = Point{19.0760, 72.8777}
+)
+
+func TestHaversine(t *testing.T) {
+	assert := assert.New(t)
+	assert.InDelta(845319.55, Haversine(bangalore, mumbai), 1)
+	assert.Equal(0.0, Haversine(bangalore, bangalore))
+	//one degree of latitude is about 111.2km
+	assert.InDelta(111195, Haversine(Point{0, 0}, Point{1, 0}), 1)
+}
+
+func TestVincenty(t *testing.T) {
+	assert := assert.New(t)
+	//Flinders Peak to Buninyong, the worked example from Vincenty's paper
+	flinders := Point{-37.95103342, 144.42486789}
+	buninyong := Point{-37.65282114, 143.92649554}
+	assert.InDelta(54972.271, Vincenty(flinders, buninyong), 0.01)
+	assert.Equal(0.0, Vincenty(mumbai, mumbai))
+	//ellipsoidal and spherical distances agree to within 0.5%
+	assert.InDelta(Haversine(bangalore, mumbai), Vincenty(bangalore, mumbai), 845319*0.005)
+	//nearly antipodal points fall back to haversine
+	a, b := Point{0, 0}, Point{0.5, 179.7}
+	assert.InDelta(Haversine(a, b), Vincenty(a, b), 30000)
+}
+
+func TestBearing(t *testing.T) {
+	assert := assert.New(t)
+	assert.InDelta(0, Bearing(Point{0, 0}, Point{1, 0}), 1e-9)
+	assert.InDelta(90, Bearing(Point{0, 0}, Point{0, 1}), 1e-9)
+	assert.InDelta(270, Bearing(Point{0, 0}, Point{0, -1}), 1e-9)
+	assert.InDelta(324.02, Bearing(bangalore, mumbai), 0.01)
+}
+
+func TestDestinationAndBoundingBox(t *testing.T) {
+	assert := assert.New(t)
+	dest := Destination(bangalore, 45, 300)
+	assert.InDelta(300, Haversine(bangalore, dest), 1e-6)
+	assert.InDelta(45, Bearing(bangalore, dest), 1e-3)
+
+	box := BoundingBox(bangalore, 300)
+	assert.True(box.Contains(bangalore))
+	for _, brng := range []float64{0, 90, 180, 270} {
+		p := Destination(bangalore, brng, 299)
+		assert.True(box.Contains(p), brng)
+		assert.False(box.Contains(Destination(bangalore, brng, 310)), brng)
+	}
+	polar := BoundingBox(Point{89.999, 10}, 1000)
+	assert.Equal(90.0, polar.Max.Lat)
+	assert.Equal(-180.0, polar.Min.Lng)
+}
@@ -8,8 +8,11 @@ import (
 
 var defaultOpts = []string{"m", "WITHDIST", "COUNT", "100", "ASC"}
 
+//allOpts returns every location in the radius
+var allOpts = []string{"m", "WITHDIST", "ASC"}
+
 type redisLocationStore struct {
-	p      *radix.Pool
+	p      radix.Client
 	pipeSz int
 }
 
@@ -33,8 +36,18 @@ func (rs *redisLocationStore) Count(idx string) (int64, error) {
 
 func (rs *redisLocationStore) NearbyWithDist(idx string,
 	lat string, lng string, radius string) ([]GeoRadiusDistInfo, error) {
+	return rs.georadius(idx, lat, lng, radius, defaultOpts)
+}
+
+func (rs *redisLocationStore) NearbyAllWithDist(idx string,
+	lat string, lng string, radius string) ([]GeoRadiusDistInfo, error) {
+	return rs.georadius(idx, lat, lng, radius, allOpts)
+}
+
+func (rs *redisLocationStore) georadius(idx string,
+	lat string, lng string, radius string, opts []string) ([]GeoRadiusDistInfo, error) {
 	var resp [][]string
-	err := rs.p.Do(radix.FlatCmd(&resp, "GEORADIUS", idx, lng, lat, radius, defaultOpts))
+	err := rs.p.Do(radix.FlatCmd(&resp, "GEORADIUS", idx, lng, lat, radius, opts))
 	if err != nil {
 		return nil, err
 	}
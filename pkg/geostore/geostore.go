@@ -27,6 +27,43 @@ const (
 	MI
 )
 
+//distanceUnits redis unit names and meters per unit
+var distanceUnits = []struct {
+	name   string
+	meters float64
+}{
+	FT: {"ft", 0.3048},
+	M:  {"m", 1},
+	KM: {"km", 1000},
+	MI: {"mi", 1609.344},
+}
+
+//String returns the redis unit name
+func (d Distance) String() string {
+	if d < FT || d > MI {
+		return ""
+	}
+	return distanceUnits[d].name
+}
+
+//Meters returns the number of meters in one unit
+func (d Distance) Meters() float64 {
+	if d < FT || d > MI {
+		return 0
+	}
+	return distanceUnits[d].meters
+}
+
+//ParseDistance returns the Distance unit for a redis unit name
+func ParseDistance(unit string) (Distance, bool) {
+	for d, u := range distanceUnits {
+		if u.name == unit {
+			return Distance(d), true
+		}
+	}
+	return M, false
+}
+
 const redisPipelineSize int = 1000
 
 // QueryOptions for nearby queries
@@ -59,10 +96,13 @@ type GeoLocationStore interface {
 	DeleteLocations(indexName string, locs ...string) (int64, error)
 	NearbyWithDist(indexName string, lat string,
 		lng string, radius string) ([]GeoRadiusDistInfo, error)
+	//NearbyAllWithDist like NearbyWithDist without the count limit
+	NearbyAllWithDist(indexName string, lat string,
+		lng string, radius string) ([]GeoRadiusDistInfo, error)
 	Count(indexName string) (int64, error)
 }
 
 // NewGeoLocationStore  ctor
-func NewGeoLocationStore(pool *radix.Pool) GeoLocationStore {
+func NewGeoLocationStore(pool radix.Client) GeoLocationStore {
 	return &redisLocationStore{pool, redisPipelineSize}
 }
@@ -0,0 +1,277 @@
+//Package hll HyperLogLog sketches for approximate distinct counts
+package hll
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/fnv"
+	"math"
+	"math/bits"
+	"sort"
+)
+
+//DefaultPrecision 2^14 registers, a standard error of about 0.8%
+const DefaultPrecision = 14
+
+//Precision bounds
+const (
+	MinPrecision = 4
+	MaxPrecision = 18
+)
+
+//Versions of the binary encoding, the first byte
+const (
+	sketchVersion       = 1
+	sparseSketchVersion = 2
+)
+
+//sparseShare a sparse sketch turns dense once more than 1/sparseShare
+//of its registers are set
+const sparseShare = 16
+
+//ErrorPrecision is returned for a precision out of bounds
+var ErrorPrecision = errors.New("hll: precision out of range")
+
+//ErrorMismatch is returned when merging sketches of different precision
+var ErrorMismatch = errors.New("hll: precision mismatch")
+
+//ErrorEncoding is returned when decoding a malformed sketch
+var ErrorEncoding = errors.New("hll: invalid encoding")
+
+//Sketch a HyperLogLog sketch. It starts sparse, keeping only the set
+//registers, and turns dense as it fills up so small sketches stay small.
+//It is not safe for concurrent use
+type Sketch struct {
+	p      uint8
+	regs   []uint8
+	sparse map[uint32]uint8
+}
+
+//New constructs a sketch with 2^p registers
+func New(p uint8) (*Sketch, error) {
+	if p < MinPrecision || p > MaxPrecision {
+		return nil, ErrorPrecision
+	}
+	return &Sketch{p: p, sparse: make(map[uint32]uint8)}, nil
+}
+
+//NewDefault constructs a sketch with DefaultPrecision
+func NewDefault() *Sketch {
+	s, _ := New(DefaultPrecision)
+	return s
+}
+
+//Precision returns the precision of the sketch
+func (s *Sketch) Precision() uint8 {
+	return s.p
+}
+
+//hash64 fnv-1a finished with the murmur3 mixer, fnv alone
+//does not spread short keys over the high bits
+func hash64(b []byte) uint64 {
+	h := fnv.New64a()
+	h.Write(b)
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+//Add adds a member to the sketch
+func (s *Sketch) Add(member []byte) {
+	x := hash64(member)
+	idx := x >> (64 - s.p)
+	//the remaining bits with a sentinel so rank is bounded
+	w := x<<s.p | 1<<(s.p-1)
+	rank := uint8(bits.LeadingZeros64(w)) + 1
+	s.set(uint32(idx), rank)
+}
+
+//set raises register idx to rank
+func (s *Sketch) set(idx uint32, rank uint8) {
+	if s.regs != nil {
+		if rank > s.regs[idx] {
+			s.regs[idx] = rank
+		}
+		return
+	}
+	if rank > s.sparse[idx] {
+		s.sparse[idx] = rank
+		if len(s.sparse) > (1<<s.p)/sparseShare {
+			s.toDense()
+		}
+	}
+}
+
+//toDense moves the sparse registers to a dense register array
+func (s *Sketch) toDense() {
+	s.regs = make([]uint8, 1<<s.p)
+	for idx, r := range s.sparse {
+		s.regs[idx] = r
+	}
+	s.sparse = nil
+}
+
+//AddString adds a string member to the sketch
+func (s *Sketch) AddString(member string) {
+	s.Add([]byte(member))
+}
+
+//Merge folds other into s, afterwards s estimates the union
+func (s *Sketch) Merge(other *Sketch) error {
+	if other == nil {
+		return nil
+	}
+	if s.p != other.p {
+		return ErrorMismatch
+	}
+	if other.regs == nil {
+		for idx, r := range other.sparse {
+			s.set(idx, r)
+		}
+		return nil
+	}
+	if s.regs == nil {
+		s.toDense()
+	}
+	for i, r := range other.regs {
+		if r > s.regs[i] {
+			s.regs[i] = r
+		}
+	}
+	return nil
+}
+
+//Clone returns a copy of the sketch
+func (s *Sketch) Clone() *Sketch {
+	if s.regs == nil {
+		sparse := make(map[uint32]uint8, len(s.sparse))
+		for idx, r := range s.sparse {
+			sparse[idx] = r
+		}
+		return &Sketch{p: s.p, sparse: sparse}
+	}
+	regs := make([]uint8, len(s.regs))
+	copy(regs, s.regs)
+	return &Sketch{p: s.p, regs: regs}
+}
+
+//Count returns the estimated number of distinct members
+func (s *Sketch) Count() uint64 {
+	m := float64(uint64(1) << s.p)
+	var sum float64
+	zeros := 0
+	if s.regs == nil {
+		zeros = int(m) - len(s.sparse)
+		sum = float64(zeros)
+		for _, r := range s.sparse {
+			sum += 1 / float64(uint64(1)<<r)
+		}
+	}
+	for _, r := range s.regs {
+		sum += 1 / float64(uint64(1)<<r)
+		if r == 0 {
+			zeros++
+		}
+	}
+	est := alpha(m) * m * m / sum
+	//linear counting is more accurate for small cardinalities
+	if est <= 2.5*m && zeros > 0 {
+		est = m * math.Log(m/float64(zeros))
+	}
+	return uint64(est + 0.5)
+}
+
+func alpha(m float64) float64 {
+	switch m {
+	case 16:
+		return 0.673
+	case 32:
+		return 0.697
+	case 64:
+		return 0.709
+	}
+	return 0.7213 / (1 + 1.079/m)
+}
+
+//MarshalBinary encodes the sketch as version, precision and registers.
+//Sparse sketches encode the count of set registers followed by the
+//index delta and rank of each
+func (s *Sketch) MarshalBinary() ([]byte, error) {
+	if s.regs == nil {
+		idxs := make([]uint32, 0, len(s.sparse))
+		for idx := range s.sparse {
+			idxs = append(idxs, idx)
+		}
+		sort.Slice(idxs, func(i, j int) bool { return idxs[i] < idxs[j] })
+		buf := make([]byte, 2, 2+binary.MaxVarintLen32*(len(idxs)+1))
+		buf[0], buf[1] = sparseSketchVersion, s.p
+		var tmp [binary.MaxVarintLen32]byte
+		buf = append(buf, tmp[:binary.PutUvarint(tmp[:], uint64(len(idxs)))]...)
+		prev := uint32(0)
+		for _, idx := range idxs {
+			buf = append(buf, tmp[:binary.PutUvarint(tmp[:], uint64(idx-prev))]...)
+			buf = append(buf, s.sparse[idx])
+			prev = idx
+		}
+		return buf, nil
+	}
+	buf := make([]byte, 2+len(s.regs))
+	buf[0], buf[1] = sketchVersion, s.p
+	copy(buf[2:], s.regs)
+	return buf, nil
+}
+
+//UnmarshalBinary decodes a sketch written by MarshalBinary
+func (s *Sketch) UnmarshalBinary(data []byte) error {
+	if len(data) < 2 || (data[0] != sketchVersion && data[0] != sparseSketchVersion) {
+		return ErrorEncoding
+	}
+	p := data[1]
+	if p < MinPrecision || p > MaxPrecision {
+		return ErrorEncoding
+	}
+	if data[0] == sparseSketchVersion {
+		return s.unmarshalSparse(p, data[2:])
+	}
+	if len(data) != 2+1<<p {
+		return ErrorEncoding
+	}
+	s.p = p
+	s.sparse = nil
+	s.regs = make([]uint8, 1<<p)
+	copy(s.regs, data[2:])
+	return nil
+}
+
+func (s *Sketch) unmarshalSparse(p uint8, data []byte) error {
+	n, k := binary.Uvarint(data)
+	if k <= 0 || n > 1<<p {
+		return ErrorEncoding
+	}
+	data = data[k:]
+	sparse := make(map[uint32]uint8, n)
+	idx := uint64(0)
+	for i := uint64(0); i < n; i++ {
+		delta, k := binary.Uvarint(data)
+		if k <= 0 || len(data) < k+1 {
+			return ErrorEncoding
+		}
+		if idx += delta; idx >= 1<<p {
+			return ErrorEncoding
+		}
+		sparse[uint32(idx)] = data[k]
+		data = data[k+1:]
+	}
+	if len(data) != 0 {
+		return ErrorEncoding
+	}
+	s.p, s.regs, s.sparse = p, nil, sparse
+	if len(sparse) > (1<<p)/sparseShare {
+		s.toDense()
+	}
+	return nil
+}
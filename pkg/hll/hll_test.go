@@ -0,0 +1,93 @@
+package hll
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCount(t *testing.T) {
+	assert := assert.New(t)
+	for _, n := range []int{0, 10, 1000, 100000} {
+		s := NewDefault()
+		for i := 0; i < n; i++ {
+			s.AddString("gid-" + strconv.Itoa(i))
+			//duplicates don't count
+			s.AddString("gid-" + strconv.Itoa(i))
+		}
+		assert.InEpsilon(float64(n)+1, float64(s.Count())+1, 0.03, "n=%d", n)
+	}
+}
+
+func TestMerge(t *testing.T) {
+	assert := assert.New(t)
+	a, b := NewDefault(), NewDefault()
+	for i := 0; i < 20000; i++ {
+		a.AddString(strconv.Itoa(i))
+		b.AddString(strconv.Itoa(i + 10000))
+	}
+	u := a.Clone()
+	assert.Nil(u.Merge(b))
+	assert.InEpsilon(30000, float64(u.Count()), 0.03)
+	//merging is idempotent
+	assert.Nil(u.Merge(b))
+	assert.InEpsilon(30000, float64(u.Count()), 0.03)
+
+	small, _ := New(10)
+	assert.Equal(ErrorMismatch, u.Merge(small))
+	_, err := New(2)
+	assert.Equal(ErrorPrecision, err)
+}
+
+func TestMarshal(t *testing.T) {
+	assert := assert.New(t)
+	s := NewDefault()
+	for i := 0; i < 500; i++ {
+		s.AddString(strconv.Itoa(i))
+	}
+	data, err := s.MarshalBinary()
+	assert.Nil(err)
+	var d Sketch
+	assert.Nil(d.UnmarshalBinary(data))
+	assert.Equal(s, &d)
+	assert.Equal(ErrorEncoding, d.UnmarshalBinary(data[:100]))
+	assert.Equal(ErrorEncoding, d.UnmarshalBinary(nil))
+}
+
+func TestSparse(t *testing.T) {
+	assert := assert.New(t)
+	s := NewDefault()
+	for i := 0; i < 100; i++ {
+		s.AddString("gid-" + strconv.Itoa(i))
+	}
+	assert.Nil(s.regs)
+	assert.InEpsilon(100, float64(s.Count()), 0.03)
+	data, err := s.MarshalBinary()
+	assert.Nil(err)
+	assert.True(len(data) < 400, "sparse encoding of %d bytes", len(data))
+
+	//a dense sketch merged into a sparse one turns it dense
+	d := NewDefault()
+	for i := 0; i < 20000; i++ {
+		d.AddString("gid-" + strconv.Itoa(i))
+	}
+	assert.NotNil(d.regs)
+	u := s.Clone()
+	assert.Nil(u.Merge(d))
+	assert.NotNil(u.regs)
+	assert.InEpsilon(20000, float64(u.Count()), 0.03)
+	//a sparse sketch merged into a dense one
+	assert.Nil(d.Merge(s))
+	assert.Equal(u, d)
+
+	//dense encodings of earlier versions still decode
+	dense := s.Clone()
+	dense.toDense()
+	data, err = dense.MarshalBinary()
+	assert.Nil(err)
+	assert.Len(data, 2+1<<DefaultPrecision)
+	var got Sketch
+	assert.Nil(got.UnmarshalBinary(data))
+	assert.Equal(s.Count(), got.Count())
+}
@@ -0,0 +1,111 @@
+package input
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"io"
+	"strconv"
+)
+
+//CreatedAtKey the input key of the ping time, it is numeric in json input
+const CreatedAtKey = "createdAt"
+
+//CSVReader reads delimited rows, mapping columns to input keys
+type CSVReader struct {
+	rc    io.ReadCloser
+	r     *csv.Reader
+	comma rune
+	keys  []string
+	line  int
+	row   []string
+	raw   bytes.Buffer
+}
+
+//NewCSVReader reads csv rows from rc and closes it on Close. The header
+//is read here when no columns are configured
+func NewCSVReader(rc io.ReadCloser, c CSVConfig) (*CSVReader, error) {
+	r := csv.NewReader(rc)
+	r.FieldsPerRecord = -1
+	r.ReuseRecord = true
+	if c.Delimiter != "" {
+		r.Comma = rune(c.Delimiter[0])
+	}
+	cr := &CSVReader{rc: rc, r: r, comma: r.Comma}
+	columns := c.Columns
+	if len(columns) == 0 {
+		header, err := r.Read()
+		if err == io.EOF {
+			return nil, errors.New("Error csv input without a header")
+		}
+		if err != nil {
+			return nil, err
+		}
+		cr.line++
+		columns = append([]string(nil), header...)
+	}
+	cr.keys = make([]string, len(columns))
+	for i, col := range columns {
+		if key, ok := c.Mapping[col]; ok {
+			cr.keys[i] = key
+		} else {
+			cr.keys[i] = col
+		}
+	}
+	return cr, nil
+}
+
+//Read decodes the next row. Rows with more fields than columns are
+//errors, missing trailing fields are left out of the record
+func (cr *CSVReader) Read() (Record, error) {
+	row, err := cr.r.Read()
+	if err == io.EOF {
+		return nil, err
+	}
+	cr.line++
+	cr.row = row
+	if err != nil {
+		cr.row = nil
+		if _, ok := err.(*csv.ParseError); ok {
+			return nil, &RecordError{cr.line, err}
+		}
+		return nil, err
+	}
+	if len(row) > len(cr.keys) {
+		return nil, &RecordError{cr.line, errors.New("more fields than columns")}
+	}
+	rec := make(Record, len(row))
+	for i, v := range row {
+		rec[cr.keys[i]] = v
+	}
+	//json input carries createdAt as a number
+	if v, ok := rec[CreatedAtKey].(string); ok {
+		if ts, err := strconv.ParseFloat(v, 64); err == nil {
+			rec[CreatedAtKey] = ts
+		}
+	}
+	return rec, nil
+}
+
+//Line returns the row number of the last record read, the header is row 1
+func (cr *CSVReader) Line() int {
+	return cr.line
+}
+
+//Raw returns the last row re-encoded as csv, nil if it did not parse
+func (cr *CSVReader) Raw() []byte {
+	if cr.row == nil {
+		return nil
+	}
+	cr.raw.Reset()
+	w := csv.NewWriter(&cr.raw)
+	w.Comma = cr.comma
+	w.Write(cr.row)
+	w.Flush()
+	return bytes.TrimRight(cr.raw.Bytes(), "\r\n")
+}
+
+//Close closes the underlying reader
+func (cr *CSVReader) Close() error {
+	return cr.rc.Close()
+}
@@ -0,0 +1,184 @@
+//Package input reads partner location exports as a stream of normalized
+//ping records, whatever their file format
+package input
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/bamarb/aws-pipeline-go/pkg/file"
+)
+
+//Input formats
+const (
+	FormatNDJSON  = "ndjson"
+	FormatCSV     = "csv"
+	FormatParquet = "parquet"
+)
+
+//Record a normalized ping keyed and typed like a decoded json input
+//line: string ids and coordinates, a numeric createdAt
+type Record map[string]interface{}
+
+//Reader a stream of records
+type Reader interface {
+	//Read returns the next record and io.EOF at the end. A *RecordError
+	//only spoils its own record, reading can go on. Any other error
+	//ends the stream
+	Read() (Record, error)
+	//Line returns the line or row number of the last record read
+	Line() int
+	//Raw returns the last record as read, for dead lettering. It is
+	//valid until the next Read
+	Raw() []byte
+	Close() error
+}
+
+//RecordError a record that could not be decoded
+type RecordError struct {
+	Line int
+	Err  error
+}
+
+func (re *RecordError) Error() string {
+	return fmt.Sprintf("record %d: %s", re.Line, re.Err)
+}
+
+//CSVConfig column mapping of csv files. Without Columns the first row is
+//a header naming the columns. Mapping renames columns to input keys, eg:
+//device_id to gid, unmapped columns keep their name
+type CSVConfig struct {
+	Delimiter string
+	Columns   []string
+	Mapping   map[string]string
+}
+
+//Config chooses the reader of a file. Prefixes maps file name prefixes to
+//a format and wins over the extension, Format is used when neither
+//decides. AccuracyKey names the accuracy field in records read from
+//Parquet. MaxLineBytes limits json lines, longer lines are skipped
+type Config struct {
+	Format       string
+	Prefixes     map[string]string
+	CSV          CSVConfig
+	AccuracyKey  string
+	MaxLineBytes int
+}
+
+//FormatOf returns the format of the file name, the longest matching
+//prefix decides, then the extension
+func (c Config) FormatOf(name string) string {
+	base := path.Base(name)
+	prefixes := make([]string, 0, len(c.Prefixes))
+	for p := range c.Prefixes {
+		prefixes = append(prefixes, p)
+	}
+	sort.Slice(prefixes, func(i, j int) bool { return len(prefixes[i]) > len(prefixes[j]) })
+	for _, p := range prefixes {
+		if strings.HasPrefix(base, p) {
+			return c.Prefixes[p]
+		}
+	}
+	switch strings.ToLower(path.Ext(base)) {
+	case ".csv", ".tsv":
+		return FormatCSV
+	case ".parquet":
+		return FormatParquet
+	case ".json", ".ndjson", ".jsonl":
+		return FormatNDJSON
+	}
+	if c.Format != "" {
+		return c.Format
+	}
+	return FormatNDJSON
+}
+
+//Validate checks the configured formats
+func (c Config) Validate() error {
+	formats := []string{c.Format}
+	for _, f := range c.Prefixes {
+		formats = append(formats, f)
+	}
+	for _, f := range formats {
+		switch f {
+		case "", FormatNDJSON, FormatCSV, FormatParquet:
+		default:
+			return fmt.Errorf("Unknown input format [%s]", f)
+		}
+	}
+	if c.MaxLineBytes < 0 {
+		return fmt.Errorf("Invalid max line size %d", c.MaxLineBytes)
+	}
+	if len(c.CSV.Delimiter) > 1 {
+		return fmt.Errorf("Invalid csv delimiter [%s]", c.CSV.Delimiter)
+	}
+	return nil
+}
+
+//Open opens a local file with the reader for its format
+func Open(name string, c Config) (Reader, error) {
+	format := c.FormatOf(name)
+	if format == FormatParquet {
+		return NewParquetReader(name, c.AccuracyKey)
+	}
+	fh, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return newStreamReader(fh, format, c)
+}
+
+//OpenFile opens a local or s3 file with the reader for its format. Parquet
+//needs random access, remote Parquet files are copied to a temporary file
+//first
+func OpenFile(ctx context.Context, f file.File, c Config) (Reader, error) {
+	if lf, ok := f.(*file.LocalFile); ok {
+		return Open(lf.String(), c)
+	}
+	format := c.FormatOf(f.Relative())
+	if format != FormatParquet {
+		rc, err := f.Reader()
+		if err != nil {
+			return nil, err
+		}
+		return newStreamReader(rc, format, c)
+	}
+	tmp, err := ioutil.TempFile("", "input-*.parquet")
+	if err != nil {
+		return nil, err
+	}
+	defer tmp.Close()
+	rc, err := f.Reader()
+	if err == nil {
+		_, err = io.Copy(tmp, rc)
+		rc.Close()
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return nil, err
+	}
+	pr, err := NewParquetReader(tmp.Name(), c.AccuracyKey)
+	if err != nil {
+		os.Remove(tmp.Name())
+		return nil, err
+	}
+	pr.remove = true
+	return pr, nil
+}
+
+func newStreamReader(rc io.ReadCloser, format string, c Config) (Reader, error) {
+	if format == FormatCSV {
+		r, err := NewCSVReader(rc, c.CSV)
+		if err != nil {
+			rc.Close()
+		}
+		return r, err
+	}
+	return NewNDJSONReader(rc, c.MaxLineBytes), nil
+}
@@ -0,0 +1,179 @@
+package input
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bamarb/aws-pipeline-go/pkg/file"
+	"github.com/stretchr/testify/assert"
+	"github.com/xitongsys/parquet-go-source/local"
+	"github.com/xitongsys/parquet-go/writer"
+)
+
+func readAll(t *testing.T, r Reader) ([]Record, int) {
+	var recs []Record
+	bad := 0
+	for {
+		rec, err := r.Read()
+		if err == io.EOF {
+			return recs, bad
+		}
+		if _, ok := err.(*RecordError); ok {
+			bad++
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		recs = append(recs, rec)
+	}
+}
+
+func TestFormatOf(t *testing.T) {
+	assert := assert.New(t)
+	c := Config{Format: FormatCSV, Prefixes: map[string]string{"partner": FormatNDJSON, "partnerx-": FormatParquet}}
+	assert.Equal(FormatParquet, c.FormatOf("/in/partnerx-2018-09-06"))
+	assert.Equal(FormatNDJSON, c.FormatOf("partner-2018.csv"))
+	assert.Equal(FormatCSV, c.FormatOf("export.CSV"))
+	assert.Equal(FormatParquet, c.FormatOf("export.parquet"))
+	assert.Equal(FormatNDJSON, c.FormatOf("usergeo.json"))
+	assert.Equal(FormatCSV, c.FormatOf("usergeologs-1"))
+	assert.Equal(FormatNDJSON, Config{}.FormatOf("usergeologs-1"))
+
+	assert.Nil(c.Validate())
+	assert.NotNil(Config{Format: "xml"}.Validate())
+	assert.NotNil(Config{Prefixes: map[string]string{"a": "avro"}}.Validate())
+}
+
+func TestNDJSONReader(t *testing.T) {
+	assert := assert.New(t)
+	in := `{"gid":"g1","lat":"12.9","lng":"77.5","createdAt":1536197400123}
+not json
+null
+[1,2]
+{"gid":"g2"}
+`
+	recs, bad := readAll(t, NewNDJSONReader(ioutil.NopCloser(strings.NewReader(in)), 0))
+	assert.Equal(3, bad)
+	assert.Len(recs, 2)
+	assert.Equal("g1", recs[0]["gid"])
+	assert.Equal(1536197400123.0, recs[0][CreatedAtKey])
+
+	_, err := NewNDJSONReader(ioutil.NopCloser(strings.NewReader("null\n")), 0).Read()
+	assert.Equal(&RecordError{1, ErrNotObject}, err)
+}
+
+func TestCSVReader(t *testing.T) {
+	assert := assert.New(t)
+	in := "device_id;latitude;longitude;timestamp;apikey\n" +
+		"g1;12.9;77.5;1536197400123;k1\n" +
+		"g2;12.8;77.4;1536197400;k1;extra\n" +
+		"g3;12.7\n"
+	cfg := CSVConfig{Delimiter: ";", Mapping: map[string]string{"device_id": "gid",
+		"latitude": "lat", "longitude": "lng", "timestamp": "createdAt"}}
+	r, err := NewCSVReader(ioutil.NopCloser(strings.NewReader(in)), cfg)
+	assert.Nil(err)
+	recs, bad := readAll(t, r)
+	assert.Equal(1, bad)
+	assert.Len(recs, 2)
+	assert.Equal(Record{"gid": "g1", "lat": "12.9", "lng": "77.5", "createdAt": 1536197400123.0, "apikey": "k1"}, recs[0])
+	assert.Equal(Record{"gid": "g3", "lat": "12.7"}, recs[1])
+
+	cfg = CSVConfig{Columns: []string{"gid", "lat", "lng", "createdAt"}}
+	r, err = NewCSVReader(ioutil.NopCloser(strings.NewReader("g1,1,2,x\n")), cfg)
+	assert.Nil(err)
+	recs, _ = readAll(t, r)
+	assert.Equal("x", recs[0][CreatedAtKey])
+
+	_, err = NewCSVReader(ioutil.NopCloser(strings.NewReader("")), CSVConfig{})
+	assert.NotNil(err)
+}
+
+func TestParquetReader(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "input")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	name := filepath.Join(dir, "partner.parquet")
+	fw, err := local.NewLocalFileWriter(name)
+	assert.Nil(err)
+	pw, err := writer.NewParquetWriter(fw, new(PingRow), 1)
+	assert.Nil(err)
+	acc := 12.5
+	total := parquetBatch + 5
+	for i := 0; i < total; i++ {
+		row := PingRow{Gid: "g1", Apikey: "k1", Lat: 12.9716, Lng: 77.5946, CreatedAt: 1536197400123}
+		if i == 0 {
+			row.Accuracy = &acc
+		}
+		assert.Nil(pw.Write(row))
+	}
+	assert.Nil(pw.WriteStop())
+	assert.Nil(fw.Close())
+
+	r, err := Open(name, Config{AccuracyKey: "acc"})
+	assert.Nil(err)
+	recs, bad := readAll(t, r)
+	assert.Nil(r.Close())
+	assert.Equal(0, bad)
+	assert.Len(recs, total)
+	assert.Equal(Record{"gid": "g1", "apikey": "k1", "lat": "12.9716", "lng": "77.5946",
+		"createdAt": 1536197400123.0, "acc": 12.5}, recs[0])
+	_, ok := recs[1]["acc"]
+	assert.False(ok)
+}
+
+func TestOpenFile(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "input")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "pings.csv")
+	assert.Nil(ioutil.WriteFile(name, []byte("gid,lat\ng1,1\n"), 0644))
+
+	r, err := OpenFile(context.Background(), file.NewLocalFile(name), Config{})
+	assert.Nil(err)
+	recs, _ := readAll(t, r)
+	assert.Nil(r.Close())
+	assert.Equal([]Record{{"gid": "g1", "lat": "1"}}, recs)
+}
+
+func TestNDJSONReaderLongLines(t *testing.T) {
+	assert := assert.New(t)
+	long := `{"gid":"` + strings.Repeat("x", 100) + `"}`
+	exact := `{"gid":"` + strings.Repeat("y", 32-10) + `"}`
+	in := long + "\r\n" + exact + "\r\n" + `{"gid":"g3"}`
+	r := NewNDJSONReader(ioutil.NopCloser(strings.NewReader(in)), 32)
+	r.br = bufio.NewReaderSize(r.rc, 16)
+
+	_, err := r.Read()
+	assert.Equal(&RecordError{1, ErrLineTooLong}, err)
+	assert.Equal(long[:32], string(r.Raw()))
+	rec, err := r.Read()
+	assert.Nil(err)
+	assert.Equal(exact, string(r.Raw()))
+	assert.Equal(strings.Repeat("y", 22), rec["gid"])
+	rec, err = r.Read()
+	assert.Nil(err)
+	assert.Equal("g3", rec["gid"])
+	assert.Equal(3, r.Line())
+	_, err = r.Read()
+	assert.Equal(io.EOF, err)
+}
+
+func TestRaw(t *testing.T) {
+	assert := assert.New(t)
+	r, err := NewCSVReader(ioutil.NopCloser(strings.NewReader("gid;name\ng1;\"a;b\"\n")), CSVConfig{Delimiter: ";"})
+	assert.Nil(err)
+	_, err = r.Read()
+	assert.Nil(err)
+	assert.Equal(2, r.Line())
+	assert.Equal(`g1;"a;b"`, string(r.Raw()))
+}
@@ -0,0 +1,109 @@
+package input
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+)
+
+//DefaultMaxLineBytes longest json line read when the config leaves it unset
+const DefaultMaxLineBytes = 1024 * 1024
+
+//ErrLineTooLong a line over the max line size, it is skipped
+var ErrLineTooLong = errors.New("line exceeds the max line size")
+
+//ErrNotObject a line that is valid json but not an object, eg: null
+var ErrNotObject = errors.New("line is not a json object")
+
+//NDJSONReader reads one json object per line. Lines longer than the max
+//line size are skipped as record errors instead of ending the stream,
+//their raw bytes are cut at the max size
+type NDJSONReader struct {
+	rc   io.ReadCloser
+	br   *bufio.Reader
+	max  int
+	raw  []byte
+	line int
+}
+
+//NewNDJSONReader reads json lines of up to maxLine bytes from rc and
+//closes it on Close. maxLine <= 0 uses DefaultMaxLineBytes
+func NewNDJSONReader(rc io.ReadCloser, maxLine int) *NDJSONReader {
+	if maxLine <= 0 {
+		maxLine = DefaultMaxLineBytes
+	}
+	return &NDJSONReader{rc: rc, br: bufio.NewReaderSize(rc, 64*1024), max: maxLine}
+}
+
+//readLine reads the next line into raw without its line ending, a
+//too long line is read to its end but only max bytes are kept
+func (nr *NDJSONReader) readLine() (bool, error) {
+	nr.raw = nr.raw[:0]
+	//room for the line ending
+	limit := nr.max + 2
+	overflow, read := false, 0
+	for {
+		chunk, err := nr.br.ReadSlice('\n')
+		read += len(chunk)
+		if keep := limit - len(nr.raw); len(chunk) > keep {
+			overflow = true
+			chunk = chunk[:keep]
+		}
+		nr.raw = append(nr.raw, chunk...)
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err == io.EOF && read > 0 {
+			err = nil
+		}
+		if err != nil {
+			return false, err
+		}
+		break
+	}
+	nr.raw = bytes.TrimRight(nr.raw, "\r\n")
+	if overflow || len(nr.raw) > nr.max {
+		if len(nr.raw) > nr.max {
+			nr.raw = nr.raw[:nr.max]
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+//Read decodes the next line
+func (nr *NDJSONReader) Read() (Record, error) {
+	tooLong, err := nr.readLine()
+	if err != nil {
+		return nil, err
+	}
+	nr.line++
+	if tooLong {
+		return nil, &RecordError{nr.line, ErrLineTooLong}
+	}
+	var rec Record
+	if err := json.Unmarshal(nr.raw, &rec); err != nil {
+		return nil, &RecordError{nr.line, err}
+	}
+	if rec == nil {
+		return nil, &RecordError{nr.line, ErrNotObject}
+	}
+	return rec, nil
+}
+
+//Line returns the line number of the last record read
+func (nr *NDJSONReader) Line() int {
+	return nr.line
+}
+
+//Raw returns the last line read, valid until the next Read
+func (nr *NDJSONReader) Raw() []byte {
+	return nr.raw
+}
+
+//Close closes the underlying reader
+func (nr *NDJSONReader) Close() error {
+	return nr.rc.Close()
+}
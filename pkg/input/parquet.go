@@ -0,0 +1,109 @@
+package input
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"strconv"
+
+	"github.com/xitongsys/parquet-go-source/local"
+	"github.com/xitongsys/parquet-go/reader"
+	"github.com/xitongsys/parquet-go/source"
+)
+
+//PingRow the Parquet schema of partner ping exports, created_at is a
+//millisecond timestamp
+type PingRow struct {
+	Gid       string   `parquet:"name=gid, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Apikey    string   `parquet:"name=apikey, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Lat       float64  `parquet:"name=lat, type=DOUBLE"`
+	Lng       float64  `parquet:"name=lng, type=DOUBLE"`
+	CreatedAt int64    `parquet:"name=created_at, type=INT64, convertedtype=TIMESTAMP_MILLIS"`
+	Accuracy  *float64 `parquet:"name=accuracy, type=DOUBLE, repetitiontype=OPTIONAL"`
+}
+
+//parquetBatch rows decoded per read
+const parquetBatch = 1000
+
+//ParquetReader reads PingRow files in batches
+type ParquetReader struct {
+	name        string
+	file        source.ParquetFile
+	pr          *reader.ParquetReader
+	accuracyKey string
+	left        int64
+	batch       []PingRow
+	pos         int
+	remove      bool
+	last        Record
+}
+
+//NewParquetReader opens a Parquet file, the accuracy column is added to
+//records as accuracyKey when that is set
+func NewParquetReader(name, accuracyKey string) (*ParquetReader, error) {
+	fr, err := local.NewLocalFileReader(name)
+	if err != nil {
+		return nil, err
+	}
+	pr, err := reader.NewParquetReader(fr, new(PingRow), 1)
+	if err != nil {
+		fr.Close()
+		return nil, err
+	}
+	return &ParquetReader{name: name, file: fr, pr: pr, accuracyKey: accuracyKey,
+		left: pr.GetNumRows()}, nil
+}
+
+//Read returns the next row as a record
+func (pr *ParquetReader) Read() (Record, error) {
+	if pr.pos == len(pr.batch) {
+		if pr.left == 0 {
+			return nil, io.EOF
+		}
+		n := int64(parquetBatch)
+		if pr.left < n {
+			n = pr.left
+		}
+		pr.batch = make([]PingRow, n)
+		pr.pos = 0
+		if err := pr.pr.Read(&pr.batch); err != nil {
+			return nil, err
+		}
+		pr.left -= n
+	}
+	row := pr.batch[pr.pos]
+	pr.pos++
+	rec := Record{
+		"gid":        row.Gid,
+		"apikey":     row.Apikey,
+		"lat":        strconv.FormatFloat(row.Lat, 'f', -1, 64),
+		"lng":        strconv.FormatFloat(row.Lng, 'f', -1, 64),
+		CreatedAtKey: float64(row.CreatedAt),
+	}
+	if row.Accuracy != nil && pr.accuracyKey != "" {
+		rec[pr.accuracyKey] = *row.Accuracy
+	}
+	pr.last = rec
+	return rec, nil
+}
+
+//Line returns the row number of the last record read
+func (pr *ParquetReader) Line() int {
+	return int(pr.pr.GetNumRows()-pr.left) - len(pr.batch) + pr.pos
+}
+
+//Raw returns the last record as a json object
+func (pr *ParquetReader) Raw() []byte {
+	raw, _ := json.Marshal(pr.last)
+	return raw
+}
+
+//Close closes the file, a temporary copy is removed
+func (pr *ParquetReader) Close() error {
+	pr.pr.ReadStop()
+	err := pr.file.Close()
+	if pr.remove {
+		os.Remove(pr.name)
+	}
+	return err
+}
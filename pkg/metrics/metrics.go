@@ -0,0 +1,148 @@
+//Package metrics prometheus metrics of the pipeline and the http server
+//exposing them with health and readiness checks
+package metrics
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const namespace = "tpz"
+
+var (
+	//S3ListDuration time taken to list the objects of a prefix
+	S3ListDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "s3_list_duration_seconds",
+		Help:      "Time taken to list the s3 objects of a prefix",
+		Buckets:   prometheus.DefBuckets,
+	})
+	//S3ListErrors failed s3 listings
+	S3ListErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "s3_list_errors_total",
+		Help:      "Failed s3 prefix listings",
+	})
+	//S3Downloads s3 downloads by result, ok or error
+	S3Downloads = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "s3_downloads_total",
+		Help:      "S3 file downloads by result",
+	}, []string{"result"})
+	//S3DownloadBytes bytes downloaded from s3
+	S3DownloadBytes = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "s3_download_bytes_total",
+		Help:      "Bytes downloaded from s3",
+	})
+	//S3DownloadDuration time taken to download an s3 file
+	S3DownloadDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "s3_download_duration_seconds",
+		Help:      "Time taken to download an s3 file",
+		Buckets:   prometheus.ExponentialBuckets(0.05, 2, 12),
+	})
+	//RedisQueryDuration latency of the redis nearby store queries
+	RedisQueryDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "redis_nearby_query_duration_seconds",
+		Help:      "Latency of the redis nearby store queries",
+		Buckets:   prometheus.ExponentialBuckets(0.0005, 2, 14),
+	})
+	//RedisQueryErrors failed redis nearby store queries
+	RedisQueryErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "redis_nearby_query_errors_total",
+		Help:      "Failed redis nearby store queries",
+	})
+	//RecordsRead input lines read
+	RecordsRead = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "records_read_total",
+		Help:      "Input lines read",
+	})
+	//RecordsMatched input records matched to at least one store
+	RecordsMatched = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "records_matched_total",
+		Help:      "Input records matched to a store",
+	})
+	//RecordsRejected input records rejected by error class
+	RecordsRejected = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "records_rejected_total",
+		Help:      "Input records rejected by error class",
+	}, []string{"class"})
+	//TaskQueueDepth tasks submitted to a task pool and not yet started
+	TaskQueueDepth = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "task_queue_depth",
+		Help:      "Tasks waiting for a worker of the pool",
+	}, []string{"pool"})
+	//InputFilesPending input files of a run not yet taken by a geo worker
+	InputFilesPending = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "input_files_pending",
+		Help:      "Input files waiting for a geo worker",
+	})
+	//RunDuration duration of the pipeline runs by status
+	RunDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "run_duration_seconds",
+		Help:      "Duration of the pipeline runs by status",
+		Buckets:   prometheus.ExponentialBuckets(30, 2, 10),
+	}, []string{"status"})
+	//LastSuccess time of the last successful run per schedule
+	LastSuccess = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "last_success_timestamp_seconds",
+		Help:      "Unix time of the last successful run per schedule",
+	}, []string{"schedule"})
+	//LastSuccessWindow end of the window of the last successful run per
+	//schedule
+	LastSuccessWindow = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "last_success_window_end_seconds",
+		Help:      "Unix time of the window end of the last successful run per schedule",
+	}, []string{"schedule"})
+)
+
+func init() {
+	prometheus.MustRegister(S3ListDuration, S3ListErrors, S3Downloads,
+		S3DownloadBytes, S3DownloadDuration, RedisQueryDuration, RedisQueryErrors,
+		RecordsRead, RecordsMatched, RecordsRejected, TaskQueueDepth,
+		InputFilesPending, RunDuration, LastSuccess, LastSuccessWindow)
+}
+
+//Since returns the seconds elapsed since start
+func Since(start time.Time) float64 {
+	return time.Since(start).Seconds()
+}
+
+//Result returns the result label of an operation
+func Result(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "ok"
+}
+
+//PoolDepth returns a task pool observer that sets the queue depth gauge
+//of the named pool
+func PoolDepth(pool string) func(int) {
+	g := TaskQueueDepth.WithLabelValues(pool)
+	return func(n int) { g.Set(float64(n)) }
+}
+
+//RunFinished records a finished run of the schedule over the window
+//ending at windowEnd. Only ok runs move the last success gauges, failed
+//and partial runs don't
+func RunFinished(schedule, status string, windowEnd time.Time, took time.Duration) {
+	RunDuration.WithLabelValues(status).Observe(took.Seconds())
+	if status != "ok" {
+		return
+	}
+	LastSuccess.WithLabelValues(schedule).Set(float64(time.Now().Unix()))
+	LastSuccessWindow.WithLabelValues(schedule).Set(float64(windowEnd.Unix()))
+}
@@ -0,0 +1,66 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func get(t *testing.T, url string) (int, string) {
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, string(body)
+}
+
+func TestServer(t *testing.T) {
+	assert := assert.New(t)
+	srv := NewServer("127.0.0.1:0", func() error { return errors.New("cache not built") })
+	assert.Nil(srv.Start())
+	defer srv.Shutdown(context.Background())
+	base := "http://" + srv.Addr().String()
+
+	code, body := get(t, base+"/healthz")
+	assert.Equal(http.StatusOK, code)
+	assert.Equal("ok\n", body)
+	code, body = get(t, base+"/readyz")
+	assert.Equal(http.StatusServiceUnavailable, code)
+	assert.Contains(body, "cache not built")
+	srv.SetReady(nil)
+	code, _ = get(t, base+"/readyz")
+	assert.Equal(http.StatusOK, code)
+
+	RecordsRejected.WithLabelValues("parse").Inc()
+	PoolDepth("test")(3)
+	InputFilesPending.Set(2)
+	RunFinished("hourly", "ok", time.Unix(1536192000, 0), time.Minute)
+	code, body = get(t, base+"/metrics")
+	assert.Equal(http.StatusOK, code)
+	for _, want := range []string{
+		`tpz_records_rejected_total{class="parse"} 1`,
+		`tpz_task_queue_depth{pool="test"} 3`,
+		`tpz_input_files_pending 2`,
+		`tpz_last_success_window_end_seconds{schedule="hourly"} 1.536192e+09`,
+		`tpz_run_duration_seconds_count{status="ok"} 1`,
+	} {
+		assert.True(strings.Contains(body, want), want)
+	}
+
+	RunFinished("daily", "failed", time.Now(), time.Minute)
+	RunFinished("daily", "partial", time.Now(), time.Minute)
+	_, body = get(t, base+"/metrics")
+	assert.False(strings.Contains(body, `tpz_last_success_timestamp_seconds{schedule="daily"}`))
+	assert.True(strings.Contains(body, `tpz_run_duration_seconds_count{status="partial"} 1`))
+}
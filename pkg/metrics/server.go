@@ -0,0 +1,91 @@
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
+)
+
+//ReadyFunc returns nil when the process is ready to do work
+type ReadyFunc func() error
+
+//Server serves /metrics, /healthz and /readyz. healthz answers ok while
+//the process is up, readyz calls the ready func
+type Server struct {
+	lock  sync.Mutex
+	ready ReadyFunc
+	srv   *http.Server
+	addr  net.Addr
+}
+
+//NewServer returns an unstarted server listening on addr, a nil ready
+//func is always ready
+func NewServer(addr string, ready ReadyFunc) *Server {
+	s := &Server{ready: ready}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/healthz", s.healthz)
+	mux.HandleFunc("/readyz", s.readyz)
+	s.srv = &http.Server{Addr: addr, Handler: mux, ReadTimeout: 10 * time.Second,
+		WriteTimeout: 30 * time.Second}
+	return s
+}
+
+//Start listens and serves in the background
+func (s *Server) Start() error {
+	ln, err := net.Listen("tcp", s.srv.Addr)
+	if err != nil {
+		return err
+	}
+	s.lock.Lock()
+	s.addr = ln.Addr()
+	s.lock.Unlock()
+	go func() {
+		if err := s.srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+			log.Errorf("Error metrics server: %s", err)
+		}
+	}()
+	return nil
+}
+
+//Addr returns the listening address, nil before Start
+func (s *Server) Addr() net.Addr {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.addr
+}
+
+//SetReady replaces the ready func
+func (s *Server) SetReady(ready ReadyFunc) {
+	s.lock.Lock()
+	s.ready = ready
+	s.lock.Unlock()
+}
+
+//Shutdown stops the server gracefully
+func (s *Server) Shutdown(ctx context.Context) error {
+	return s.srv.Shutdown(ctx)
+}
+
+func (s *Server) healthz(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintln(w, "ok")
+}
+
+func (s *Server) readyz(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	ready := s.ready
+	s.lock.Unlock()
+	if ready != nil {
+		if err := ready(); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+	}
+	fmt.Fprintln(w, "ok")
+}
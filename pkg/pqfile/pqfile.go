@@ -0,0 +1,91 @@
+//Package pqfile writes pipeline records as Parquet files with typed
+//columns, for loading into Athena and Spark
+package pqfile
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/xitongsys/parquet-go-source/local"
+	"github.com/xitongsys/parquet-go/parquet"
+	"github.com/xitongsys/parquet-go/source"
+	"github.com/xitongsys/parquet-go/writer"
+)
+
+//Parallelism number of goroutines used to encode a row group
+const Parallelism = 2
+
+//DefaultRowGroupSize row groups are cut at this many bytes
+const DefaultRowGroupSize = 64 * 1024 * 1024
+
+//Writer writes rows of a single schema to a Parquet file. The file is
+//written under a hidden temporary name and renamed into place on Close,
+//a reader never sees a file without its footer
+type Writer struct {
+	name string
+	tmp  string
+	file source.ParquetFile
+	pw   *writer.ParquetWriter
+	rows int64
+}
+
+//Create creates or replaces name. schema is a pointer to one of the row
+//types, its parquet tags define the columns
+func Create(name string, schema interface{}) (*Writer, error) {
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return nil, err
+	}
+	tmp := filepath.Join(filepath.Dir(name), "."+filepath.Base(name)+".tmp")
+	file, err := local.NewLocalFileWriter(tmp)
+	if err != nil {
+		return nil, err
+	}
+	pw, err := writer.NewParquetWriter(file, schema, Parallelism)
+	if err != nil {
+		file.Close()
+		os.Remove(tmp)
+		return nil, err
+	}
+	pw.RowGroupSize = DefaultRowGroupSize
+	pw.CompressionType = parquet.CompressionCodec_SNAPPY
+	return &Writer{name: name, tmp: tmp, file: file, pw: pw}, nil
+}
+
+//Name returns the final file name
+func (w *Writer) Name() string {
+	return w.name
+}
+
+//Write writes a row, it must be of the schema type
+func (w *Writer) Write(row interface{}) error {
+	if err := w.pw.Write(row); err != nil {
+		return err
+	}
+	w.rows++
+	return nil
+}
+
+//Rows returns the number of rows written
+func (w *Writer) Rows() int64 {
+	return w.rows
+}
+
+//Close writes the footer and moves the file into place. On error the
+//temporary file is removed and any previous file is left as it was
+func (w *Writer) Close() error {
+	err := w.pw.WriteStop()
+	if cerr := w.file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(w.tmp)
+		return err
+	}
+	return os.Rename(w.tmp, w.name)
+}
+
+//Abort discards the file
+func (w *Writer) Abort() {
+	w.file.Close()
+	os.Remove(w.tmp)
+}
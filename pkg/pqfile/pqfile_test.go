@@ -0,0 +1,101 @@
+package pqfile
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/bamarb/aws-pipeline-go/pkg/trapyz"
+	"github.com/stretchr/testify/assert"
+	"github.com/xitongsys/parquet-go-source/local"
+	"github.com/xitongsys/parquet-go/reader"
+)
+
+func readGeoLocRows(t *testing.T, name string) []GeoLocRow {
+	fr, err := local.NewLocalFileReader(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fr.Close()
+	pr, err := reader.NewParquetReader(fr, new(GeoLocRow), Parallelism)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pr.ReadStop()
+	rows := make([]GeoLocRow, pr.GetNumRows())
+	if err := pr.Read(&rows); err != nil {
+		t.Fatal(err)
+	}
+	return rows
+}
+
+func TestGeoLocRows(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "pqfile")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	rec := trapyz.GeoLocOutput{Gid: "g1", UID: "s1", Sname: "Store", Lat: "12.9716", Lng: "77.5946",
+		Pin: 560001, Cat: 3, Subcat: 7, City: 1, Apikey: 2, Distance: 42, Createdat: "1536197400123"}
+	row, err := GeoLocRowFrom(rec)
+	assert.Nil(err)
+	assert.Equal(12.9716, row.Lat)
+	assert.Equal(int32(42), row.Distance)
+	assert.Equal(int64(1536197400123), row.Createdat)
+
+	rec.Createdat = "1536197400"
+	row, err = GeoLocRowFrom(rec)
+	assert.Nil(err)
+	assert.Equal(int64(1536197400000), row.Createdat)
+	_, err = GeoLocRowFrom(trapyz.GeoLocOutput{Lat: "north", Lng: "1", Createdat: "1"})
+	assert.NotNil(err)
+
+	name := filepath.Join(dir, "geocalc.parquet")
+	w, err := Create(name, new(GeoLocRow))
+	assert.Nil(err)
+	for i := 0; i < 3; i++ {
+		assert.Nil(w.Write(row))
+	}
+	_, err = os.Stat(name)
+	assert.True(os.IsNotExist(err), "file is only visible after close")
+	assert.Nil(w.Close())
+	assert.Equal(int64(3), w.Rows())
+
+	rows := readGeoLocRows(t, name)
+	assert.Len(rows, 3)
+	assert.Equal(row, rows[2])
+	infos, err := ioutil.ReadDir(dir)
+	assert.Nil(err)
+	assert.Len(infos, 1)
+}
+
+func TestFootfallRows(t *testing.T) {
+	assert := assert.New(t)
+	at := time.Date(2018, 9, 6, 1, 30, 0, 0, time.UTC)
+	ms := at.UnixNano() / int64(time.Millisecond)
+	ff := trapyz.NewFootfall()
+	for _, gid := range []string{"g1", "g2", "g1"} {
+		ff.Add(trapyz.GeoLocOutput{UID: "s1", Gid: gid, Apikey: 1, Distance: 30,
+			Createdat: strconv.FormatInt(ms, 10)})
+	}
+	hours := ff.Hours()
+	assert.Len(hours, 1)
+	row, err := FootfallRowFrom(hours[0])
+	assert.Nil(err)
+	assert.Equal("s1", row.UID)
+	assert.Equal(millis(at.Truncate(time.Hour)), row.Hour)
+	assert.Equal(int64(3), row.Pings)
+	assert.Equal(int64(2), row.UniqueDevices)
+	assert.Equal(int32(1), row.UniqueApikeys)
+	assert.Equal(int64(3), row.Histogram[1])
+
+	dir, err := ioutil.TempDir("", "pqfile")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+	assert.Nil(WriteFootfall(filepath.Join(dir, "footfall.parquet"), ff))
+	_, err = os.Stat(filepath.Join(dir, "footfall.parquet"))
+	assert.Nil(err)
+}
@@ -0,0 +1,116 @@
+package pqfile
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/bamarb/aws-pipeline-go/pkg/trapyz"
+)
+
+//GeoLocRow the Parquet schema of a GeoLocOutput. Coordinates and the
+//distance are numeric, createdat is a millisecond timestamp and the low
+//cardinality ids are dictionary encoded
+type GeoLocRow struct {
+	Gid       string  `parquet:"name=gid, type=BYTE_ARRAY, convertedtype=UTF8"`
+	UID       string  `parquet:"name=uuid, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	Sname     string  `parquet:"name=sname, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	Lat       float64 `parquet:"name=lat, type=DOUBLE"`
+	Lng       float64 `parquet:"name=lng, type=DOUBLE"`
+	Pin       int32   `parquet:"name=pin, type=INT32"`
+	Cat       int32   `parquet:"name=cat, type=INT32, encoding=PLAIN_DICTIONARY"`
+	Subcat    int32   `parquet:"name=subcat, type=INT32, encoding=PLAIN_DICTIONARY"`
+	City      int32   `parquet:"name=city, type=INT32, encoding=PLAIN_DICTIONARY"`
+	Apikey    int32   `parquet:"name=apikey, type=INT32, encoding=PLAIN_DICTIONARY"`
+	Distance  int32   `parquet:"name=distance, type=INT32"`
+	Createdat int64   `parquet:"name=createdat, type=INT64, convertedtype=TIMESTAMP_MILLIS"`
+}
+
+//VisitRow the Parquet schema of a Visit, dwell is in seconds
+type VisitRow struct {
+	Gid         string `parquet:"name=gid, type=BYTE_ARRAY, convertedtype=UTF8"`
+	UID         string `parquet:"name=uuid, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	Sname       string `parquet:"name=sname, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	Cat         int32  `parquet:"name=cat, type=INT32, encoding=PLAIN_DICTIONARY"`
+	Subcat      int32  `parquet:"name=subcat, type=INT32, encoding=PLAIN_DICTIONARY"`
+	City        int32  `parquet:"name=city, type=INT32, encoding=PLAIN_DICTIONARY"`
+	Apikey      int32  `parquet:"name=apikey, type=INT32, encoding=PLAIN_DICTIONARY"`
+	Entry       int64  `parquet:"name=entry, type=INT64, convertedtype=TIMESTAMP_MILLIS"`
+	Exit        int64  `parquet:"name=exit, type=INT64, convertedtype=TIMESTAMP_MILLIS"`
+	Dwell       int64  `parquet:"name=dwell, type=INT64"`
+	Pings       int32  `parquet:"name=pings, type=INT32"`
+	MinDistance int32  `parquet:"name=min_distance, type=INT32"`
+}
+
+//FootfallRow the Parquet schema of a store hour aggregate. The histogram
+//holds the counts of the trapyz.DistanceBuckets
+type FootfallRow struct {
+	UID           string  `parquet:"name=uuid, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	Hour          int64   `parquet:"name=hour, type=INT64, convertedtype=TIMESTAMP_MILLIS"`
+	Pings         int64   `parquet:"name=pings, type=INT64"`
+	UniqueDevices int64   `parquet:"name=unique_devices, type=INT64"`
+	UniqueApikeys int32   `parquet:"name=unique_apikeys, type=INT32"`
+	Histogram     []int64 `parquet:"name=distance_histogram, type=INT64, repetitiontype=REPEATED"`
+}
+
+//GeoLocRowFrom converts a record, coordinates and createdat must parse
+func GeoLocRowFrom(rec trapyz.GeoLocOutput) (GeoLocRow, error) {
+	row := GeoLocRow{Gid: rec.Gid, UID: rec.UID, Sname: rec.Sname, Pin: int32(rec.Pin),
+		Cat: int32(rec.Cat), Subcat: int32(rec.Subcat), City: int32(rec.City),
+		Apikey: int32(rec.Apikey), Distance: int32(rec.Distance)}
+	var err error
+	if row.Lat, err = strconv.ParseFloat(rec.Lat, 64); err != nil {
+		return row, err
+	}
+	if row.Lng, err = strconv.ParseFloat(rec.Lng, 64); err != nil {
+		return row, err
+	}
+	at, err := trapyz.CreatedAtTime(rec.Createdat)
+	if err != nil {
+		return row, err
+	}
+	row.Createdat = millis(at)
+	return row, nil
+}
+
+//VisitRowFrom converts a visit
+func VisitRowFrom(v trapyz.Visit) VisitRow {
+	return VisitRow{Gid: v.Gid, UID: v.UID, Sname: v.Sname, Cat: int32(v.Cat),
+		Subcat: int32(v.Subcat), City: int32(v.City), Apikey: int32(v.Apikey),
+		Entry: v.Entry, Exit: v.Exit, Dwell: v.Dwell, Pings: int32(v.Pings),
+		MinDistance: int32(v.MinDistance)}
+}
+
+//FootfallRowFrom converts a store hour aggregate
+func FootfallRowFrom(hf *trapyz.HourlyFootfall) (FootfallRow, error) {
+	hour, err := time.Parse(trapyz.FootfallHourFormat, hf.Hour)
+	if err != nil {
+		return FootfallRow{}, err
+	}
+	return FootfallRow{UID: hf.UID, Hour: millis(hour), Pings: hf.Pings,
+		UniqueDevices: int64(hf.Devices.Count()), UniqueApikeys: int32(len(hf.Apikeys)),
+		Histogram: hf.Histogram}, nil
+}
+
+//WriteFootfall writes all aggregates of ff to name
+func WriteFootfall(name string, ff *trapyz.Footfall) error {
+	w, err := Create(name, new(FootfallRow))
+	if err != nil {
+		return err
+	}
+	for _, hf := range ff.Hours() {
+		row, err := FootfallRowFrom(hf)
+		if err != nil {
+			w.Abort()
+			return err
+		}
+		if err := w.Write(row); err != nil {
+			w.Abort()
+			return err
+		}
+	}
+	return w.Close()
+}
+
+func millis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
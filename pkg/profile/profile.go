@@ -0,0 +1,229 @@
+//Package profile derives per device attributes from matched pings:
+//top categories, home city, visit frequency and recency
+package profile
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/bamarb/aws-pipeline-go/pkg/trapyz"
+)
+
+//DayFormat format of the active day list
+const DayFormat = "20060102"
+
+//MaxDays number of most recent active days kept per device
+const MaxDays = 90
+
+//TopN number of categories reported in TopCats
+const TopN = 3
+
+//Profile the derived attributes of a device. Counts are kept alongside
+//the derived fields so profiles from different runs can be merged.
+//A visit is a distinct store and day, visits older than the last
+//MaxDays active days are dropped
+type Profile struct {
+	Gid       string                  `json:"gid"`
+	Pings     int64                   `json:"pings"`
+	Cats      map[trapyz.CatID]int64  `json:"cats"`
+	Cities    map[trapyz.CityID]int64 `json:"cities"`
+	Days      []string                `json:"days"`
+	StoreDays map[string]bool         `json:"store_days"`
+	FirstSeen int64                   `json:"first_seen"`
+	LastSeen  int64                   `json:"last_seen"`
+	TopCats   []trapyz.CatID          `json:"top_cats"`
+	HomeCity  trapyz.CityID           `json:"home_city"`
+	Visits    int                     `json:"visits"`
+	Frequency float64                 `json:"visits_per_week"`
+	Recency   int                     `json:"recency_days"`
+}
+
+//New constructs an empty profile
+func New(gid string) *Profile {
+	return &Profile{Gid: gid, Cats: make(map[trapyz.CatID]int64),
+		Cities: make(map[trapyz.CityID]int64), StoreDays: make(map[string]bool)}
+}
+
+//Add counts a matched ping. Visits are distinct store days
+func (p *Profile) Add(rec trapyz.GeoLocOutput) {
+	at, err := trapyz.CreatedAtTime(rec.Createdat)
+	if err != nil {
+		return
+	}
+	ms := at.UnixNano() / int64(time.Millisecond)
+	day := at.UTC().Format(DayFormat)
+	p.Pings++
+	if rec.Cat.Known() {
+		p.Cats[rec.Cat]++
+	}
+	if rec.City.Known() {
+		p.Cities[rec.City]++
+	}
+	p.StoreDays[day+"|"+rec.UID] = true
+	p.addDay(day)
+	if p.FirstSeen == 0 || ms < p.FirstSeen {
+		p.FirstSeen = ms
+	}
+	if ms > p.LastSeen {
+		p.LastSeen = ms
+	}
+}
+
+func (p *Profile) addDay(day string) {
+	i := sort.SearchStrings(p.Days, day)
+	if i < len(p.Days) && p.Days[i] == day {
+		return
+	}
+	p.Days = append(p.Days, "")
+	copy(p.Days[i+1:], p.Days[i:])
+	p.Days[i] = day
+	if len(p.Days) > MaxDays {
+		p.Days = p.Days[len(p.Days)-MaxDays:]
+	}
+}
+
+//Merge adds the counts of other, an earlier profile of the same device
+func (p *Profile) Merge(other *Profile) {
+	p.Pings += other.Pings
+	for c, n := range other.Cats {
+		p.Cats[c] += n
+	}
+	for c, n := range other.Cities {
+		p.Cities[c] += n
+	}
+	for _, d := range other.Days {
+		p.addDay(d)
+	}
+	for sd := range other.StoreDays {
+		p.StoreDays[sd] = true
+	}
+	if other.FirstSeen != 0 && (p.FirstSeen == 0 || other.FirstSeen < p.FirstSeen) {
+		p.FirstSeen = other.FirstSeen
+	}
+	if other.LastSeen > p.LastSeen {
+		p.LastSeen = other.LastSeen
+	}
+}
+
+//Derive computes the derived fields as of now
+func (p *Profile) Derive(now time.Time) {
+	if len(p.Days) > 0 {
+		//store days are keyed day first, drop those before the oldest kept day
+		for sd := range p.StoreDays {
+			if sd < p.Days[0] {
+				delete(p.StoreDays, sd)
+			}
+		}
+	}
+	p.Visits = len(p.StoreDays)
+
+	cats := make([]trapyz.CatID, 0, len(p.Cats))
+	for c := range p.Cats {
+		cats = append(cats, c)
+	}
+	sort.Slice(cats, func(i, j int) bool {
+		if p.Cats[cats[i]] != p.Cats[cats[j]] {
+			return p.Cats[cats[i]] > p.Cats[cats[j]]
+		}
+		return cats[i] < cats[j]
+	})
+	if len(cats) > TopN {
+		cats = cats[:TopN]
+	}
+	p.TopCats = cats
+
+	//the city with the most pings, ties go to the lower id
+	p.HomeCity = trapyz.UnknownID
+	var best int64
+	for c, n := range p.Cities {
+		if n > best || (n == best && c < p.HomeCity) {
+			p.HomeCity, best = c, n
+		}
+	}
+
+	//visits per week over the kept active days, at least a week
+	p.Frequency = 0
+	if len(p.Days) > 0 {
+		first, _ := time.Parse(DayFormat, p.Days[0])
+		last, _ := time.Parse(DayFormat, p.Days[len(p.Days)-1])
+		weeks := (last.Sub(first).Hours()/24 + 1) / 7
+		if weeks < 1 {
+			weeks = 1
+		}
+		p.Frequency = float64(p.Visits) / weeks
+	}
+	p.Recency = 0
+	if p.LastSeen > 0 {
+		last := time.Unix(0, p.LastSeen*int64(time.Millisecond))
+		if d := now.Sub(last); d > 0 {
+			p.Recency = int(d.Hours() / 24)
+		}
+	}
+}
+
+//Builder accumulates profiles of all devices in a run. It is not safe
+//for concurrent use
+type Builder struct {
+	profiles map[string]*Profile
+}
+
+//NewBuilder constructs an empty builder
+func NewBuilder() *Builder {
+	return &Builder{profiles: make(map[string]*Profile)}
+}
+
+//Add counts a matched ping against its device
+func (b *Builder) Add(rec trapyz.GeoLocOutput) {
+	if rec.Gid == "" {
+		return
+	}
+	p, ok := b.profiles[rec.Gid]
+	if !ok {
+		p = New(rec.Gid)
+		b.profiles[rec.Gid] = p
+	}
+	p.Add(rec)
+}
+
+//AddFrom reads GeoLocOutput json lines, at most limit lines if limit
+//is positive. Lines that don't parse are counted and skipped
+func (b *Builder) AddFrom(r io.Reader, limit int) (lines, bad int, err error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		if limit > 0 && lines >= limit {
+			break
+		}
+		lines++
+		var rec trapyz.GeoLocOutput
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			bad++
+			continue
+		}
+		b.Add(rec)
+	}
+	return lines, bad, scanner.Err()
+}
+
+//Len returns the number of devices
+func (b *Builder) Len() int {
+	return len(b.profiles)
+}
+
+//Get returns the profile of a device, nil if it was not seen
+func (b *Builder) Get(gid string) *Profile {
+	return b.profiles[gid]
+}
+
+//Profiles returns the profiles ordered by gid
+func (b *Builder) Profiles() []*Profile {
+	ret := make([]*Profile, 0, len(b.profiles))
+	for _, p := range b.profiles {
+		ret = append(ret, p)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Gid < ret[j].Gid })
+	return ret
+}
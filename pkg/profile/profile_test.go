@@ -0,0 +1,99 @@
+package profile
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/bamarb/aws-pipeline-go/pkg/trapyz"
+	"github.com/stretchr/testify/assert"
+)
+
+//fixtureEnd a day and a bit after the last ping in testdata/geocalc.out
+var fixtureEnd = time.Date(2018, 9, 21, 0, 0, 0, 0, time.UTC)
+
+func loadFixture(t *testing.T, limit int) *Builder {
+	fh, err := os.Open("testdata/geocalc.out")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fh.Close()
+	b := NewBuilder()
+	if _, _, err := b.AddFrom(fh, limit); err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestBuilder(t *testing.T) {
+	assert := assert.New(t)
+	fh, err := os.Open("testdata/geocalc.out")
+	assert.Nil(err)
+	defer fh.Close()
+	b := NewBuilder()
+	lines, bad, err := b.AddFrom(fh, 0)
+	assert.Nil(err)
+	assert.Equal(19, lines)
+	assert.Equal(1, bad)
+	assert.Equal(2, b.Len())
+
+	g1 := b.Get("g1")
+	g1.Derive(fixtureEnd)
+	assert.Equal(int64(16), g1.Pings)
+	assert.Equal([]trapyz.CatID{5, 3, 7}, g1.TopCats)
+	assert.Equal(trapyz.CityID(2), g1.HomeCity)
+	//s1 on 6 days, s2 and s3 and s4 once each
+	assert.Equal(9, g1.Visits)
+	assert.Len(g1.Days, 7)
+	//9 visits over a 14 day span
+	assert.InDelta(4.5, g1.Frequency, 0.01)
+	assert.Equal(1, g1.Recency)
+
+	g2 := b.Get("g2")
+	g2.Derive(fixtureEnd)
+	assert.Equal([]trapyz.CatID{9}, g2.TopCats)
+	assert.Equal(trapyz.CityID(4), g2.HomeCity)
+	assert.Equal(2, g2.Visits)
+	assert.Equal(2.0, g2.Frequency)
+	assert.Equal(14, g2.Recency)
+
+	assert.Equal(1, loadFixture(t, 3).Len())
+}
+
+func TestMerge(t *testing.T) {
+	assert := assert.New(t)
+	whole := loadFixture(t, 0).Get("g1")
+	whole.Derive(fixtureEnd)
+
+	//the same pings split across two runs, with the first run stored as json
+	first, second := New("g1"), New("g1")
+	fh, err := os.Open("testdata/geocalc.out")
+	assert.Nil(err)
+	defer fh.Close()
+	var recs []trapyz.GeoLocOutput
+	scanner := bufio.NewScanner(fh)
+	for scanner.Scan() {
+		var rec trapyz.GeoLocOutput
+		if json.Unmarshal(scanner.Bytes(), &rec) == nil && rec.Gid == "g1" {
+			recs = append(recs, rec)
+		}
+	}
+	for i, rec := range recs {
+		if i < len(recs)/2 {
+			first.Add(rec)
+		} else {
+			second.Add(rec)
+		}
+	}
+	first.Derive(fixtureEnd)
+	data, err := json.Marshal(first)
+	assert.Nil(err)
+	stored := New("g1")
+	assert.Nil(json.Unmarshal(data, stored))
+
+	second.Merge(stored)
+	second.Derive(fixtureEnd)
+	assert.Equal(whole, second)
+}
@@ -0,0 +1,112 @@
+package profile
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+
+	radix "github.com/mediocregopher/radix.v3"
+)
+
+//DefaultKeyPrefix prefix of the profile keys in redis
+const DefaultKeyPrefix = "profile:"
+
+//storeBatchSize profiles read and written per redis round trip
+const storeBatchSize = 500
+
+//RedisStore keeps profiles as json strings in redis, one key per device
+type RedisStore struct {
+	Client radix.Client
+	Prefix string
+	TTL    time.Duration
+}
+
+//NewRedisStore constructs a store with the default key prefix
+func NewRedisStore(client radix.Client, ttl time.Duration) *RedisStore {
+	return &RedisStore{Client: client, Prefix: DefaultKeyPrefix, TTL: ttl}
+}
+
+func (rs *RedisStore) key(gid string) string {
+	return rs.Prefix + gid
+}
+
+//Get returns the stored profiles of the given devices, devices without
+//a profile are absent from the map
+func (rs *RedisStore) Get(gids ...string) (map[string]*Profile, error) {
+	ret := make(map[string]*Profile, len(gids))
+	if len(gids) == 0 {
+		return ret, nil
+	}
+	keys := make([]string, len(gids))
+	for i, gid := range gids {
+		keys[i] = rs.key(gid)
+	}
+	var vals []string
+	if err := rs.Client.Do(radix.Cmd(&vals, "MGET", keys...)); err != nil {
+		return nil, err
+	}
+	for i, v := range vals {
+		if v == "" || i >= len(gids) {
+			continue
+		}
+		p := New(gids[i])
+		if err := json.Unmarshal([]byte(v), p); err != nil {
+			return nil, err
+		}
+		ret[gids[i]] = p
+	}
+	return ret, nil
+}
+
+//Put writes profiles replacing the stored ones
+func (rs *RedisStore) Put(profiles ...*Profile) error {
+	if len(profiles) == 0 {
+		return nil
+	}
+	cmds := make([]radix.CmdAction, 0, len(profiles))
+	for _, p := range profiles {
+		data, err := json.Marshal(p)
+		if err != nil {
+			return err
+		}
+		args := []string{rs.key(p.Gid), string(data)}
+		if rs.TTL > 0 {
+			args = append(args, "EX", strconv.Itoa(int(rs.TTL/time.Second)))
+		}
+		cmds = append(cmds, radix.Cmd(nil, "SET", args...))
+	}
+	return rs.Client.Do(radix.Pipeline(cmds...))
+}
+
+//Save merges the profiles of a run into the stored ones, derives them
+//as of now and writes them back. It returns the number of profiles saved
+func (rs *RedisStore) Save(b *Builder, now time.Time) (int, error) {
+	profiles := b.Profiles()
+	saved := 0
+	for start := 0; start < len(profiles); start += storeBatchSize {
+		end := start + storeBatchSize
+		if end > len(profiles) {
+			end = len(profiles)
+		}
+		batch := profiles[start:end]
+		gids := make([]string, len(batch))
+		for i, p := range batch {
+			gids[i] = p.Gid
+		}
+		stored, err := rs.Get(gids...)
+		if err != nil {
+			return saved, err
+		}
+		for _, p := range batch {
+			if prev, ok := stored[p.Gid]; ok {
+				p.Merge(prev)
+			}
+			p.Derive(now)
+		}
+		if err := rs.Put(batch...); err != nil {
+			return saved, err
+		}
+		saved += len(batch)
+	}
+	return saved, nil
+}
@@ -0,0 +1,182 @@
+package sink
+
+import (
+	"context"
+	"fmt"
+	"path"
+
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/bamarb/aws-pipeline-go/pkg/elastic"
+	"github.com/bamarb/aws-pipeline-go/pkg/file"
+	"github.com/bamarb/aws-pipeline-go/pkg/pqfile"
+	"github.com/bamarb/aws-pipeline-go/pkg/trapyz"
+	radix "github.com/mediocregopher/radix.v3"
+)
+
+//Sink names used in the [output] sinks list
+const (
+	NameFile    = "file"
+	NameGzip    = "gzip"
+	NameStdout  = "stdout"
+	NameDiscard = "discard"
+	NameElastic = "elastic"
+	NamePart    = "partitioned"
+	NameParquet = "parquet"
+)
+
+//DefaultSinks used when the sinks list is empty
+var DefaultSinks = []string{NameFile}
+
+//Enabled returns true if the named sink is configured
+func Enabled(cfg *trapyz.Config, name string) bool {
+	names := cfg.Output.Sinks
+	if len(names) == 0 {
+		names = DefaultSinks
+	}
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+//PartitionDir returns the directory of the partitioned sink
+func PartitionDir(cfg *trapyz.Config) string {
+	if cfg.Output.Partition.Directory != "" {
+		return cfg.Output.Partition.Directory
+	}
+	return path.Join(cfg.Output.Directory, "geocalc")
+}
+
+//FromConfig builds the sinks listed in the output section, followed by
+//the visits, footfall and uniques sinks when those are configured. With
+//the parquet sink listed visits and footfall are also written as Parquet.
+//The redis client, connected to the uniques db, is used by the redis
+//uniques backend. Every sink is
+//wrapped in a CountedSink for the run report
+func FromConfig(cfg *trapyz.Config, client radix.Client) (FanOut, error) {
+	names := cfg.Output.Sinks
+	if len(names) == 0 {
+		names = DefaultSinks
+	}
+	var sinks FanOut
+	fail := func(err error) (FanOut, error) {
+		sinks.Close()
+		return nil, err
+	}
+	add := func(name string, s Sink) {
+		sinks = append(sinks, Counted(name, s))
+	}
+	outFile := path.Join(cfg.Output.Directory, cfg.Output.File)
+	for _, name := range names {
+		switch name {
+		case NameFile:
+			ls, err := NewNDJSONFile(outFile)
+			if err != nil {
+				return fail(err)
+			}
+			add(name, ls)
+		case NameGzip:
+			ls, err := NewGzipFile(outFile + ".gz")
+			if err != nil {
+				return fail(err)
+			}
+			add(name, ls)
+		case NamePart:
+			ps, err := NewPartitionedSink(PartitionDir(cfg), cfg.Output.Partition)
+			if err != nil {
+				return fail(err)
+			}
+			add(name, ps)
+		case NameParquet:
+			ps, err := NewParquetSink(ParquetName(outFile))
+			if err != nil {
+				return fail(err)
+			}
+			add(name, ps)
+		case NameStdout:
+			add(name, NewStdout())
+		case NameDiscard:
+			add(name, Discard{})
+		case NameElastic:
+			esCfg, err := elastic.ConfigFrom(cfg.Elastic)
+			if err != nil {
+				return fail(err)
+			}
+			es, err := elastic.NewBulkSink(esCfg, nil)
+			if err != nil {
+				return fail(err)
+			}
+			add(name, NewElasticSink(es))
+		default:
+			return fail(fmt.Errorf("Unknown output sink [%s]", name))
+		}
+	}
+
+	//aggregates are written as Parquet too when the records are
+	withParquet := Enabled(cfg, NameParquet)
+	visits, err := trapyz.VisitBuilderFromConfig(cfg)
+	if err != nil {
+		return fail(err)
+	}
+	if visits != nil {
+		vname := cfg.Output.VisitsFile
+		if vname == "" {
+			vname = "visits.out"
+		}
+		vfile := path.Join(cfg.Output.Directory, vname)
+		ls, err := NewNDJSONFile(vfile)
+		if err != nil {
+			return fail(err)
+		}
+		vs := NewVisitSink(visits, ls)
+		if cfg.Visits.OpenFile != "" {
+			if _, err := vs.WithOpenFile(cfg.Visits.OpenFile); err != nil {
+				ls.Close()
+				return fail(err)
+			}
+		}
+		if withParquet {
+			pw, err := pqfile.Create(ParquetName(vfile), new(pqfile.VisitRow))
+			if err != nil {
+				ls.Close()
+				return fail(err)
+			}
+			vs.WithParquet(pw)
+		}
+		add(NameVisits, vs)
+	}
+	if cfg.Output.FootfallFile != "" {
+		ffile := path.Join(cfg.Output.Directory, cfg.Output.FootfallFile)
+		fs := NewFootfallSink(ffile).WithRetention(cfg.Output.FootfallRetentionDays)
+		if withParquet {
+			fs.WithParquet()
+		}
+		add(NameFootfall, fs)
+	}
+	us, err := trapyz.UniqueStoreFromConfig(cfg, client)
+	if err != nil {
+		return fail(err)
+	}
+	if us != nil {
+		add(NameUniques, NewUniqueSink(cfg, us))
+	}
+	return sinks, nil
+}
+
+//Upload copies the finished partitions of the fan out to the configured
+//upload destination. Nothing is uploaded without a destination or a
+//partitioned sink, conn is only used for s3 destinations
+func Upload(ctx context.Context, cfg *trapyz.Config, fo FanOut, conn s3iface.S3API) (int, error) {
+	ucfg := cfg.Output.Upload
+	ps := fo.Partitioned()
+	if ucfg.Destination == "" || ps == nil {
+		return 0, nil
+	}
+	target, err := file.NewTarget(conn, ucfg.Destination, ucfg.PartSize)
+	if err != nil {
+		return 0, err
+	}
+	return ps.Upload(ctx, target)
+}
@@ -0,0 +1,58 @@
+package sink
+
+import (
+	"sync/atomic"
+
+	"github.com/bamarb/aws-pipeline-go/pkg/trapyz"
+)
+
+//Names of the aggregate sinks in the run report
+const (
+	NameVisits   = "visits"
+	NameFootfall = "footfall"
+	NameUniques  = "uniques"
+	NameProfiles = "profiles"
+)
+
+//CountedSink counts the records written to and failed by a named sink
+type CountedSink struct {
+	Sink
+	name    string
+	written uint64
+	failed  uint64
+}
+
+//Counted wraps the sink with write counters
+func Counted(name string, s Sink) *CountedSink {
+	return &CountedSink{Sink: s, name: name}
+}
+
+//Write writes the record to the wrapped sink and counts the result
+func (cs *CountedSink) Write(rec trapyz.GeoLocOutput) error {
+	err := cs.Sink.Write(rec)
+	if err != nil {
+		atomic.AddUint64(&cs.failed, 1)
+	} else {
+		atomic.AddUint64(&cs.written, 1)
+	}
+	return err
+}
+
+//Name returns the sink name
+func (cs *CountedSink) Name() string { return cs.name }
+
+//Counts returns the records written and failed so far
+func (cs *CountedSink) Counts() (written, failed uint64) {
+	return atomic.LoadUint64(&cs.written), atomic.LoadUint64(&cs.failed)
+}
+
+//Report adds the counts of the counted sinks of the fan out to the run
+//report
+func (fo FanOut) Report(r *trapyz.RunReport) {
+	for _, s := range fo {
+		if cs, ok := s.(*CountedSink); ok {
+			written, failed := cs.Counts()
+			r.SetOutput(cs.name, written, failed)
+		}
+	}
+}
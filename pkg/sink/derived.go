@@ -0,0 +1,228 @@
+package sink
+
+import (
+	"os"
+	"time"
+
+	"github.com/bamarb/aws-pipeline-go/pkg/elastic"
+	"github.com/bamarb/aws-pipeline-go/pkg/pqfile"
+	"github.com/bamarb/aws-pipeline-go/pkg/trapyz"
+	log "github.com/sirupsen/logrus"
+)
+
+//VisitSink groups records into visits and writes them as json lines on
+//Close, and to a Parquet file when one is set. With an open file the
+//visits still open at the end of the run are carried over to the next
+type VisitSink struct {
+	visits   *trapyz.VisitBuilder
+	out      *LineSink
+	pq       *pqfile.Writer
+	openFile string
+}
+
+//NewVisitSink writes the visits built by vb to out
+func NewVisitSink(vb *trapyz.VisitBuilder, out *LineSink) *VisitSink {
+	return &VisitSink{visits: vb, out: out}
+}
+
+//WithParquet also writes the visits to w
+func (vs *VisitSink) WithParquet(w *pqfile.Writer) *VisitSink {
+	vs.pq = w
+	return vs
+}
+
+//WithOpenFile resumes the visits left open by the last run from file,
+//the visits open at Close are saved to it
+func (vs *VisitSink) WithOpenFile(file string) (*VisitSink, error) {
+	open, err := trapyz.LoadOpenVisits(file)
+	if err != nil {
+		return nil, err
+	}
+	vs.visits.Resume(open)
+	vs.openFile = file
+	return vs, nil
+}
+
+//Write adds the record to the visits
+func (vs *VisitSink) Write(rec trapyz.GeoLocOutput) error {
+	vs.visits.Add(rec)
+	return nil
+}
+
+func (vs *VisitSink) writeVisits(visits []trapyz.Visit) error {
+	for _, v := range visits {
+		if err := vs.out.WriteJSON(v); err != nil {
+			return err
+		}
+		if vs.pq != nil {
+			if err := vs.pq.Write(pqfile.VisitRowFrom(v)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+//Flush flushes the written visits, visits are built on Close
+func (vs *VisitSink) Flush() error {
+	return vs.out.Flush()
+}
+
+//Close writes the visits and closes the file. With an open file the
+//visits that may continue are saved for the next run instead
+func (vs *VisitSink) Close() error {
+	var err error
+	if vs.openFile != "" {
+		done, open := vs.visits.FlushOpen()
+		err = vs.writeVisits(done)
+		if serr := trapyz.SaveOpenVisits(vs.openFile, open); err == nil {
+			err = serr
+		}
+	} else {
+		err = vs.writeVisits(vs.visits.Flush())
+	}
+	if cerr := vs.out.Close(); err == nil {
+		err = cerr
+	}
+	if vs.pq != nil {
+		if perr := vs.pq.Close(); err == nil {
+			err = perr
+		}
+	}
+	return err
+}
+
+//FootfallSink aggregates hourly footfall and merges it into one file per
+//day on Close, keyed by the run window so a re-run of a window replaces
+//its aggregates. The merged days are also written to Parquet files when
+//set. Day files older than the retention are removed
+type FootfallSink struct {
+	footfall  *trapyz.Footfall
+	file      string
+	parquet   bool
+	window    string
+	retention int
+}
+
+//NewFootfallSink merges into day files named after file
+func NewFootfallSink(file string) *FootfallSink {
+	return &FootfallSink{footfall: trapyz.NewFootfall(), file: file,
+		window: "run-" + time.Now().UTC().Format(trapyz.FootfallHourFormat+"0405")}
+}
+
+//WithParquet also writes the merged days to Parquet files
+func (fs *FootfallSink) WithParquet() *FootfallSink {
+	fs.parquet = true
+	return fs
+}
+
+//WithRetention removes the day files more than days old, 0 keeps all
+func (fs *FootfallSink) WithRetention(days int) *FootfallSink {
+	fs.retention = days
+	return fs
+}
+
+//SetWindow sets the run window the aggregates are merged under, without
+//one every run adds to the day files
+func (fs *FootfallSink) SetWindow(from, to time.Time) {
+	fs.window = trapyz.FootfallWindow(from, to)
+}
+
+//Write counts the record
+func (fs *FootfallSink) Write(rec trapyz.GeoLocOutput) error {
+	fs.footfall.Add(rec)
+	return nil
+}
+
+//Flush does nothing, aggregates are written once per run
+func (fs *FootfallSink) Flush() error {
+	return nil
+}
+
+//Close merges the aggregates into the day files and removes the expired
+//ones
+func (fs *FootfallSink) Close() error {
+	log.Infof("Merging %d store hours of window %s into footfall files %s", fs.footfall.Len(),
+		fs.window, fs.file)
+	files, err := trapyz.MergeFootfallFiles(fs.file, fs.window, fs.footfall)
+	if err != nil {
+		return err
+	}
+	if fs.parquet {
+		for _, f := range files {
+			merged, err := trapyz.ReadFootfallFile(f)
+			if err != nil {
+				return err
+			}
+			if err := pqfile.WriteFootfall(ParquetName(f), merged); err != nil {
+				return err
+			}
+		}
+	}
+	removed, err := trapyz.ExpireFootfallFiles(fs.file, fs.retention, time.Now())
+	for _, f := range removed {
+		if perr := os.Remove(ParquetName(f)); perr != nil && !os.IsNotExist(perr) && err == nil {
+			err = perr
+		}
+	}
+	if len(removed) > 0 {
+		log.Infof("Removed %d expired footfall day files", len(removed))
+	}
+	return err
+}
+
+//UniqueSink counts unique devices and saves the store on Close
+type UniqueSink struct {
+	uniques *trapyz.UniqueCounter
+	cfg     *trapyz.Config
+}
+
+//NewUniqueSink counts into us
+func NewUniqueSink(cfg *trapyz.Config, us trapyz.UniqueStore) *UniqueSink {
+	return &UniqueSink{trapyz.NewUniqueCounter(us), cfg}
+}
+
+//Write counts the record's device
+func (us *UniqueSink) Write(rec trapyz.GeoLocOutput) error {
+	return us.uniques.Add(rec)
+}
+
+//Flush writes buffered devices to the store
+func (us *UniqueSink) Flush() error {
+	return us.uniques.Flush()
+}
+
+//Close flushes and saves the store
+func (us *UniqueSink) Close() error {
+	if err := us.uniques.Flush(); err != nil {
+		return err
+	}
+	return trapyz.SaveUniqueStore(us.cfg, us.uniques.Store)
+}
+
+//ElasticSink indexes records with an elasticsearch bulk sink
+type ElasticSink struct {
+	es *elastic.BulkSink
+}
+
+//NewElasticSink wraps es
+func NewElasticSink(es *elastic.BulkSink) *ElasticSink {
+	return &ElasticSink{es}
+}
+
+//Write queues the record
+func (es *ElasticSink) Write(rec trapyz.GeoLocOutput) error {
+	return es.es.WriteRecord(rec)
+}
+
+//Flush sends the queued records
+func (es *ElasticSink) Flush() error {
+	return es.es.Flush()
+}
+
+//Close sends the queued records and stops the bulk sink
+func (es *ElasticSink) Close() error {
+	err := es.es.Close()
+	log.Infof("Elastic sink: %+v", es.es.Stats())
+	return err
+}
@@ -0,0 +1,112 @@
+package sink
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/bamarb/aws-pipeline-go/pkg/trapyz"
+)
+
+//LineSink writes json lines to a file, optionally gzip compressed,
+//or to stdout
+type LineSink struct {
+	name string
+	file *os.File
+	gz   *gzip.Writer
+	buf  *bufio.Writer
+}
+
+//NewNDJSONFile creates or truncates a json lines file
+func NewNDJSONFile(name string) (*LineSink, error) {
+	return newLineFile(name, false)
+}
+
+//NewGzipFile creates or truncates a gzip compressed json lines file
+func NewGzipFile(name string) (*LineSink, error) {
+	return newLineFile(name, true)
+}
+
+func newLineFile(name string, compress bool) (*LineSink, error) {
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return nil, err
+	}
+	fh, err := os.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	ls := &LineSink{name: name, file: fh}
+	var out io.Writer = fh
+	if compress {
+		ls.gz = gzip.NewWriter(fh)
+		out = ls.gz
+	}
+	ls.buf = bufio.NewWriterSize(out, 64*1024)
+	return ls, nil
+}
+
+//NewStdout writes json lines to stdout, closing it leaves stdout open
+func NewStdout() *LineSink {
+	return &LineSink{name: "stdout", buf: bufio.NewWriter(os.Stdout)}
+}
+
+//Name returns the file name
+func (ls *LineSink) Name() string {
+	return ls.name
+}
+
+//Write writes the record as a json line
+func (ls *LineSink) Write(rec trapyz.GeoLocOutput) error {
+	return ls.WriteJSON(rec)
+}
+
+//WriteJSON writes any value as a json line
+func (ls *LineSink) WriteJSON(v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if _, err := ls.buf.Write(data); err != nil {
+		return err
+	}
+	return ls.buf.WriteByte('\n')
+}
+
+//Flush writes out buffered lines and syncs the file
+func (ls *LineSink) Flush() error {
+	if err := ls.buf.Flush(); err != nil {
+		return err
+	}
+	if ls.gz != nil {
+		if err := ls.gz.Flush(); err != nil {
+			return err
+		}
+	}
+	if ls.file != nil {
+		return ls.file.Sync()
+	}
+	return nil
+}
+
+//Close flushes and closes the file
+func (ls *LineSink) Close() error {
+	err := ls.buf.Flush()
+	if ls.gz != nil {
+		if gerr := ls.gz.Close(); err == nil {
+			err = gerr
+		}
+	}
+	if ls.file == nil {
+		return err
+	}
+	if serr := ls.file.Sync(); err == nil {
+		err = serr
+	}
+	if cerr := ls.file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
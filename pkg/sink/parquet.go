@@ -0,0 +1,50 @@
+package sink
+
+import (
+	"path"
+	"strings"
+
+	"github.com/bamarb/aws-pipeline-go/pkg/pqfile"
+	"github.com/bamarb/aws-pipeline-go/pkg/trapyz"
+)
+
+//ParquetSink writes records to a Parquet file. Rows are buffered into
+//row groups, the file only becomes readable once it is closed
+type ParquetSink struct {
+	w *pqfile.Writer
+}
+
+//NewParquetSink creates or replaces the file name
+func NewParquetSink(name string) (*ParquetSink, error) {
+	w, err := pqfile.Create(name, new(pqfile.GeoLocRow))
+	if err != nil {
+		return nil, err
+	}
+	return &ParquetSink{w}, nil
+}
+
+//Write converts and writes the record, records whose coordinates or
+//createdat do not parse are rejected
+func (ps *ParquetSink) Write(rec trapyz.GeoLocOutput) error {
+	row, err := pqfile.GeoLocRowFrom(rec)
+	if err != nil {
+		return err
+	}
+	return ps.w.Write(row)
+}
+
+//Flush does nothing, a Parquet file can't be made readable before Close
+func (ps *ParquetSink) Flush() error {
+	return nil
+}
+
+//Close writes the footer and moves the file into place
+func (ps *ParquetSink) Close() error {
+	return ps.w.Close()
+}
+
+//ParquetName replaces the extension of a json lines file name with
+//.parquet, eg: geocalc.out becomes geocalc.parquet
+func ParquetName(name string) string {
+	return strings.TrimSuffix(name, path.Ext(name)) + ".parquet"
+}
@@ -0,0 +1,462 @@
+package sink
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/bamarb/aws-pipeline-go/pkg/file"
+	"github.com/bamarb/aws-pipeline-go/pkg/trapyz"
+)
+
+//Partition keys beyond date and hour
+const (
+	PartitionCity   = "city"
+	PartitionApikey = "apikey"
+)
+
+//SuccessMarker written to a partition once all its files are complete
+const SuccessMarker = "_SUCCESS"
+
+//Upload bookkeeping, the files of a partition already uploaded and the
+//partitions whose upload failed
+const (
+	UploadManifest = "_UPLOADED"
+	UploadPending  = "_upload_pending"
+)
+
+//Defaults used when the partition config leaves a value unset
+const (
+	DefaultPartMaxBytes = 128 * 1024 * 1024
+	DefaultMaxOpenParts = 64
+)
+
+//partFile a part being written under a hidden temporary name, it is
+//renamed to its final name on close
+type partFile struct {
+	tmp, final string
+	file       *os.File
+	count      *countingWriter
+	gz         *gzip.Writer
+	buf        *bufio.Writer
+	lastWrite  uint64
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+//size bytes written so far, compressed bytes are only counted once
+//the gzip writer emits them
+func (pf *partFile) size() int64 {
+	return pf.count.n + int64(pf.buf.Buffered())
+}
+
+func (pf *partFile) flush() error {
+	if err := pf.buf.Flush(); err != nil {
+		return err
+	}
+	if pf.gz != nil {
+		if err := pf.gz.Flush(); err != nil {
+			return err
+		}
+	}
+	return pf.file.Sync()
+}
+
+func (pf *partFile) close() error {
+	err := pf.buf.Flush()
+	if pf.gz != nil {
+		if gerr := pf.gz.Close(); err == nil {
+			err = gerr
+		}
+	}
+	if serr := pf.file.Sync(); err == nil {
+		err = serr
+	}
+	if cerr := pf.file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(pf.tmp)
+		return err
+	}
+	return os.Rename(pf.tmp, pf.final)
+}
+
+//PartitionedSink writes json lines into dt=/hr= partitions of the record
+//creation time, optionally further split by city or apikey. Parts rotate
+//at MaxBytes and are renamed into place when complete, every partition
+//written gets a _SUCCESS marker on Close
+type PartitionedSink struct {
+	dir      string
+	by       []string
+	maxBytes int64
+	maxOpen  int
+	compress bool
+	open     map[string]*partFile
+	next     map[string]int
+	touched  map[string]bool
+	writes   uint64
+}
+
+//NewPartitionedSink writes partitions under dir
+func NewPartitionedSink(dir string, pcfg trapyz.PartitionInfo) (*PartitionedSink, error) {
+	for _, b := range pcfg.By {
+		if b != PartitionCity && b != PartitionApikey {
+			return nil, fmt.Errorf("Unknown partition key [%s]", b)
+		}
+	}
+	ps := &PartitionedSink{dir: dir, by: pcfg.By, maxBytes: pcfg.MaxBytes, maxOpen: pcfg.MaxOpen,
+		compress: pcfg.Compress, open: make(map[string]*partFile),
+		next: make(map[string]int), touched: make(map[string]bool)}
+	if ps.maxBytes <= 0 {
+		ps.maxBytes = DefaultPartMaxBytes
+	}
+	if ps.maxOpen <= 0 {
+		ps.maxOpen = DefaultMaxOpenParts
+	}
+	return ps, os.MkdirAll(dir, 0755)
+}
+
+//PartitionPath returns the partition of a record relative to the sink
+//directory, eg: dt=2018-09-06/hr=01/city=3
+func (ps *PartitionedSink) PartitionPath(rec trapyz.GeoLocOutput) (string, error) {
+	at, err := trapyz.CreatedAtTime(rec.Createdat)
+	if err != nil {
+		return "", err
+	}
+	at = at.UTC()
+	parts := []string{"dt=" + at.Format("2006-01-02"), "hr=" + at.Format("15")}
+	for _, b := range ps.by {
+		switch b {
+		case PartitionCity:
+			parts = append(parts, "city="+rec.City.String())
+		case PartitionApikey:
+			parts = append(parts, "apikey="+rec.Apikey.String())
+		}
+	}
+	return filepath.Join(parts...), nil
+}
+
+//Write appends the record to its partition
+func (ps *PartitionedSink) Write(rec trapyz.GeoLocOutput) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	return ps.WriteLine(rec, data)
+}
+
+//WriteLine appends an encoded line to the partition of rec
+func (ps *PartitionedSink) WriteLine(rec trapyz.GeoLocOutput, data []byte) error {
+	part, err := ps.PartitionPath(rec)
+	if err != nil {
+		return err
+	}
+	pf, err := ps.part(part)
+	if err != nil {
+		return err
+	}
+	ps.writes++
+	pf.lastWrite = ps.writes
+	if _, err := pf.buf.Write(data); err != nil {
+		return err
+	}
+	if err := pf.buf.WriteByte('\n'); err != nil {
+		return err
+	}
+	if pf.size() >= ps.maxBytes {
+		delete(ps.open, part)
+		return pf.close()
+	}
+	return nil
+}
+
+//part returns the open part of a partition, opening the next one if needed
+func (ps *PartitionedSink) part(part string) (*partFile, error) {
+	if pf, ok := ps.open[part]; ok {
+		return pf, nil
+	}
+	if len(ps.open) >= ps.maxOpen {
+		if err := ps.closeOldest(); err != nil {
+			return nil, err
+		}
+	}
+	dir := filepath.Join(ps.dir, part)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	idx, ok := ps.next[part]
+	if !ok {
+		//continue after parts of earlier runs instead of overwriting them
+		idx = nextPartIndex(dir)
+	}
+	ps.next[part] = idx + 1
+	name := fmt.Sprintf("part-%04d.ndjson", idx)
+	if ps.compress {
+		name += ".gz"
+	}
+	pf := &partFile{tmp: filepath.Join(dir, "."+name+".tmp"), final: filepath.Join(dir, name)}
+	fh, err := os.Create(pf.tmp)
+	if err != nil {
+		return nil, err
+	}
+	pf.file = fh
+	pf.count = &countingWriter{w: fh}
+	var out io.Writer = pf.count
+	if ps.compress {
+		pf.gz = gzip.NewWriter(pf.count)
+		out = pf.gz
+	}
+	pf.buf = bufio.NewWriterSize(out, 64*1024)
+	ps.open[part] = pf
+	ps.touched[part] = true
+	return pf, nil
+}
+
+func (ps *PartitionedSink) closeOldest() error {
+	var oldest string
+	for part, pf := range ps.open {
+		if oldest == "" || pf.lastWrite < ps.open[oldest].lastWrite {
+			oldest = part
+		}
+	}
+	pf := ps.open[oldest]
+	delete(ps.open, oldest)
+	return pf.close()
+}
+
+//nextPartIndex returns one more than the highest part number in dir
+func nextPartIndex(dir string) int {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return 0
+	}
+	next := 0
+	for _, fi := range infos {
+		var idx int
+		if _, err := fmt.Sscanf(fi.Name(), "part-%04d", &idx); err == nil && idx >= next {
+			next = idx + 1
+		}
+	}
+	return next
+}
+
+//Flush flushes the open parts, they stay under their temporary names
+//until closed
+func (ps *PartitionedSink) Flush() error {
+	var firstErr error
+	for _, pf := range ps.open {
+		if err := pf.flush(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+//Close completes all parts and marks the partitions written as done.
+//A partition whose parts failed to close gets no marker
+func (ps *PartitionedSink) Close() error {
+	var firstErr error
+	failed := make(map[string]bool)
+	for part, pf := range ps.open {
+		if err := pf.close(); err != nil {
+			failed[part] = true
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+		delete(ps.open, part)
+	}
+	for part := range ps.touched {
+		if failed[part] {
+			continue
+		}
+		marker := filepath.Join(ps.dir, part, SuccessMarker)
+		if err := ioutil.WriteFile(marker, nil, 0644); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+//Partitions returns the partitions written, relative to the sink directory
+func (ps *PartitionedSink) Partitions() []string {
+	parts := make([]string, 0, len(ps.touched))
+	for part := range ps.touched {
+		parts = append(parts, part)
+	}
+	sort.Strings(parts)
+	return parts
+}
+
+//Dir returns the sink directory
+func (ps *PartitionedSink) Dir() string {
+	return ps.dir
+}
+
+//Upload copies the finished partitions to the target, keeping their
+//relative paths. Each partition's _SUCCESS marker is uploaded after its
+//parts so readers of the target never see a partial partition as done.
+//Partitions without a marker are skipped. Files uploaded are listed in
+//the partition's _UPLOADED manifest and not uploaded again, partitions
+//that failed are kept in _upload_pending and retried by the next upload
+//along with the partitions written. Returns the files uploaded and the
+//first error
+func (ps *PartitionedSink) Upload(ctx context.Context, target *file.Target) (int, error) {
+	pendingFile := filepath.Join(ps.dir, UploadPending)
+	pending, err := readNames(pendingFile)
+	if err != nil {
+		return 0, err
+	}
+	parts := ps.Partitions()
+	seen := make(map[string]bool, len(parts))
+	for _, part := range parts {
+		seen[part] = true
+	}
+	for _, part := range pending {
+		if !seen[part] {
+			seen[part] = true
+			parts = append(parts, part)
+		}
+	}
+	sort.Strings(parts)
+	uploaded := 0
+	var firstErr error
+	var failed []string
+	for i, part := range parts {
+		if err := ctx.Err(); err != nil {
+			failed = append(failed, parts[i:]...)
+			if firstErr == nil {
+				firstErr = err
+			}
+			break
+		}
+		n, err := ps.uploadPartition(ctx, target, part)
+		uploaded += n
+		if err != nil {
+			failed = append(failed, part)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	if err := writeNames(pendingFile, failed); err != nil && firstErr == nil {
+		firstErr = err
+	}
+	return uploaded, firstErr
+}
+
+//uploadPartition uploads the parts of a partition missing from its
+//manifest, then its marker if anything was uploaded or the marker wasn't
+func (ps *PartitionedSink) uploadPartition(ctx context.Context, target *file.Target, part string) (int, error) {
+	dir := filepath.Join(ps.dir, part)
+	if _, err := os.Stat(filepath.Join(dir, SuccessMarker)); err != nil {
+		return 0, nil
+	}
+	manifest := filepath.Join(dir, UploadManifest)
+	names, err := readNames(manifest)
+	if err != nil {
+		return 0, err
+	}
+	done := make(map[string]bool, len(names))
+	for _, name := range names {
+		done[name] = true
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return 0, err
+	}
+	uploaded := 0
+	upload := func(name string) error {
+		rel := filepath.ToSlash(filepath.Join(part, name))
+		if _, err := target.Upload(ctx, filepath.Join(dir, name), rel); err != nil {
+			return fmt.Errorf("Error uploading %s: %s", rel, err)
+		}
+		uploaded++
+		return appendName(manifest, name)
+	}
+	for _, e := range entries {
+		if e.IsDir() || !IsPartFile(e.Name()) || done[e.Name()] {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return uploaded, err
+		}
+		if err := upload(e.Name()); err != nil {
+			return uploaded, err
+		}
+	}
+	if uploaded == 0 && done[SuccessMarker] {
+		return 0, nil
+	}
+	return uploaded, upload(SuccessMarker)
+}
+
+//readNames returns the non empty lines of a file, a missing file has none
+func readNames(name string) ([]string, error) {
+	data, err := ioutil.ReadFile(name)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var lines []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines, nil
+}
+
+//writeNames replaces a file with the lines atomically, no lines removes it
+func writeNames(name string, lines []string) error {
+	if len(lines) == 0 {
+		if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	tmp := name + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, name)
+}
+
+func appendName(name, line string) error {
+	fh, err := os.OpenFile(name, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := fh.WriteString(line + "\n"); err != nil {
+		fh.Close()
+		return err
+	}
+	return fh.Close()
+}
+
+//IsPartFile returns true for complete part files, temporary files and
+//markers are excluded
+func IsPartFile(name string) bool {
+	return strings.HasPrefix(name, "part-") && !strings.HasSuffix(name, ".tmp")
+}
@@ -0,0 +1,180 @@
+package sink
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/bamarb/aws-pipeline-go/pkg/file"
+	"github.com/bamarb/aws-pipeline-go/pkg/trapyz"
+	"github.com/stretchr/testify/assert"
+)
+
+func partRec(gid string, city trapyz.CityID, at time.Time) trapyz.GeoLocOutput {
+	return trapyz.GeoLocOutput{UID: "s1", Gid: gid, City: city,
+		Createdat: strconv.FormatInt(at.UnixNano()/int64(time.Millisecond), 10)}
+}
+
+func listParts(t *testing.T, dir string) []string {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, fi := range infos {
+		names = append(names, fi.Name())
+	}
+	return names
+}
+
+func TestPartitionedSink(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "partitions")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	at := time.Date(2018, 9, 6, 1, 30, 0, 0, time.UTC)
+	line, _ := json.Marshal(partRec("g0", 3, at))
+	//rotate after every 3 records
+	ps, err := NewPartitionedSink(dir, trapyz.PartitionInfo{By: []string{"city"},
+		MaxBytes: int64(3 * (len(line) + 1))})
+	assert.Nil(err)
+	for i := 0; i < 10; i++ {
+		assert.Nil(ps.Write(partRec("g"+strconv.Itoa(i), 3, at)))
+	}
+	assert.Nil(ps.Write(partRec("g1", 4, at.Add(time.Hour))))
+	assert.Nil(ps.Flush())
+	//parts still being written are hidden
+	hr1 := filepath.Join(dir, "dt=2018-09-06", "hr=01", "city=3")
+	for _, name := range listParts(t, hr1) {
+		assert.False(name == SuccessMarker)
+	}
+	assert.Nil(ps.Close())
+	assert.Equal([]string{"dt=2018-09-06/hr=01/city=3", "dt=2018-09-06/hr=02/city=4"}, ps.Partitions())
+
+	assert.Equal([]string{SuccessMarker, "part-0000.ndjson", "part-0001.ndjson",
+		"part-0002.ndjson", "part-0003.ndjson"}, listParts(t, hr1))
+	var total int
+	for _, name := range listParts(t, hr1) {
+		if IsPartFile(name) {
+			fh, err := os.Open(filepath.Join(hr1, name))
+			assert.Nil(err)
+			total += len(readLines(t, fh))
+			fh.Close()
+		}
+	}
+	assert.Equal(10, total)
+
+	//a later run adds parts after the existing ones
+	ps, err = NewPartitionedSink(dir, trapyz.PartitionInfo{By: []string{"city"}, Compress: true})
+	assert.Nil(err)
+	assert.Nil(ps.Write(partRec("g1", 4, at.Add(time.Hour))))
+	assert.Nil(ps.Close())
+	hr2 := filepath.Join(dir, "dt=2018-09-06", "hr=02", "city=4")
+	assert.Equal([]string{SuccessMarker, "part-0000.ndjson", "part-0001.ndjson.gz"}, listParts(t, hr2))
+	fh, err := os.Open(filepath.Join(hr2, "part-0001.ndjson.gz"))
+	assert.Nil(err)
+	defer fh.Close()
+	zr, err := gzip.NewReader(fh)
+	assert.Nil(err)
+	assert.Len(readLines(t, zr), 1)
+
+	_, err = NewPartitionedSink(dir, trapyz.PartitionInfo{By: []string{"state"}})
+	assert.Error(err)
+}
+
+func TestPartitionedSinkMaxOpen(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "partitions")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+	at := time.Date(2018, 9, 6, 0, 0, 0, 0, time.UTC)
+	ps, err := NewPartitionedSink(dir, trapyz.PartitionInfo{MaxOpen: 2})
+	assert.Nil(err)
+	for h := 0; h < 4; h++ {
+		assert.Nil(ps.Write(partRec("g1", 3, at.Add(time.Duration(h)*time.Hour))))
+	}
+	assert.Len(ps.open, 2)
+	//hour 0 was closed to make room and gets a new part when written again
+	assert.Nil(ps.Write(partRec("g2", 3, at)))
+	assert.Nil(ps.Close())
+	assert.Equal([]string{SuccessMarker, "part-0000.ndjson", "part-0001.ndjson"},
+		listParts(t, filepath.Join(dir, "dt=2018-09-06", "hr=00")))
+}
+
+func TestPartitionedSinkUpload(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "partitions")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	ps, err := NewPartitionedSink(filepath.Join(dir, "out"), trapyz.PartitionInfo{})
+	assert.Nil(err)
+	at := time.Date(2018, 9, 6, 1, 30, 0, 0, time.UTC)
+	assert.Nil(ps.Write(partRec("g1", 1, at)))
+	assert.Nil(ps.Write(partRec("g2", 1, at.Add(time.Hour))))
+	assert.Nil(ps.Close())
+
+	target, err := file.NewTarget(nil, filepath.Join(dir, "archive"), 0)
+	assert.Nil(err)
+	n, err := ps.Upload(context.Background(), target)
+	assert.Nil(err)
+	assert.Equal(4, n)
+	for _, part := range ps.Partitions() {
+		assert.Equal([]string{"_SUCCESS", "part-0000.ndjson"}, listParts(t, filepath.Join(dir, "archive", part)))
+	}
+}
+
+func TestPartitionedSinkUploadRetry(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "partitions")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	ps, err := NewPartitionedSink(filepath.Join(dir, "out"), trapyz.PartitionInfo{})
+	assert.Nil(err)
+	at := time.Date(2018, 9, 6, 1, 30, 0, 0, time.UTC)
+	assert.Nil(ps.Write(partRec("g1", 1, at)))
+	assert.Nil(ps.Write(partRec("g2", 1, at.Add(time.Hour))))
+	assert.Nil(ps.Close())
+
+	//a file in place of the hr=02 directory fails that partition only
+	archive := filepath.Join(dir, "archive")
+	blocked := filepath.Join(archive, "dt=2018-09-06", "hr=02")
+	assert.Nil(os.MkdirAll(filepath.Dir(blocked), 0755))
+	assert.Nil(ioutil.WriteFile(blocked, nil, 0644))
+	target, err := file.NewTarget(nil, archive, 0)
+	assert.Nil(err)
+	n, err := ps.Upload(context.Background(), target)
+	assert.NotNil(err)
+	assert.Equal(2, n)
+	pending, err := readNames(filepath.Join(dir, "out", UploadPending))
+	assert.Nil(err)
+	assert.Equal([]string{"dt=2018-09-06/hr=02"}, pending)
+
+	//a later run retries the failed partition without re-uploading hr=01
+	assert.Nil(os.Remove(blocked))
+	ps, err = NewPartitionedSink(filepath.Join(dir, "out"), trapyz.PartitionInfo{})
+	assert.Nil(err)
+	n, err = ps.Upload(context.Background(), target)
+	assert.Nil(err)
+	assert.Equal(2, n)
+	assert.Equal([]string{"_SUCCESS", "part-0000.ndjson"}, listParts(t, blocked))
+	_, err = os.Stat(filepath.Join(dir, "out", UploadPending))
+	assert.True(os.IsNotExist(err))
+
+	//new parts of an uploaded partition are uploaded with its marker
+	assert.Nil(ps.Write(partRec("g3", 1, at)))
+	assert.Nil(ps.Close())
+	n, err = ps.Upload(context.Background(), target)
+	assert.Nil(err)
+	assert.Equal(2, n)
+	assert.Equal([]string{"_SUCCESS", "part-0000.ndjson", "part-0001.ndjson"},
+		listParts(t, filepath.Join(archive, "dt=2018-09-06", "hr=01")))
+}
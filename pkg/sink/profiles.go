@@ -0,0 +1,92 @@
+package sink
+
+import (
+	"context"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/bamarb/aws-pipeline-go/pkg/dynamo"
+	"github.com/bamarb/aws-pipeline-go/pkg/profile"
+	"github.com/bamarb/aws-pipeline-go/pkg/trapyz"
+	radix "github.com/mediocregopher/radix.v3"
+	log "github.com/sirupsen/logrus"
+)
+
+//ProfileTTL returns the configured profile expiry, 0 never expires
+func ProfileTTL(cfg *trapyz.Config) (time.Duration, error) {
+	if cfg.ProfileTTL == "" {
+		return 0, nil
+	}
+	return time.ParseDuration(cfg.ProfileTTL)
+}
+
+//ProfileSink derives device profiles from the records of a run and
+//saves them on Close
+type ProfileSink struct {
+	builder *profile.Builder
+	cfg     *trapyz.Config
+	client  radix.Client
+	api     dynamodbiface.DynamoDBAPI
+}
+
+//NewProfileSink saves the profiles to the redis profile store client and
+//the dynamo table when api is set
+func NewProfileSink(cfg *trapyz.Config, client radix.Client, api dynamodbiface.DynamoDBAPI) *ProfileSink {
+	return &ProfileSink{builder: profile.NewBuilder(), cfg: cfg, client: client, api: api}
+}
+
+//Write counts the record against its device
+func (ps *ProfileSink) Write(rec trapyz.GeoLocOutput) error {
+	ps.builder.Add(rec)
+	return nil
+}
+
+//Flush does nothing, profiles are saved once per run
+func (ps *ProfileSink) Flush() error {
+	return nil
+}
+
+//Close saves the profiles
+func (ps *ProfileSink) Close() error {
+	return SaveProfiles(context.Background(), ps.cfg, ps.builder, ps.client, ps.api)
+}
+
+//SaveProfiles merges the profiles of a run into the redis profile store
+//and writes them to the dynamo table when api is set. Nothing is written
+//to dynamo if the redis save fails
+func SaveProfiles(ctx context.Context, cfg *trapyz.Config, b *profile.Builder, client radix.Client,
+	api dynamodbiface.DynamoDBAPI) error {
+	ttl, err := ProfileTTL(cfg)
+	if err != nil {
+		log.Errorf("Invalid profile_ttl [%s], profiles won't expire: %s", cfg.ProfileTTL, err)
+	}
+	saved, err := profile.NewRedisStore(client, ttl).Save(b, time.Now())
+	log.Infof("Profiles devices:%d saved:%d", b.Len(), saved)
+	if err != nil {
+		return err
+	}
+	if api == nil {
+		return nil
+	}
+	return writeProfilesDynamo(ctx, cfg, b, api)
+}
+
+//writeProfilesDynamo writes the derived profiles to the dynamo table
+func writeProfilesDynamo(ctx context.Context, cfg *trapyz.Config, b *profile.Builder,
+	api dynamodbiface.DynamoDBAPI) error {
+	dcfg := dynamo.ConfigFrom(cfg.Aws[trapyz.CfgKey(cfg, "dynamo")])
+	w, err := dynamo.NewWriter(ctx, api, dcfg)
+	if err != nil {
+		return err
+	}
+	for _, p := range b.Profiles() {
+		if err = w.Write(dynamo.ProfileItem(p, dcfg.HashKey)); err != nil {
+			break
+		}
+	}
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
+	log.Infof("Dynamo profiles table %s: %+v", dcfg.Table, w.Stats())
+	return err
+}
@@ -0,0 +1,36 @@
+package sink
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/bamarb/aws-pipeline-go/pkg/trapyz"
+	radix "github.com/mediocregopher/radix.v3"
+	"github.com/stretchr/testify/assert"
+)
+
+//downClient a redis client whose commands fail
+type downClient struct{}
+
+func (downClient) Do(radix.Action) error { return errors.New("connection refused") }
+func (downClient) Close() error          { return nil }
+
+func TestProfileSink(t *testing.T) {
+	assert := assert.New(t)
+	ps := NewProfileSink(&trapyz.Config{}, downClient{}, nil)
+	assert.Nil(ps.Write(trapyz.GeoLocOutput{Gid: "g1", UID: "s1", Createdat: "1536228000000"}))
+	assert.Nil(ps.Write(trapyz.GeoLocOutput{Gid: "g2", UID: "s1", Createdat: "1536228000000"}))
+	assert.Nil(ps.Write(trapyz.GeoLocOutput{UID: "s1", Createdat: "1536228000000"}))
+	assert.Nil(ps.Flush())
+	assert.Equal(2, ps.builder.Len())
+	//the failed redis save is returned
+	assert.EqualError(ps.Close(), "connection refused")
+
+	ttl, err := ProfileTTL(&trapyz.Config{ProfileTTL: "2160h"})
+	assert.Nil(err)
+	assert.Equal(90*24*time.Hour, ttl)
+	ttl, err = ProfileTTL(&trapyz.Config{})
+	assert.Nil(err)
+	assert.Zero(ttl)
+}
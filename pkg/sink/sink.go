@@ -0,0 +1,125 @@
+//Package sink output destinations for GeoLocOutput records
+package sink
+
+import (
+	"time"
+
+	"github.com/bamarb/aws-pipeline-go/pkg/trapyz"
+	log "github.com/sirupsen/logrus"
+)
+
+//Sink receives matched records. Flush makes the records written so far
+//durable, Close flushes and releases the sink. A sink is used from a
+//single goroutine
+type Sink interface {
+	Write(rec trapyz.GeoLocOutput) error
+	Flush() error
+	Close() error
+}
+
+//FanOut writes every record to all of its sinks
+type FanOut []Sink
+
+//Write writes the record to all sinks, a failing sink does not stop
+//the others. The first error is returned
+func (fo FanOut) Write(rec trapyz.GeoLocOutput) error {
+	var firstErr error
+	for _, s := range fo {
+		if err := s.Write(rec); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+//Flush flushes all sinks and returns the first error
+func (fo FanOut) Flush() error {
+	var firstErr error
+	for _, s := range fo {
+		if err := s.Flush(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+//Close closes all sinks and returns the first error
+func (fo FanOut) Close() error {
+	var firstErr error
+	for _, s := range fo {
+		if err := s.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+//Partitioned returns the partitioned sink of the fan out, nil if it
+//has none
+func (fo FanOut) Partitioned() *PartitionedSink {
+	for _, s := range fo {
+		if cs, ok := s.(*CountedSink); ok {
+			s = cs.Sink
+		}
+		if ps, ok := s.(*PartitionedSink); ok {
+			return ps
+		}
+	}
+	return nil
+}
+
+//windowed sinks whose output depends on the run window
+type windowed interface {
+	SetWindow(from, to time.Time)
+}
+
+//SetWindow passes the run window to the sinks keyed by it
+func (fo FanOut) SetWindow(from, to time.Time) {
+	for _, s := range fo {
+		if cs, ok := s.(*CountedSink); ok {
+			s = cs.Sink
+		}
+		if ws, ok := s.(windowed); ok {
+			ws.SetWindow(from, to)
+		}
+	}
+}
+
+//Discard drops all records
+type Discard struct{}
+
+//Write drops the record
+func (Discard) Write(rec trapyz.GeoLocOutput) error { return nil }
+
+//Flush does nothing
+func (Discard) Flush() error { return nil }
+
+//Close does nothing
+func (Discard) Close() error { return nil }
+
+//maxLoggedErrors write errors logged per Consume, the rest are only counted
+const maxLoggedErrors = 10
+
+//Consume writes records from the channel to the sink until it is closed.
+//It returns the number of records written and failed. Records without a
+//store are skipped
+func Consume(records <-chan trapyz.GeoLocOutput, s Sink) (written, failed int) {
+	for rec := range records {
+		if rec.UID == "" {
+			log.Errorf("Error record without store: %+v", rec)
+			continue
+		}
+		if err := s.Write(rec); err != nil {
+			failed++
+			if failed <= maxLoggedErrors {
+				log.Errorf("Error writing record %+v: %s", rec, err)
+			}
+			continue
+		}
+		written++
+	}
+	if failed > 0 {
+		log.Errorf("Error writing %d records", failed)
+	}
+	return written, failed
+}
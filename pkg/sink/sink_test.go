@@ -0,0 +1,129 @@
+package sink
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bamarb/aws-pipeline-go/pkg/trapyz"
+	"github.com/stretchr/testify/assert"
+)
+
+//failSink fails every write
+type failSink struct{ Discard }
+
+func (failSink) Write(rec trapyz.GeoLocOutput) error { return errors.New("write failed") }
+
+func readLines(t *testing.T, r io.Reader) []trapyz.GeoLocOutput {
+	var recs []trapyz.GeoLocOutput
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		var rec trapyz.GeoLocOutput
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			t.Fatal(err)
+		}
+		recs = append(recs, rec)
+	}
+	return recs
+}
+
+func TestFanOut(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "sink")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	plain, err := NewNDJSONFile(filepath.Join(dir, "out", "geocalc.out"))
+	assert.Nil(err)
+	gz, err := NewGzipFile(filepath.Join(dir, "out", "geocalc.out.gz"))
+	assert.Nil(err)
+	out := FanOut{plain, gz, Discard{}}
+
+	records := make(chan trapyz.GeoLocOutput, 4)
+	records <- trapyz.GeoLocOutput{UID: "s1", Gid: "g1", Cat: 5}
+	records <- trapyz.GeoLocOutput{Gid: "no store"}
+	records <- trapyz.GeoLocOutput{UID: "s2", Gid: "g2", Distance: 10}
+	close(records)
+	written, failed := Consume(records, out)
+	assert.Equal(2, written)
+	assert.Equal(0, failed)
+
+	//flushed lines are readable before close
+	assert.Nil(out.Flush())
+	fh, err := os.Open(plain.Name())
+	assert.Nil(err)
+	defer fh.Close()
+	assert.Len(readLines(t, fh), 2)
+	assert.Nil(out.Close())
+
+	zfh, err := os.Open(gz.Name())
+	assert.Nil(err)
+	defer zfh.Close()
+	zr, err := gzip.NewReader(zfh)
+	assert.Nil(err)
+	recs := readLines(t, zr)
+	assert.Equal([]trapyz.GeoLocOutput{{UID: "s1", Gid: "g1", Cat: 5}, {UID: "s2", Gid: "g2", Distance: 10}}, recs)
+}
+
+func TestFanOutErrors(t *testing.T) {
+	assert := assert.New(t)
+	var counted int
+	counter := &countSink{n: &counted}
+	out := FanOut{failSink{}, counter}
+	records := make(chan trapyz.GeoLocOutput, 2)
+	records <- trapyz.GeoLocOutput{UID: "s1"}
+	records <- trapyz.GeoLocOutput{UID: "s2"}
+	close(records)
+	written, failed := Consume(records, out)
+	assert.Equal(0, written)
+	assert.Equal(2, failed)
+	//a failing sink doesn't starve the others
+	assert.Equal(2, counted)
+}
+
+type countSink struct {
+	Discard
+	n *int
+}
+
+func (cs *countSink) Write(rec trapyz.GeoLocOutput) error {
+	*cs.n++
+	return nil
+}
+
+func TestFromConfig(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "sink")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+	cfg := &trapyz.Config{Output: trapyz.OutputInfo{Directory: dir, File: "geocalc.out",
+		FootfallFile: "footfall.out", Sinks: []string{"file", "gzip", "discard"}}}
+	out, err := FromConfig(cfg, nil)
+	assert.Nil(err)
+	assert.Len(out, 4)
+	out.SetWindow(time.Date(2018, 9, 6, 10, 0, 0, 0, time.UTC), time.Date(2018, 9, 6, 11, 0, 0, 0, time.UTC))
+	assert.Nil(out.Write(trapyz.GeoLocOutput{UID: "s1", Createdat: "1536228000000"}))
+	assert.Nil(out.Close())
+	report := trapyz.NewRunReport("test", time.Time{}, time.Time{})
+	out.Report(report)
+	assert.Len(report.Outputs, 4)
+	assert.Equal(trapyz.OutputReport{Written: 1}, report.Outputs[NameGzip])
+	assert.Equal(trapyz.OutputReport{Written: 1}, report.Outputs[NameFootfall])
+	for _, name := range []string{"geocalc.out", "geocalc.out.gz", "footfall-2018-09-06.out"} {
+		_, err := os.Stat(filepath.Join(dir, name))
+		assert.Nil(err, name)
+	}
+	assert.True(Enabled(cfg, NameGzip))
+	assert.False(Enabled(cfg, NameElastic))
+
+	cfg.Output.Sinks = []string{"file", "kafka"}
+	_, err = FromConfig(cfg, nil)
+	assert.Error(err)
+}
@@ -2,6 +2,7 @@ package task
 
 import (
 	"sync"
+	"sync/atomic"
 )
 
 //Worker must be implemented by types that want to
@@ -18,6 +19,8 @@ type Pool struct {
 	started  bool
 	nworkers int
 	wg       sync.WaitGroup
+	pending  int64
+	observe  func(int)
 }
 
 //New creates a new unstarted worker pool
@@ -38,6 +41,7 @@ func (p *Pool) Start() {
 		go func(id int) {
 			//fmt.Printf("Worker [%d] starting...\n", id)
 			for w := range p.work {
+				p.track(-1)
 				w.Task()
 			}
 			//fmt.Printf("Worker [%d] terminated\n", id)
@@ -56,9 +60,28 @@ func (p *Pool) isStarted() bool {
 //this is a synchronous method and could block if all workers
 //are busy. Panics if you submit a job to a stopped pool
 func (p *Pool) Submit(w Worker) {
+	p.track(1)
 	p.work <- w
 }
 
+//Observe calls fn with the number of submitted tasks waiting for a
+//worker whenever it changes, set it before Start
+func (p *Pool) Observe(fn func(pending int)) {
+	p.observe = fn
+}
+
+//Pending returns the number of submitted tasks waiting for a worker
+func (p *Pool) Pending() int {
+	return int(atomic.LoadInt64(&p.pending))
+}
+
+func (p *Pool) track(delta int64) {
+	n := atomic.AddInt64(&p.pending, delta)
+	if p.observe != nil {
+		p.observe(int(n))
+	}
+}
+
 //Stop stops (gracefully) the pool, stopping a stopped pool causes a panic
 func (p *Pool) Stop() {
 	close(p.work)
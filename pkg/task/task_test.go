@@ -1,6 +1,7 @@
 package task
 
 import (
+	"sync/atomic"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -25,3 +26,27 @@ func TestStartStop(t *testing.T) {
 	myPool.Stop()
 	assert.False(t, myPool.isStarted())
 }
+
+type blockTask chan struct{}
+
+func (b blockTask) Task() { <-b }
+
+func TestPending(t *testing.T) {
+	var myPool = New(1)
+	var calls int32
+	myPool.Observe(func(n int) { atomic.AddInt32(&calls, 1) })
+	myPool.Start()
+	block := make(blockTask)
+	myPool.Submit(block)
+	done := make(chan struct{})
+	go func() {
+		myPool.Submit(block)
+		close(done)
+	}()
+	block <- struct{}{}
+	<-done
+	block <- struct{}{}
+	myPool.Stop()
+	assert.Equal(t, 0, myPool.Pending())
+	assert.Equal(t, int32(4), atomic.LoadInt32(&calls))
+}
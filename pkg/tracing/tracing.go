@@ -0,0 +1,134 @@
+//Package tracing opentelemetry tracing of the pipeline stages. Spans are
+//exported to stdout, a file or an otlp http collector
+package tracing
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+//Exporters
+const (
+	ExporterNone   = "none"
+	ExporterStdout = "stdout"
+	ExporterFile   = "file"
+	ExporterOTLP   = "otlp"
+)
+
+//instrumentation name of the pipeline tracer
+const tracerName = "github.com/bamarb/aws-pipeline-go"
+
+//ErrorUnknownExporter unsupported exporter name
+var ErrorUnknownExporter = errors.New("Error unknown trace exporter")
+
+//ErrorNoTraceFile file exporter without a file
+var ErrorNoTraceFile = errors.New("Error file trace exporter needs a file")
+
+//Config exporter is one of none, stdout, file or otlp. File is the span
+//output of the file exporter, endpoint the host:port of the otlp http
+//collector. SampleRatio is the fraction of traces kept, 1 keeps all and
+//0 none
+type Config struct {
+	Exporter    string
+	File        string
+	Endpoint    string
+	Insecure    bool
+	SampleRatio float64
+	ServiceName string
+}
+
+//ShutdownFunc flushes the pending spans and stops the exporter
+type ShutdownFunc func(context.Context) error
+
+func noShutdown(context.Context) error { return nil }
+
+//Setup installs the global tracer provider for the config. Without an
+//exporter tracing stays disabled and spans are no-ops
+func Setup(ctx context.Context, c Config) (ShutdownFunc, error) {
+	var exp sdktrace.SpanExporter
+	var closer io.Closer
+	var err error
+	switch c.Exporter {
+	case "", ExporterNone:
+		return noShutdown, nil
+	case ExporterStdout:
+		exp, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	case ExporterFile:
+		if c.File == "" {
+			return nil, ErrorNoTraceFile
+		}
+		f, ferr := os.OpenFile(c.File, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if ferr != nil {
+			return nil, ferr
+		}
+		closer = f
+		exp, err = stdouttrace.New(stdouttrace.WithWriter(f))
+	case ExporterOTLP:
+		opts := []otlptracehttp.Option{}
+		if c.Endpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpoint(c.Endpoint))
+		}
+		if c.Insecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		exp, err = otlptracehttp.New(ctx, opts...)
+	default:
+		return nil, ErrorUnknownExporter
+	}
+	if err != nil {
+		if closer != nil {
+			closer.Close()
+		}
+		return nil, err
+	}
+	sampler := sdktrace.AlwaysSample()
+	if c.SampleRatio < 1 {
+		sampler = sdktrace.TraceIDRatioBased(c.SampleRatio)
+	}
+	name := c.ServiceName
+	if name == "" {
+		name = "tpz"
+	}
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exp),
+		sdktrace.WithSampler(sdktrace.ParentBased(sampler)),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", name))),
+	)
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	return func(ctx context.Context) error {
+		err := tp.Shutdown(ctx)
+		if closer != nil {
+			if cerr := closer.Close(); err == nil {
+				err = cerr
+			}
+		}
+		return err
+	}, nil
+}
+
+//Start starts a span as a child of the span in ctx
+func Start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+//End ends the span, marking it failed if err is set
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
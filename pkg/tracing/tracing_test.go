@@ -0,0 +1,76 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+func TestSetupNone(t *testing.T) {
+	assert := assert.New(t)
+	shutdown, err := Setup(context.Background(), Config{})
+	assert.Nil(err)
+	_, span := Start(context.Background(), "noop")
+	assert.False(span.SpanContext().IsValid())
+	End(span, nil)
+	assert.Nil(shutdown(context.Background()))
+
+	_, err = Setup(context.Background(), Config{Exporter: "jaeger"})
+	assert.Equal(ErrorUnknownExporter, err)
+	_, err = Setup(context.Background(), Config{Exporter: ExporterFile})
+	assert.Equal(ErrorNoTraceFile, err)
+}
+
+func TestSetupFile(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "tracing")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "traces.json")
+
+	shutdown, err := Setup(context.Background(), Config{Exporter: ExporterFile, File: name,
+		SampleRatio: 1, ServiceName: "tpz-test"})
+	assert.Nil(err)
+	ctx, parent := Start(context.Background(), "pipeline.run")
+	_, child := Start(ctx, "geocalc.file", attribute.String("file", "a.json"))
+	assert.Equal(parent.SpanContext().TraceID(), child.SpanContext().TraceID())
+	End(child, errors.New("Unknown apikey"))
+	End(parent, nil)
+	assert.Nil(shutdown(context.Background()))
+
+	data, err := ioutil.ReadFile(name)
+	assert.Nil(err)
+	out := string(data)
+	for _, want := range []string{`"Name":"pipeline.run"`, `"Name":"geocalc.file"`,
+		`"Value":"a.json"`, `"Description":"Unknown apikey"`, `"Value":"tpz-test"`} {
+		assert.True(strings.Contains(out, want), want)
+	}
+}
+
+func TestSampleRatio(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "tracing")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "traces.json")
+
+	for _, c := range []struct {
+		ratio   float64
+		sampled bool
+	}{{1, true}, {0, false}} {
+		shutdown, err := Setup(context.Background(), Config{Exporter: ExporterFile, File: name,
+			SampleRatio: c.ratio})
+		assert.Nil(err)
+		_, span := Start(context.Background(), "pipeline.run")
+		assert.Equal(c.sampled, span.SpanContext().IsSampled(), "ratio %v", c.ratio)
+		End(span, nil)
+		assert.Nil(shutdown(context.Background()))
+	}
+}
@@ -1,55 +1,147 @@
 package trapyz
 
 import (
+	"context"
+	"database/sql"
+	"fmt"
 	"strconv"
 	"strings"
 	"text/template"
+	"time"
 
+	"github.com/bamarb/aws-pipeline-go/pkg/geofence"
+	"github.com/bamarb/aws-pipeline-go/pkg/geomath"
 	"github.com/bamarb/aws-pipeline-go/pkg/geostore"
+	"github.com/bamarb/aws-pipeline-go/pkg/tracing"
 	"github.com/jmoiron/sqlx"
 	radix "github.com/mediocregopher/radix.v3"
 	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 //Cache holds reverse index maps for reverse lookup
 type Cache struct {
-	APIKeyMap map[string]int
-	CatMap    map[string]int
-	ScatMap   map[string]int
-	CityMap   map[string]int
-	PinMap    map[int]int
+	APIKeyMap map[string]APIKeyID
+	CatMap    map[string]CatID
+	ScatMap   map[string]SubcatID
+	CityMap   map[string]CityID
+	PinMap    map[int]PinID
 	LocCache  map[string]GeoLocOutput
+	//Per store radius and polygon geofences keyed by store id
+	Fences map[string]geofence.Fence
+	//The largest reach in meters of any fence, used to widen
+	//the redis radius search
+	MaxReach float64
+	//Stores with unmapped category, city or pincode
+	Quality *QualityReport
+	//Store locations keyed by store id
+	StoreLoc map[string]geomath.Point
+	//the store locations of the redis geo indexes, kept out of
+	//snapshots of the cache which carry their own copy
+	points []GeoPoint
 }
 
 //MakeCache a utility function that populates the cache
-func MakeCache(db *sqlx.DB, redisPool *radix.Pool, cfg *Config) (*Cache, error) {
+func MakeCache(ctx context.Context, db *sqlx.DB, redisPool *radix.Pool, cfg *Config) (cache *Cache, err error) {
+	ctx, span := tracing.Start(ctx, "cache.make")
+	defer func() { tracing.End(span, err) }()
 	/* Get the Table Names from config */
 	dbTabName := cfg.Db[CfgKey(cfg, "mysql")].Tables
-	/* Get the index name to populate */
-	indexKey := cfg.RedisCacheKey
-	var existsKey int
-	err := redisPool.Do(radix.Cmd(&existsKey, "EXISTS", indexKey))
-	if nil != err {
+	report := NewQualityReport()
+	points, err := mkGeoPoints(db, dbTabName, report)
+	if err != nil {
 		return nil, err
 	}
-	if existsKey == 0 {
-		log.Infof("Key %s does not exist populating redis", indexKey)
-		err := populateRedisGeoData(db, redisPool, dbTabName, indexKey)
-		if nil != err {
-			return nil, err
-		}
-		log.Debugf("Done populating redis geo cache, populating in memory caches")
-	}
 
 	/* Populate Caches */
-	aKeyMap := mkAPIKeyMap(db)
-	catMap := mkCategoryMap(db)
-	subCatMap := mkSubCategoryMap(db)
-	cityMap := mkCityMap(db)
-	pinMap := mkPincodeMap(db)
-	locCache := mkLocCache(db, catMap, subCatMap, cityMap, pinMap, dbTabName)
+	aKeyMap, err := mkAPIKeyMap(db, report)
+	if err != nil {
+		return nil, err
+	}
+	catMap, err := mkCategoryMap(db, report)
+	if err != nil {
+		return nil, err
+	}
+	subCatMap, err := mkSubCategoryMap(db, report)
+	if err != nil {
+		return nil, err
+	}
+	cityMap, err := mkCityMap(db, report)
+	if err != nil {
+		return nil, err
+	}
+	pinMap, err := mkPincodeMap(db, report)
+	if err != nil {
+		return nil, err
+	}
+	locCache, err := mkLocCache(db, catMap, subCatMap, cityMap, pinMap, dbTabName, report)
+	if err != nil {
+		return nil, err
+	}
 	log.Debugf("Geo Location cache populated with %d keys", len(locCache))
-	return &Cache{aKeyMap, catMap, subCatMap, cityMap, pinMap, locCache}, nil
+	fences, err := mkFenceMap(db, dbTabName, report)
+	if err != nil {
+		return nil, err
+	}
+	log.Infof("Catalog quality: %d of %d stores bad, unmapped %v unreadable %v", report.BadStores,
+		report.TotalStores, report.Unmapped, report.ScanErrors)
+	if err := report.WriteFile(cfg.Output.Directory, QualityReportFile); err != nil {
+		log.Errorf("Error writing data quality report: %s", err)
+	}
+	if err := report.Check(cfg.MaxBadStoreRatio); err != nil {
+		log.Errorf("Catalog bad store ratio %.4f exceeds max_bad_store_ratio %.4f",
+			report.BadRatio(), cfg.MaxBadStoreRatio)
+		return nil, err
+	}
+	var maxReach float64
+	for _, f := range fences {
+		if r := f.Reach(); r > maxReach {
+			maxReach = r
+		}
+	}
+	log.Debugf("Geofence cache populated with %d keys, max reach %.0fm", len(fences), maxReach)
+	if err := buildGeoIndexes(ctx, redisPool, cfg, points, fences, rebuildGeoIndex); err != nil {
+		return nil, err
+	}
+	storeLoc := mkStoreLocs(points)
+	span.SetAttributes(attribute.Int("stores", len(locCache)), attribute.Int("fences", len(fences)))
+	return &Cache{aKeyMap, catMap, subCatMap, cityMap, pinMap, locCache, fences, maxReach, report, storeLoc,
+		points}, nil
+}
+
+//EnsureGeoIndexes rebuilds the redis geo indexes of the cache that are
+//missing, eg: after the per run flush of a redis they share
+func (c *Cache) EnsureGeoIndexes(ctx context.Context, client radix.Client, cfg *Config) error {
+	return buildGeoIndexes(ctx, client, cfg, c.points, c.Fences, ensureGeoIndex)
+}
+
+//FlushRunData flushes the per run data in db 0 of the redis, the geo
+//indexes go with it. The flush is skipped while the profiles share
+//db 0, returns whether the db was flushed
+func FlushRunData(client radix.Client, cfg *Config) (bool, error) {
+	if cfg.ProfileDB == 0 {
+		return false, nil
+	}
+	return true, client.Do(radix.Cmd(nil, "FLUSHDB"))
+}
+
+//mkStoreLocs parses the store locations for exact distance computation
+func mkStoreLocs(points []GeoPoint) map[string]geomath.Point {
+	ret := make(map[string]geomath.Point, len(points))
+	for _, pt := range points {
+		lat, err := strconv.ParseFloat(pt.Lat, 64)
+		if err != nil {
+			log.Errorf("LOC-ERROR: uuid:[%s] lat:[%s]: %s", pt.ID, pt.Lat, err)
+			continue
+		}
+		lng, err := strconv.ParseFloat(pt.Lng, 64)
+		if err != nil {
+			log.Errorf("LOC-ERROR: uuid:[%s] lng:[%s]: %s", pt.ID, pt.Lng, err)
+			continue
+		}
+		ret[pt.ID] = geomath.Point{Lat: lat, Lng: lng}
+	}
+	return ret
 }
 
 func mkGeoStoreQuery(qp DbTableName) (string, error) {
@@ -69,158 +161,277 @@ func mkGeoStoreQuery(qp DbTableName) (string, error) {
 	return qstr.String(), nil
 }
 
-// Reads store data from mysql and creates a geo index in redis
-// TODO: Create a Batch Uploader to save RTT
-func populateRedisGeoData(db *sqlx.DB, rp *radix.Pool, dbt DbTableName, indexName string) error {
+//GeoPoint a store location as read from mysql
+type GeoPoint struct {
+	ID  string
+	Lat string
+	Lng string
+}
+
+//mkGeoPoints reads store locations from mysql, unreadable rows are
+//skipped and recorded in the quality report
+func mkGeoPoints(db *sqlx.DB, dbt DbTableName, report *QualityReport) ([]GeoPoint, error) {
 	query, err := mkGeoStoreQuery(dbt)
 	if err != nil {
-		return err
+		return nil, &CacheError{dbt.MasterRecTable, "template", err}
 	}
 	log.Infoln("Querying DB for stores...")
 	rows, err := db.Query(query)
 	if nil != err {
-		return err
+		return nil, &CacheError{dbt.MasterRecTable, "query", err}
 	}
 	log.Infoln("stores query completed")
 	defer rows.Close()
+	points := make([]GeoPoint, 0, 50000)
+	for rows.Next() {
+		var pt GeoPoint
+		err = rows.Scan(&pt.ID, &pt.Lat, &pt.Lng)
+		if nil != err {
+			report.ScanError(dbt.MasterRecTable, err)
+			continue
+		}
+		points = append(points, pt)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, &CacheError{dbt.MasterRecTable, "read", err}
+	}
+	return points, nil
+}
+
+//WideIndexKey returns the geo index of the stores with a fence reaching
+//beyond the default radius
+func WideIndexKey(indexKey string) string {
+	return indexKey + ":wide"
+}
+
+//widePoints returns the points of the stores with a fence reaching beyond
+//radius
+func widePoints(points []GeoPoint, fences map[string]geofence.Fence, radius float64) []GeoPoint {
+	var wide []GeoPoint
+	for _, pt := range points {
+		if f, ok := fences[pt.ID]; ok && f.Reach() > radius {
+			wide = append(wide, pt)
+		}
+	}
+	return wide
+}
+
+//geoIndexBuilder builds the geo index at indexKey from the points
+type geoIndexBuilder func(ctx context.Context, rp radix.Client, indexKey string, load func() ([]GeoPoint, error)) error
+
+//buildGeoIndexes builds the geo index of all stores, queried with the
+//default radius, and the wide index of the stores with large fences,
+//queried with their reach
+func buildGeoIndexes(ctx context.Context, rp radix.Client, cfg *Config, points []GeoPoint,
+	fences map[string]geofence.Fence, build geoIndexBuilder) error {
+	err := build(ctx, rp, cfg.RedisCacheKey, func() ([]GeoPoint, error) {
+		return points, nil
+	})
+	if err != nil {
+		return err
+	}
+	radius, err := ParseRadius(cfg.Radius)
+	if err != nil {
+		return err
+	}
+	return build(ctx, rp, WideIndexKey(cfg.RedisCacheKey), func() ([]GeoPoint, error) {
+		return widePoints(points, fences, radius), nil
+	})
+}
+
+//rebuildGeoIndex replaces the redis geo index with the loaded store
+//locations. The index is built under a temporary key and renamed over
+//the old one, queries see either the old or the new index
+func rebuildGeoIndex(ctx context.Context, rp radix.Client, indexKey string, load func() ([]GeoPoint, error)) (err error) {
+	_, span := tracing.Start(ctx, "redis.geo_index", attribute.String("key", indexKey),
+		attribute.Bool("rebuild", true))
+	defer func() { tracing.End(span, err) }()
+	points, err := load()
+	if err != nil {
+		return err
+	}
+	span.SetAttributes(attribute.Int("points", len(points)))
+	if len(points) == 0 {
+		return rp.Do(radix.Cmd(nil, "DEL", indexKey))
+	}
+	tmpKey := fmt.Sprintf("%s:build:%d", indexKey, time.Now().UnixNano())
+	if err = populateRedisGeoPoints(rp, points, tmpKey); err != nil {
+		rp.Do(radix.Cmd(nil, "DEL", tmpKey))
+		return err
+	}
+	if err = rp.Do(radix.Cmd(nil, "RENAME", tmpKey, indexKey)); err != nil {
+		rp.Do(radix.Cmd(nil, "DEL", tmpKey))
+		return err
+	}
+	log.Infof("Rebuilt redis geo index %s with %d stores", indexKey, len(points))
+	return nil
+}
+
+//ensureGeoIndex populates the redis geo index from the
+//loaded store locations if the index key does not exist
+func ensureGeoIndex(ctx context.Context, rp radix.Client, indexKey string, load func() ([]GeoPoint, error)) (err error) {
+	_, span := tracing.Start(ctx, "redis.geo_index", attribute.String("key", indexKey))
+	defer func() { tracing.End(span, err) }()
+	var existsKey int
+	err = rp.Do(radix.Cmd(&existsKey, "EXISTS", indexKey))
+	if nil != err {
+		return err
+	}
+	if existsKey != 0 {
+		return nil
+	}
+	log.Infof("Key %s does not exist populating redis", indexKey)
+	points, err := load()
+	if err != nil {
+		return err
+	}
+	span.SetAttributes(attribute.Int("points", len(points)))
+	err = populateRedisGeoPoints(rp, points, indexKey)
+	log.Debugf("Done populating redis geo cache with %d stores", len(points))
+	return err
+}
+
+//populateRedisGeoPoints creates a geo index in redis from store
+//locations, it stops at the first failed batch
+func populateRedisGeoPoints(rp radix.Client, points []GeoPoint, indexName string) error {
 	redisStore := geostore.NewGeoLocationStore(rp)
 	//Instead of making a roundtrip to redis for adding each location
 	//We batch up 1000 locations and add them at once
 	const count = 1000
 	const batchSize = count * 3
 	var locs = make([]string, 0, batchSize)
-	var i = 0
-	for rows.Next() {
-		var id, lat, lng string
-		err = rows.Scan(&id, &lat, &lng)
-		if nil != err {
-			log.Errorf("Row scan error:%s\n", err)
-			return err
-		}
-		if i < count {
-			locs = append(locs, lng, lat, id)
-			i++
+	for i, pt := range points {
+		locs = append(locs, pt.Lng, pt.Lat, pt.ID)
+		if (i+1)%count != 0 && i != len(points)-1 {
 			continue
 		}
-		_, err = redisStore.AddOrUpdateLocations(indexName, locs...)
+		_, err := redisStore.AddOrUpdateLocations(indexName, locs...)
 		if nil != err {
-			log.Errorf("Redis store error : %s\n", err)
+			return err
 		}
 		//reset the slice for the next round
-		i = 0
 		locs = locs[:0]
-		locs = append(locs, lng, lat, id)
-		i++
-	}
-	//Add Any remaining to redis
-	_, err = redisStore.AddOrUpdateLocations(indexName, locs...)
-	if nil != err {
-		log.Errorf("Redis store error : %s\n", err)
 	}
 	return nil
 }
 
-func mkCategoryMap(db *sqlx.DB) map[string]int {
-	ret := make(map[string]int)
+func mkCategoryMap(db *sqlx.DB, report *QualityReport) (map[string]CatID, error) {
+	ret := make(map[string]CatID)
 	rows, err := db.Query(`SELECT * from CategoryMap`)
 	if err != nil {
-		return ret
+		return nil, &CacheError{"CategoryMap", "query", err}
 	}
 	defer rows.Close()
 	for rows.Next() {
-		var catid int
+		var catid CatID
 		var name string
 		err = rows.Scan(&catid, &name)
 		if nil != err {
-			log.Errorf("Error scan CategoryMap: %s", err)
+			report.ScanError("CategoryMap", err)
 			continue
 		}
 		name = strings.ToLower(name)
 		ret[name] = catid
 	}
-	return ret
+	if err = rows.Err(); err != nil {
+		return nil, &CacheError{"CategoryMap", "read", err}
+	}
+	return ret, nil
 }
 
 // Maps name to sub cat id
-func mkSubCategoryMap(db *sqlx.DB) map[string]int {
-	ret := make(map[string]int)
+func mkSubCategoryMap(db *sqlx.DB, report *QualityReport) (map[string]SubcatID, error) {
+	ret := make(map[string]SubcatID)
 	rows, err := db.Query(`SELECT * from SubCategoryMap`)
 	if err != nil {
-		return ret
+		return nil, &CacheError{"SubCategoryMap", "query", err}
 	}
 	defer rows.Close()
 	for rows.Next() {
-		var catid, subcatid int
+		var catid CatID
+		var subcatid SubcatID
 		var name string
 		err = rows.Scan(&catid, &subcatid, &name)
 		if nil != err {
-			log.Errorf("Error scan SubCategoryMap: %s", err)
+			report.ScanError("SubCategoryMap", err)
 			continue
 		}
 		name = strings.ToLower(name)
 		ret[name] = subcatid
 	}
-	return ret
+	if err = rows.Err(); err != nil {
+		return nil, &CacheError{"SubCategoryMap", "read", err}
+	}
+	return ret, nil
 }
 
-func mkAPIKeyMap(db *sqlx.DB) map[string]int {
-	ret := make(map[string]int)
+func mkAPIKeyMap(db *sqlx.DB, report *QualityReport) (map[string]APIKeyID, error) {
+	ret := make(map[string]APIKeyID)
 	rows, err := db.Query(`SELECT * from ApikeyMap`)
 	if err != nil {
-		return ret
+		return nil, &CacheError{"ApikeyMap", "query", err}
 	}
 	defer rows.Close()
 	for rows.Next() {
-		var id int
+		var id APIKeyID
 		var name string
 		err = rows.Scan(&id, &name)
 		if nil != err {
-			log.Errorf("Error scan ApikeyMap: %s", err)
+			report.ScanError("ApikeyMap", err)
 			continue
 		}
 		ret[name] = id
 	}
-	return ret
+	if err = rows.Err(); err != nil {
+		return nil, &CacheError{"ApikeyMap", "read", err}
+	}
+	return ret, nil
 }
 
-func mkCityMap(db *sqlx.DB) map[string]int {
-	ret := make(map[string]int)
+func mkCityMap(db *sqlx.DB, report *QualityReport) (map[string]CityID, error) {
+	ret := make(map[string]CityID)
 	rows, err := db.Query(`SELECT * from CityMap`)
 	if err != nil {
-		return ret
+		return nil, &CacheError{"CityMap", "query", err}
 	}
 	defer rows.Close()
 	for rows.Next() {
-		var id int
+		var id CityID
 		var name string
 		err = rows.Scan(&id, &name)
 		if nil != err {
-			log.Errorf("Error scan CityMap: %s", err)
+			report.ScanError("CityMap", err)
 			continue
 		}
 		ret[name] = id
 	}
-	return ret
+	if err = rows.Err(); err != nil {
+		return nil, &CacheError{"CityMap", "read", err}
+	}
+	return ret, nil
 }
 
-func mkPincodeMap(db *sqlx.DB) map[int]int {
-	ret := make(map[int]int)
+func mkPincodeMap(db *sqlx.DB, report *QualityReport) (map[int]PinID, error) {
+	ret := make(map[int]PinID)
 	rows, err := db.Query(`SELECT id, Pincode from PincodeMap`)
 	if err != nil {
-		return ret
+		return nil, &CacheError{"PincodeMap", "query", err}
 	}
 	defer rows.Close()
 	for rows.Next() {
-		var id int
+		var id PinID
 		var name int
 		err = rows.Scan(&id, &name)
 		if nil != err {
-			log.Errorf("Error scan Pincode: %s", err)
+			report.ScanError("PincodeMap", err)
 			continue
 		}
 		ret[name] = id
 	}
-	return ret
+	if err = rows.Err(); err != nil {
+		return nil, &CacheError{"PincodeMap", "read", err}
+	}
+	return ret, nil
 }
 
 func mkLocCacheQuery(qp DbTableName) (string, error) {
@@ -239,18 +450,18 @@ func mkLocCacheQuery(qp DbTableName) (string, error) {
 	return qstr.String(), nil
 }
 
-func mkLocCache(db *sqlx.DB, catm, scatm, cm map[string]int,
-	pm map[int]int, dbt DbTableName) map[string]GeoLocOutput {
+//mkLocCache builds the store templates, stores with unmapped fields
+//are listed in the quality report
+func mkLocCache(db *sqlx.DB, catm map[string]CatID, scatm map[string]SubcatID, cm map[string]CityID,
+	pm map[int]PinID, dbt DbTableName, report *QualityReport) (map[string]GeoLocOutput, error) {
 	q, err := mkLocCacheQuery(dbt)
 	if err != nil {
-		log.Errorf("Making query failed: %s", err)
-		return nil
+		return nil, &CacheError{dbt.MasterRecTable, "template", err}
 	}
 	log.Infof("LocCache query:[%s] ", q)
 	rows, err := db.Queryx(q)
 	if err != nil {
-		log.Errorf("mkLocCache query failed: %s", err)
-		return nil
+		return nil, &CacheError{dbt.MasterRecTable, "query", err}
 	}
 	defer rows.Close()
 	ret := make(map[string]GeoLocOutput, 50000)
@@ -258,29 +469,102 @@ func mkLocCache(db *sqlx.DB, catm, scatm, cm map[string]int,
 	for rows.Next() {
 		var uuid, pincode int
 		var sname, cat, subcat, city string
-		var catid, subcatid, cityid, pinid string
+		report.TotalStores++
 		err = rows.Scan(&uuid, &sname, &cat, &subcat, &city, &pincode)
 		if nil != err {
-			log.Errorf("mkLocCache scan failed: %s\n", err)
+			report.BadStoreRow(dbt.MasterRecTable, err)
 			continue
 		}
 		cat = strings.ToLower(cat)
 		subcat = strings.ToLower(subcat)
-		//log.Debugf("Scanned: %d, %s, %s, %s,%s, %d", uuid, sname, cat, subcat, city, pincode)
 		uuidstr := strconv.Itoa(uuid)
-		catid = strconv.Itoa(catm[cat])
-		subcatid = strconv.Itoa(scatm[subcat])
-		cityid = strconv.Itoa(cm[city])
-		pinid = strconv.Itoa(pm[pincode])
-		if catid == "0" || catid == "" || subcatid == "0" || subcatid == "" {
-			log.Errorf("CAT-ERROR: uuid:[%s], sname:[%s] catid:[%s] subcatid:[%s] catname:[%s] subcatname:[%s]",
-				uuidstr, sname, catid, subcatid, cat, subcat)
+		catid, subcatid, cityid, pinid := catm[cat], scatm[subcat], cm[city], pm[pincode]
+		var unmapped []string
+		for _, f := range []struct {
+			name string
+			ok   bool
+		}{{FieldCat, catid.Known()}, {FieldSubcat, subcatid.Known()},
+			{FieldCity, cityid.Known()}, {FieldPin, pinid.Known()}} {
+			if !f.ok {
+				unmapped = append(unmapped, f.name)
+			}
 		}
-		if cityid == "0" || cityid == "" || pinid == "0" || pinid == "" {
-			log.Errorf("CITY-ERROR: uuid:[%s] sname:[%s] cityid:[%s] pinid:[%s] city-name:[%s] pin-name:[%d]",
-				uuidstr, sname, cityid, pinid, city, pincode)
+		if len(unmapped) > 0 {
+			log.Errorf("UNMAPPED: uuid:[%s] sname:[%s] fields:%v cat:[%s] subcat:[%s] city:[%s] pin:[%d]",
+				uuidstr, sname, unmapped, cat, subcat, city, pincode)
+			report.Add(UnmappedStore{UID: uuidstr, Sname: sname, Fields: unmapped,
+				Cat: cat, Subcat: subcat, City: city, Pincode: pincode})
 		}
-		ret[uuidstr] = GeoLocOutput{UID: uuidstr, Pin: pinid, Sname: sname, Cat: catid, Subcat: subcatid, City: cityid}
+		ret[uuidstr] = GeoLocOutput{UID: uuidstr, Pin: pinid, Sname: sname,
+			Cat: catid, Subcat: subcatid, City: cityid}
 	}
-	return ret
+	if err = rows.Err(); err != nil {
+		return nil, &CacheError{dbt.MasterRecTable, "read", err}
+	}
+	return ret, nil
+}
+
+func mkFenceQuery(qp DbTableName) (string, error) {
+	queryTemplate := `SELECT s.Store_ID,
+	{{if .RadiusColumn}}m.{{.RadiusColumn}}{{else}}NULL{{end}},
+	{{if .GeofenceColumn}}m.{{.GeofenceColumn}}{{else}}NULL{{end}}
+	FROM {{.StoreUUIDTable}} s INNER JOIN {{.MasterRecTable}} m ON s.Store_Uuid = m.UUID;`
+	var qstr strings.Builder
+	tmpl, err := template.New("Fences").Parse(queryTemplate)
+	if err != nil {
+		return "", err
+	}
+	err = tmpl.Execute(&qstr, qp)
+	if err != nil {
+		return "", err
+	}
+	return qstr.String(), nil
+}
+
+//mkFenceMap reads per store radii and polygons, stores without either
+//are left out and fall back to the configured radius
+func mkFenceMap(db *sqlx.DB, dbt DbTableName, report *QualityReport) (map[string]geofence.Fence, error) {
+	ret := make(map[string]geofence.Fence)
+	if dbt.RadiusColumn == "" && dbt.GeofenceColumn == "" {
+		return ret, nil
+	}
+	q, err := mkFenceQuery(dbt)
+	if err != nil {
+		return nil, &CacheError{dbt.MasterRecTable, "template", err}
+	}
+	rows, err := db.Query(q)
+	if err != nil {
+		return nil, &CacheError{dbt.MasterRecTable, "query", err}
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var uuid int
+		var radius sql.NullFloat64
+		var geom sql.NullString
+		err = rows.Scan(&uuid, &radius, &geom)
+		if nil != err {
+			report.ScanError(dbt.MasterRecTable, err)
+			continue
+		}
+		var fence geofence.Fence
+		if radius.Valid && radius.Float64 > 0 {
+			fence.Radius = radius.Float64
+		}
+		if geom.Valid && strings.TrimSpace(geom.String) != "" {
+			poly, err := geofence.Parse(geom.String)
+			if err != nil {
+				log.Errorf("FENCE-ERROR: uuid:[%d] geofence:[%s]: %s", uuid, geom.String, err)
+			} else {
+				fence.Polygon = poly
+			}
+		}
+		if fence.Radius == 0 && !fence.IsPolygon() {
+			continue
+		}
+		ret[strconv.Itoa(uuid)] = fence
+	}
+	if err = rows.Err(); err != nil {
+		return nil, &CacheError{dbt.MasterRecTable, "read", err}
+	}
+	return ret, nil
 }
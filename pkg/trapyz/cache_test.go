@@ -0,0 +1,120 @@
+package trapyz
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/bamarb/aws-pipeline-go/pkg/geofence"
+	"github.com/bamarb/aws-pipeline-go/pkg/geomath"
+	"github.com/bamarb/aws-pipeline-go/pkg/geostore"
+	"github.com/mediocregopher/radix.v3"
+	"github.com/stretchr/testify/assert"
+)
+
+//fakeGeoRedis keeps the geo sets of a single redis db in memory
+type fakeGeoRedis struct {
+	sync.Mutex
+	sets map[string]map[string]geomath.Point
+}
+
+func newFakeGeoRedis() *fakeGeoRedis {
+	return &fakeGeoRedis{sets: make(map[string]map[string]geomath.Point)}
+}
+
+func (f *fakeGeoRedis) conn() radix.Conn {
+	return radix.Stub("tcp", "127.0.0.1:6379", f.do)
+}
+
+func (f *fakeGeoRedis) do(args []string) interface{} {
+	f.Lock()
+	defer f.Unlock()
+	switch args[0] {
+	case "FLUSHDB":
+		f.sets = make(map[string]map[string]geomath.Point)
+		return "OK"
+	case "EXISTS":
+		if _, ok := f.sets[args[1]]; ok {
+			return 1
+		}
+		return 0
+	case "DEL":
+		delete(f.sets, args[1])
+		return 1
+	case "RENAME":
+		f.sets[args[2]] = f.sets[args[1]]
+		delete(f.sets, args[1])
+		return "OK"
+	case "GEOADD":
+		set, ok := f.sets[args[1]]
+		if !ok {
+			set = make(map[string]geomath.Point)
+			f.sets[args[1]] = set
+		}
+		for i := 2; i+2 < len(args); i += 3 {
+			lng, _ := strconv.ParseFloat(args[i], 64)
+			lat, _ := strconv.ParseFloat(args[i+1], 64)
+			set[args[i+2]] = geomath.Point{Lat: lat, Lng: lng}
+		}
+		return len(args) / 3
+	case "GEORADIUS":
+		lng, _ := strconv.ParseFloat(args[2], 64)
+		lat, _ := strconv.ParseFloat(args[3], 64)
+		radius, _ := strconv.ParseFloat(args[4], 64)
+		var ret [][]string
+		for id, pt := range f.sets[args[1]] {
+			if d := geomath.Haversine(geomath.Point{Lat: lat, Lng: lng}, pt); d <= radius {
+				ret = append(ret, []string{id, fmt.Sprintf("%.4f", d)})
+			}
+		}
+		return ret
+	}
+	return errors.New("unsupported command " + args[0])
+}
+
+func TestFlushRunDataEnsureGeoIndexes(t *testing.T) {
+	assert := assert.New(t)
+	redis := newFakeGeoRedis()
+	client := redis.conn()
+	cfg := &Config{RedisCacheKey: "stores", Radius: "300m", ProfileDB: 1}
+	cache := &Cache{
+		Fences: map[string]geofence.Fence{"42": {Radius: 120}, "43": {Radius: 900}},
+		points: []GeoPoint{
+			{ID: "42", Lat: "12.9716", Lng: "77.5946"},
+			{ID: "43", Lat: "12.9352", Lng: "77.6245"},
+		},
+	}
+	ctx := context.Background()
+	assert.Nil(cache.EnsureGeoIndexes(ctx, client, cfg))
+	store := geostore.NewGeoLocationStore(client)
+	near := func(idx string) []string {
+		found, err := store.NearbyWithDist(idx, "12.9717", "77.5946", "300")
+		assert.Nil(err)
+		var ids []string
+		for _, f := range found {
+			ids = append(ids, f.LocID)
+		}
+		return ids
+	}
+	assert.Equal([]string{"42"}, near(cfg.RedisCacheKey))
+
+	flushed, err := FlushRunData(client, cfg)
+	assert.Nil(err)
+	assert.True(flushed)
+	assert.Empty(near(cfg.RedisCacheKey))
+
+	//the next run restores the flushed indexes before querying
+	assert.Nil(cache.EnsureGeoIndexes(ctx, client, cfg))
+	assert.Equal([]string{"42"}, near(cfg.RedisCacheKey))
+	assert.Len(redis.sets[WideIndexKey(cfg.RedisCacheKey)], 1)
+
+	//profiles sharing db 0 are never flushed
+	cfg.ProfileDB = 0
+	flushed, err = FlushRunData(client, cfg)
+	assert.Nil(err)
+	assert.False(flushed)
+	assert.Equal([]string{"42"}, near(cfg.RedisCacheKey))
+}
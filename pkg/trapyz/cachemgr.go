@@ -0,0 +1,95 @@
+package trapyz
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+//ErrorNoCache is returned when no cache has been built yet
+var ErrorNoCache = errors.New("Error no cache available")
+
+//CacheBuilder builds a fresh Cache, usually a closure over MakeCache
+type CacheBuilder func() (*Cache, error)
+
+//CacheManager holds a long lived Cache and refreshes it in the background.
+//A new cache is built off to the side and published with an atomic swap,
+//so readers always see a complete cache and a failed refresh keeps the
+//last good one
+type CacheManager struct {
+	build    CacheBuilder
+	interval time.Duration
+	current  atomic.Value
+	//serializes builds
+	lock    sync.Mutex
+	trigger chan struct{}
+}
+
+//NewCacheManager constructs a cache manager, an interval of zero
+//disables periodic refresh, the cache can still be refreshed on demand
+func NewCacheManager(build CacheBuilder, interval time.Duration) *CacheManager {
+	if nil == build {
+		return nil
+	}
+	return &CacheManager{build: build, interval: interval, trigger: make(chan struct{}, 1)}
+}
+
+//Get returns the current cache snapshot or nil if no build has succeeded.
+//Callers should hold on to the returned pointer for the duration of a run
+func (cm *CacheManager) Get() *Cache {
+	cache, _ := cm.current.Load().(*Cache)
+	return cache
+}
+
+//Refresh builds a new cache synchronously and publishes it on success
+func (cm *CacheManager) Refresh() error {
+	cm.lock.Lock()
+	defer cm.lock.Unlock()
+	start := time.Now()
+	cache, err := cm.build()
+	if err != nil {
+		log.Errorf("Cache refresh failed, keeping last good cache: %s", err)
+		return err
+	}
+	if cache == nil {
+		return ErrorNoCache
+	}
+	cm.current.Store(cache)
+	log.Infof("Cache refreshed in %s: %d stores", time.Since(start), len(cache.LocCache))
+	return nil
+}
+
+//Trigger requests an asynchronous refresh, it never blocks and
+//collapses multiple pending requests into one
+func (cm *CacheManager) Trigger() {
+	select {
+	case cm.trigger <- struct{}{}:
+	default:
+	}
+}
+
+//Start runs the refresh loop until the context is done
+func (cm *CacheManager) Start(ctx context.Context) {
+	go func() {
+		var tick <-chan time.Time
+		if cm.interval > 0 {
+			ticker := time.NewTicker(cm.interval)
+			defer ticker.Stop()
+			tick = ticker.C
+		}
+		for {
+			select {
+			case <-tick:
+				cm.Refresh()
+			case <-cm.trigger:
+				cm.Refresh()
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
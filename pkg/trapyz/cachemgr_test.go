@@ -0,0 +1,55 @@
+package trapyz
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCacheManagerRefresh(t *testing.T) {
+	assert := assert.New(t)
+	var builds int
+	var fail bool
+	cm := NewCacheManager(func() (*Cache, error) {
+		if fail {
+			return nil, errors.New("db down")
+		}
+		builds++
+		return &Cache{LocCache: make(map[string]GeoLocOutput, builds)}, nil
+	}, 0)
+	assert.Nil(cm.Get())
+
+	assert.Nil(cm.Refresh())
+	first := cm.Get()
+	assert.NotNil(first)
+
+	//A failed refresh keeps the last good cache
+	fail = true
+	assert.Error(cm.Refresh())
+	assert.True(first == cm.Get())
+
+	fail = false
+	assert.Nil(cm.Refresh())
+	assert.False(first == cm.Get())
+	assert.Equal(2, builds)
+}
+
+func TestCacheManagerTrigger(t *testing.T) {
+	done := make(chan struct{}, 1)
+	cm := NewCacheManager(func() (*Cache, error) {
+		done <- struct{}{}
+		return &Cache{}, nil
+	}, 0)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cm.Start(ctx)
+	cm.Trigger()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("triggered refresh did not run")
+	}
+}
@@ -6,6 +6,8 @@ import (
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3iface"
 	"github.com/jmoiron/sqlx"
@@ -36,29 +38,65 @@ func NewConnMgr(config *Config) *ConnectionManager {
 
 //MustConnectMysql make the mysql connection or die
 func (cm *ConnectionManager) MustConnectMysql() *sqlx.DB {
+	conn, err := cm.ConnectMysql()
+	if err != nil {
+		panic(err)
+	}
+	return conn
+}
+
+//ConnectMysql make the mysql connection
+func (cm *ConnectionManager) ConnectMysql() (*sqlx.DB, error) {
 	key := CfgKey(cm.cfg, "mysql")
 	cm.lock.RLock()
 	if ret, present := cm.connCache[key]; present {
 		cm.lock.RUnlock()
-		return ret.(*sqlx.DB)
+		return ret.(*sqlx.DB), nil
 	}
 	cm.lock.RUnlock()
 	cm.lock.Lock()
+	defer cm.lock.Unlock()
 	dbCfg := cm.cfg.Db[key]
 	sqlConnStr := fmt.Sprintf("%s:%s@tcp(%s:%s)/%s", dbCfg.User,
 		dbCfg.Password, dbCfg.Server, dbCfg.Port, dbCfg.Dbname)
 	//log.Debugf("SQL Conn str [%s]\n", sqlConnStr)
-	conn := sqlx.MustConnect("mysql", sqlConnStr)
+	conn, err := sqlx.Connect("mysql", sqlConnStr)
+	if err != nil {
+		return nil, err
+	}
 	cm.connCache[key] = conn
-	cm.lock.Unlock()
-	return conn
+	return conn, nil
 }
 
 //MustConnectRedis make redis connection or die
 func (cm *ConnectionManager) MustConnectRedis() *radix.Pool {
-	key := CfgKey(cm.cfg, "redis")
+	return cm.mustConnectRedis(CfgKey(cm.cfg, "redis"), 0)
+}
+
+//MustConnectRedisLocal make the local redis connection or die
+func (cm *ConnectionManager) MustConnectRedisLocal() *radix.Pool {
+	return cm.mustConnectRedis(CfgKey(cm.cfg, "redis-local"), 0)
+}
+
+//MustConnectRedisProfiles connects to the profile db of the local redis
+//or dies, profiles are kept apart from the per run data in db 0
+func (cm *ConnectionManager) MustConnectRedisProfiles() *radix.Pool {
+	return cm.mustConnectRedis(CfgKey(cm.cfg, "redis-local"), cm.cfg.ProfileDB)
+}
+
+//MustConnectRedisUniques connects to the uniques db of the local redis
+//or dies, like the profiles the sketches outlive the per run data
+func (cm *ConnectionManager) MustConnectRedisUniques() *radix.Pool {
+	return cm.mustConnectRedis(CfgKey(cm.cfg, "redis-local"), cm.cfg.Uniques.DB)
+}
+
+func (cm *ConnectionManager) mustConnectRedis(key string, db int) *radix.Pool {
+	cacheKey := key
+	if db != 0 {
+		cacheKey = fmt.Sprintf("%s/%d", key, db)
+	}
 	cm.lock.RLock()
-	if conn, present := cm.connCache[key]; present {
+	if conn, present := cm.connCache[cacheKey]; present {
 		cm.lock.RUnlock()
 		return conn.(*radix.Pool)
 	}
@@ -66,12 +104,18 @@ func (cm *ConnectionManager) MustConnectRedis() *radix.Pool {
 	cm.lock.Lock()
 	redisCfg := cm.cfg.Db[key]
 	redisConnStr := fmt.Sprintf("%s:%s", redisCfg.Server, redisCfg.Port)
-	redisPool, err := radix.NewPool("tcp", redisConnStr, 10)
+	var opts []radix.PoolOpt
+	if db != 0 {
+		opts = append(opts, radix.PoolConnFunc(func(network, addr string) (radix.Conn, error) {
+			return radix.Dial(network, addr, radix.DialSelectDB(db))
+		}))
+	}
+	redisPool, err := radix.NewPool("tcp", redisConnStr, 10, opts...)
 	if err != nil {
 		cm.lock.Unlock()
 		panic(err)
 	}
-	cm.connCache[key] = redisPool
+	cm.connCache[cacheKey] = redisPool
 	cm.lock.Unlock()
 	return redisPool
 }
@@ -116,3 +160,39 @@ func (cm *ConnectionManager) MustConnectS3() s3iface.S3API {
 	cm.lock.Unlock()
 	return conn
 }
+
+//MustConnectDynamo make a DynamoDBAPI client or die. Returns nil if
+//the dynamo section of this environment is missing or not enabled
+func (cm *ConnectionManager) MustConnectDynamo() dynamodbiface.DynamoDBAPI {
+	key := CfgKey(cm.cfg, "dynamo")
+	cm.lock.RLock()
+	if conn, present := cm.connCache[key]; present {
+		cm.lock.RUnlock()
+		return conn.(dynamodbiface.DynamoDBAPI)
+	}
+	cm.lock.RUnlock()
+	awsCfgInfo, ok := cm.cfg.Aws[key]
+	if !ok || !awsCfgInfo.Enabled {
+		return nil
+	}
+	region := awsCfgInfo.Region
+	if region == "" {
+		region = "us-east-1"
+	}
+	awsCfg := aws.Config{Region: aws.String(region)}
+	if awsCfgInfo.Endpoint != "" {
+		awsCfg.Endpoint = aws.String(awsCfgInfo.Endpoint)
+	}
+	cm.lock.Lock()
+	defer cm.lock.Unlock()
+	sess, err := session.NewSessionWithOptions(session.Options{
+		Config:  awsCfg,
+		Profile: awsCfgInfo.Profile,
+	})
+	if err != nil {
+		panic(err)
+	}
+	conn := dynamodb.New(sess)
+	cm.connCache[key] = conn
+	return conn
+}
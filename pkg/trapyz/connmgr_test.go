@@ -0,0 +1,17 @@
+package trapyz
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMustConnectDynamoDisabled(t *testing.T) {
+	assert := assert.New(t)
+	cfg := &Config{TpzEnv: "dev", Aws: map[string]AwsS3Info{}}
+	cm := &ConnectionManager{cfg: cfg, connCache: make(map[string]interface{})}
+	assert.Nil(cm.MustConnectDynamo())
+	//a configured section is not connected unless enabled
+	cfg.Aws["dynamo-dev"] = AwsS3Info{Endpoint: "http://127.0.0.1:8000", Table: "device_profiles"}
+	assert.Nil(cm.MustConnectDynamo())
+}
@@ -0,0 +1,277 @@
+package trapyz
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bamarb/aws-pipeline-go/pkg/input"
+)
+
+//ErrorUnknownAPIKey the ping's apikey has no mapping, none of its
+//matches could be output
+var ErrorUnknownAPIKey = errors.New("Unknown apikey")
+
+//ErrorReplayDir is returned if the replay input directory has files in it
+var ErrorReplayDir = errors.New("Error replay directory is not empty")
+
+//ErrorClass the stage an input record failed at
+type ErrorClass int
+
+const (
+	// ErrorParse the line could not be read or decoded
+	ErrorParse ErrorClass = iota
+	// ErrorValidation required keys are missing or the filter rejected it
+	ErrorValidation
+	// ErrorLookup the store or id lookups failed
+	ErrorLookup
+	numErrorClasses
+)
+
+var errorClassNames = [...]string{"parse", "validation", "lookup"}
+
+func (c ErrorClass) String() string {
+	if c < ErrorParse || c >= numErrorClasses {
+		return "unknown"
+	}
+	return errorClassNames[c]
+}
+
+//matchErrorClass classifies an OutputToWriter error, coordinates that
+//don't parse are invalid input, anything else is a lookup failure
+func matchErrorClass(err error) ErrorClass {
+	if _, ok := err.(*strconv.NumError); ok {
+		return ErrorValidation
+	}
+	return ErrorLookup
+}
+
+//FileStats accounting of one input file
+type FileStats struct {
+	Lines      uint
+	Matched    uint
+	Duplicates uint
+	Errors     [numErrorClasses]uint
+}
+
+//Reject counts a record failed at class
+func (fs *FileStats) Reject(class ErrorClass) {
+	fs.Errors[class]++
+}
+
+func (fs FileStats) String() string {
+	return fmt.Sprintf("lines:%d matched:%d duplicates:%d parse_errors:%d validation_errors:%d lookup_errors:%d",
+		fs.Lines, fs.Matched, fs.Duplicates, fs.Errors[ErrorParse], fs.Errors[ErrorValidation], fs.Errors[ErrorLookup])
+}
+
+//DeadLetter a rejected input record. Raw is the line as read, Record the
+//normalized record when the source was not json lines so the record can
+//be replayed without its csv header or Parquet schema
+type DeadLetter struct {
+	File   string                 `json:"file"`
+	Line   int                    `json:"line"`
+	Class  string                 `json:"class"`
+	Reason string                 `json:"reason"`
+	Worker int                    `json:"worker"`
+	Raw    string                 `json:"raw"`
+	Record map[string]interface{} `json:"record,omitempty"`
+}
+
+//ReplayLine returns the json line to feed back to the geo calculator
+//with createdAt in milliseconds, replay input is read without scaling.
+//scaleTime is set if the raw json lines carry createdAt in seconds, the
+//kept records of the other formats are in milliseconds already
+func (dl *DeadLetter) ReplayLine(scaleTime bool) ([]byte, error) {
+	if dl.Record != nil {
+		return json.Marshal(dl.Record)
+	}
+	if !scaleTime {
+		return []byte(dl.Raw), nil
+	}
+	var rec map[string]interface{}
+	if err := json.Unmarshal([]byte(dl.Raw), &rec); err != nil || rec == nil {
+		//replayed as is to be rejected again
+		return []byte(dl.Raw), nil
+	}
+	if secs, ok := rec[input.CreatedAtKey].(float64); ok {
+		rec[input.CreatedAtKey] = float64(int64(secs) * 1000)
+	}
+	return json.Marshal(rec)
+}
+
+//DeadLetterQueue collects the rejected records of a run as json lines in
+//<dir>/deadletter-<run start>.ndjson. It is shared by the workers, the
+//file is only created once a record is written. A nil queue drops
+//everything
+type DeadLetterQueue struct {
+	lock  sync.Mutex
+	name  string
+	fh    *os.File
+	buf   *bufio.Writer
+	count uint64
+}
+
+//NewDeadLetterQueue returns nil if dir is empty
+func NewDeadLetterQueue(dir string, start time.Time) *DeadLetterQueue {
+	if dir == "" {
+		return nil
+	}
+	name := "deadletter-" + start.Format("20060102-150405") + ".ndjson"
+	return &DeadLetterQueue{name: filepath.Join(dir, name)}
+}
+
+//Write appends a rejected record
+func (dq *DeadLetterQueue) Write(dl DeadLetter) error {
+	if dq == nil {
+		return nil
+	}
+	data, err := json.Marshal(dl)
+	if err != nil {
+		return err
+	}
+	dq.lock.Lock()
+	defer dq.lock.Unlock()
+	if dq.fh == nil {
+		if err := os.MkdirAll(filepath.Dir(dq.name), 0755); err != nil {
+			return err
+		}
+		fh, err := os.Create(dq.name)
+		if err != nil {
+			return err
+		}
+		dq.fh = fh
+		dq.buf = bufio.NewWriterSize(fh, 64*1024)
+	}
+	dq.count++
+	if _, err := dq.buf.Write(data); err != nil {
+		return err
+	}
+	return dq.buf.WriteByte('\n')
+}
+
+//Name returns the queue file name
+func (dq *DeadLetterQueue) Name() string {
+	if dq == nil {
+		return ""
+	}
+	return dq.name
+}
+
+//Count returns the records written
+func (dq *DeadLetterQueue) Count() uint64 {
+	if dq == nil {
+		return 0
+	}
+	dq.lock.Lock()
+	defer dq.lock.Unlock()
+	return dq.count
+}
+
+//Close flushes and closes the file if one was written
+func (dq *DeadLetterQueue) Close() error {
+	if dq == nil {
+		return nil
+	}
+	dq.lock.Lock()
+	defer dq.lock.Unlock()
+	if dq.fh == nil {
+		return nil
+	}
+	err := dq.buf.Flush()
+	if cerr := dq.fh.Close(); err == nil {
+		err = cerr
+	}
+	dq.fh = nil
+	return err
+}
+
+//ReadDeadLetters calls fn for every record of a queue file, stopping at
+//the first error
+func ReadDeadLetters(r io.Reader, fn func(DeadLetter) error) error {
+	dec := json.NewDecoder(r)
+	for {
+		var dl DeadLetter
+		if err := dec.Decode(&dl); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if err := fn(dl); err != nil {
+			return err
+		}
+	}
+}
+
+//WriteReplayInput writes the records of the queue files accepted by keep
+//into dir as json lines, one file per source file named <source>.ndjson.
+//scaleTime is passed to ReplayLine. dir must be new or empty, no file
+//is replaced. Returns the number of records written
+func WriteReplayInput(queues []string, dir string, keep func(DeadLetter) bool, scaleTime bool) (int, error) {
+	if names, err := ioutil.ReadDir(dir); err == nil && len(names) > 0 {
+		return 0, ErrorReplayDir
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return 0, err
+	}
+	type replayFile struct {
+		fh  *os.File
+		buf *bufio.Writer
+	}
+	files := make(map[string]*replayFile)
+	closeAll := func(err error) error {
+		for _, rf := range files {
+			if ferr := rf.buf.Flush(); err == nil {
+				err = ferr
+			}
+			if cerr := rf.fh.Close(); err == nil {
+				err = cerr
+			}
+		}
+		return err
+	}
+	written := 0
+	write := func(dl DeadLetter) error {
+		if !keep(dl) {
+			return nil
+		}
+		line, err := dl.ReplayLine(scaleTime)
+		if err != nil {
+			return err
+		}
+		source := filepath.Base(dl.File)
+		rf, ok := files[source]
+		if !ok {
+			fh, err := os.OpenFile(filepath.Join(dir, source+".ndjson"), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+			if err != nil {
+				return err
+			}
+			rf = &replayFile{fh, bufio.NewWriter(fh)}
+			files[source] = rf
+		}
+		if _, err := rf.buf.Write(line); err != nil {
+			return err
+		}
+		written++
+		return rf.buf.WriteByte('\n')
+	}
+	for _, q := range queues {
+		fh, err := os.Open(q)
+		if err != nil {
+			return written, closeAll(err)
+		}
+		err = ReadDeadLetters(fh, write)
+		fh.Close()
+		if err != nil {
+			return written, closeAll(fmt.Errorf("Error reading dead letters %s: %s", q, err))
+		}
+	}
+	return written, closeAll(nil)
+}
@@ -0,0 +1,130 @@
+package trapyz
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/bamarb/aws-pipeline-go/pkg/input"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeadLetterQueue(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "deadletter")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	var none *DeadLetterQueue
+	assert.Nil(NewDeadLetterQueue("", time.Now()))
+	assert.Nil(none.Write(DeadLetter{}))
+	assert.Nil(none.Close())
+	assert.Equal(uint64(0), none.Count())
+
+	start := time.Date(2018, 9, 6, 1, 30, 0, 0, time.UTC)
+	clean := NewDeadLetterQueue(filepath.Join(dir, "clean"), start)
+	assert.Nil(clean.Close())
+	_, err = os.Stat(clean.Name())
+	assert.True(os.IsNotExist(err), "no file without rejects")
+
+	dq := NewDeadLetterQueue(filepath.Join(dir, "dl"), start)
+	assert.Equal(filepath.Join(dir, "dl", "deadletter-20180906-013000.ndjson"), dq.Name())
+	written := []DeadLetter{
+		{File: "a.json", Line: 1, Class: "parse", Reason: "unexpected end of JSON input", Worker: 0, Raw: `{"gid":`},
+		{File: "a.json", Line: 2, Class: "lookup", Reason: "Unknown apikey", Worker: 1, Raw: `{"gid":"g1"}`},
+		{File: "b.csv", Line: 3, Class: "lookup", Reason: "Unknown apikey", Worker: 2, Raw: "g2,1,2",
+			Record: map[string]interface{}{"gid": "g2", "lat": "1", "lng": "2"}},
+	}
+	for _, dl := range written {
+		assert.Nil(dq.Write(dl))
+	}
+	assert.Nil(dq.Close())
+	assert.Equal(uint64(3), dq.Count())
+
+	fh, err := os.Open(dq.Name())
+	assert.Nil(err)
+	var read []DeadLetter
+	assert.Nil(ReadDeadLetters(fh, func(dl DeadLetter) error {
+		read = append(read, dl)
+		return nil
+	}))
+	fh.Close()
+	assert.Equal(written, read)
+
+	replayDir := filepath.Join(dir, "replay")
+	n, err := WriteReplayInput([]string{dq.Name()}, replayDir, func(dl DeadLetter) bool {
+		return dl.Class == ErrorLookup.String()
+	}, false)
+	assert.Nil(err)
+	assert.Equal(2, n)
+	data, err := ioutil.ReadFile(filepath.Join(replayDir, "a.json.ndjson"))
+	assert.Nil(err)
+	assert.Equal("{\"gid\":\"g1\"}\n", string(data))
+	data, err = ioutil.ReadFile(filepath.Join(replayDir, "b.csv.ndjson"))
+	assert.Nil(err)
+	assert.Equal("{\"gid\":\"g2\",\"lat\":\"1\",\"lng\":\"2\"}\n", string(data))
+
+	//earlier replay input is never replaced
+	_, err = WriteReplayInput([]string{dq.Name()}, replayDir, func(DeadLetter) bool { return true }, false)
+	assert.Equal(ErrorReplayDir, err)
+	data, err = ioutil.ReadFile(filepath.Join(replayDir, "a.json.ndjson"))
+	assert.Nil(err)
+	assert.Equal("{\"gid\":\"g1\"}\n", string(data))
+
+	_, err = WriteReplayInput([]string{filepath.Join(dir, "missing.ndjson")}, filepath.Join(dir, "replay2"),
+		func(DeadLetter) bool { return true }, false)
+	assert.NotNil(err)
+}
+
+func TestReplayScaleTime(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "deadletter")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	//json lines in seconds and a csv row already in milliseconds
+	dq := NewDeadLetterQueue(dir, time.Now())
+	assert.Nil(dq.Write(DeadLetter{File: "a.json", Line: 1, Class: "lookup",
+		Raw: `{"apikey":"k","gid":"g1","lat":1,"lng":2,"createdAt":1536228000}`}))
+	assert.Nil(dq.Write(DeadLetter{File: "b.csv", Line: 2, Class: "lookup", Raw: "k,g2,1,2,1536228000123",
+		Record: map[string]interface{}{"apikey": "k", "gid": "g2", "lat": "1", "lng": "2",
+			"createdAt": float64(1536228000123)}}))
+	assert.Nil(dq.Close())
+	replayDir := filepath.Join(dir, "replay")
+	n, err := WriteReplayInput([]string{dq.Name()}, replayDir, func(DeadLetter) bool { return true }, true)
+	assert.Nil(err)
+	assert.Equal(2, n)
+
+	//the replay reads its json lines without scaling
+	cfg := &Config{Aws: map[string]AwsS3Info{"s3-dev": {ScaleTime: false}}}
+	gct := GeoLocCalcTask{Cfg: cfg}
+	want := map[string]string{"a.json.ndjson": "1536228000000", "b.csv.ndjson": "1536228000123"}
+	for file, createdAt := range want {
+		recs, err := input.Open(filepath.Join(replayDir, file), InputConfig(cfg))
+		assert.Nil(err)
+		rec, err := recs.Read()
+		assert.Nil(err)
+		recs.Close()
+		vars, ok := gct.convertJSONMap(rec, []string{"gid", "createdAt"}, gct.scaleTime(input.FormatNDJSON))
+		assert.True(ok)
+		assert.Equal(createdAt, vars["createdAt"], file)
+	}
+}
+
+func TestFileStats(t *testing.T) {
+	assert := assert.New(t)
+	_, numErr := strconv.ParseFloat("north", 64)
+	assert.Equal(ErrorValidation, matchErrorClass(numErr))
+	assert.Equal(ErrorLookup, matchErrorClass(ErrorUnknownAPIKey))
+
+	stats := FileStats{Lines: 5, Matched: 1, Duplicates: 1}
+	stats.Reject(ErrorParse)
+	stats.Reject(ErrorLookup)
+	stats.Reject(ErrorLookup)
+	assert.Equal("lines:5 matched:1 duplicates:1 parse_errors:1 validation_errors:0 lookup_errors:2", stats.String())
+	assert.Equal("validation", ErrorValidation.String())
+	assert.Equal("unknown", ErrorClass(9).String())
+}
@@ -0,0 +1,118 @@
+package trapyz
+
+import (
+	"container/list"
+	"math"
+	"strconv"
+	"time"
+)
+
+//Default dedup parameters
+const (
+	DefaultDedupPrecision = 4
+	DefaultDedupWindow    = time.Minute
+	DefaultDedupSize      = 100000
+)
+
+//Deduper drops pings resent by the SDKs. Two pings are duplicates when they
+//have the same gid, the same coordinates rounded to Precision decimals and
+//fall in the same time bucket. Keys are kept in an LRU bounded to Size
+//entries, a Deduper is not safe for concurrent use, use one per worker
+type Deduper struct {
+	precision int
+	window    int64
+	size      int
+	lru       *list.List
+	keys      map[string]*list.Element
+	//Dropped number of duplicates seen
+	Dropped uint64
+}
+
+//NewDeduper constructs a deduper, window is the time bucket size
+func NewDeduper(precision int, window time.Duration, size int) *Deduper {
+	w := int64(window / time.Millisecond)
+	if w <= 0 {
+		w = 1
+	}
+	return &Deduper{precision: precision, window: w, size: size,
+		lru: list.New(), keys: make(map[string]*list.Element)}
+}
+
+//DeduperFromConfig returns a deduper configured from the dedup
+//section, or nil if dedup is disabled
+func DeduperFromConfig(cfg *Config) (*Deduper, error) {
+	dcfg := cfg.Dedup
+	if !dcfg.Enabled {
+		return nil, nil
+	}
+	precision, window, size := DefaultDedupPrecision, DefaultDedupWindow, DefaultDedupSize
+	if dcfg.Precision > 0 {
+		precision = dcfg.Precision
+	}
+	if dcfg.Size > 0 {
+		size = dcfg.Size
+	}
+	if dcfg.Window != "" {
+		var err error
+		if window, err = time.ParseDuration(dcfg.Window); err != nil {
+			return nil, err
+		}
+	}
+	return NewDeduper(precision, window, size), nil
+}
+
+//Duplicate returns true if the ping was seen before, otherwise the ping
+//is remembered. A nil Deduper never reports duplicates
+func (d *Deduper) Duplicate(vars map[string]string) bool {
+	if d == nil {
+		return false
+	}
+	key, ok := d.key(vars)
+	if !ok {
+		return false
+	}
+	if el, ok := d.keys[key]; ok {
+		d.lru.MoveToFront(el)
+		d.Dropped++
+		return true
+	}
+	d.keys[key] = d.lru.PushFront(key)
+	if d.lru.Len() > d.size {
+		oldest := d.lru.Back()
+		d.lru.Remove(oldest)
+		delete(d.keys, oldest.Value.(string))
+	}
+	return false
+}
+
+//Len returns the number of remembered pings
+func (d *Deduper) Len() int {
+	return d.lru.Len()
+}
+
+func (d *Deduper) key(vars map[string]string) (string, bool) {
+	lat, err := strconv.ParseFloat(vars["lat"], 64)
+	if err != nil {
+		return "", false
+	}
+	lng, err := strconv.ParseFloat(vars["lng"], 64)
+	if err != nil {
+		return "", false
+	}
+	at, err := CreatedAtTime(vars["createdAt"])
+	if err != nil {
+		return "", false
+	}
+	bucket := at.UnixNano() / int64(time.Millisecond) / d.window
+	return vars["gid"] + "|" + roundCoord(lat, d.precision) + "," +
+		roundCoord(lng, d.precision) + "|" + strconv.FormatInt(bucket, 10), true
+}
+
+func roundCoord(v float64, precision int) string {
+	s := strconv.FormatFloat(v, 'f', precision, 64)
+	//avoid -0.0000 and 0.0000 being different keys
+	if math.Abs(v) < math.Pow(10, -float64(precision))/2 {
+		s = strconv.FormatFloat(0, 'f', precision, 64)
+	}
+	return s
+}
@@ -0,0 +1,30 @@
+package trapyz
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeduper(t *testing.T) {
+	assert := assert.New(t)
+	d := NewDeduper(4, time.Minute, 2)
+	p := func(gid, lat, lng, createdAt string) map[string]string {
+		return map[string]string{"gid": gid, "lat": lat, "lng": lng, "createdAt": createdAt}
+	}
+	assert.False(d.Duplicate(p("g1", "12.97161", "77.59461", "1536228000000")))
+	//same fix resent with noise below the precision in the same minute
+	assert.True(d.Duplicate(p("g1", "12.97162", "77.59459", "1536228030000")))
+	//next time bucket
+	assert.False(d.Duplicate(p("g1", "12.97161", "77.59461", "1536228060000")))
+	//other device
+	assert.False(d.Duplicate(p("g2", "12.97161", "77.59461", "1536228000000")))
+	assert.Equal(2, d.Len())
+	//g1's first key was evicted
+	assert.False(d.Duplicate(p("g1", "12.97161", "77.59461", "1536228000000")))
+	assert.Equal(uint64(1), d.Dropped)
+
+	var nilDedup *Deduper
+	assert.False(nilDedup.Duplicate(p("g1", "12.97161", "77.59461", "1536228000000")))
+}
@@ -0,0 +1,355 @@
+package trapyz
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/bamarb/aws-pipeline-go/pkg/hll"
+)
+
+//FootfallHourFormat the hour key of an aggregate
+const FootfallHourFormat = "2006-01-02T15"
+
+//FootfallDateFormat the day of the footfall day files
+const FootfallDateFormat = "2006-01-02"
+
+//footfallPrecision HLL precision of the per store hour device sketches,
+//about 3% error at 1KB each
+const footfallPrecision = 10
+
+//DistanceBuckets upper bounds in meters of the distance histogram
+//buckets, a final bucket holds everything beyond the last bound
+var DistanceBuckets = []int{25, 50, 100, 250, 500, 1000}
+
+//HourlyFootfall pings seen near a store within one hour. Devices are kept
+//as a HLL sketch and apikeys as a set so aggregates can be merged without
+//double counting. Window is the run window that counted the pings
+type HourlyFootfall struct {
+	UID       string
+	Hour      string
+	Window    string
+	Pings     int64
+	Devices   *hll.Sketch
+	Apikeys   map[string]bool
+	Histogram []int64
+}
+
+//footfallJSON the on disk form of HourlyFootfall, the device sketch and
+//apikey set are written alongside their counts
+type footfallJSON struct {
+	UID         string   `json:"uuid"`
+	Hour        string   `json:"hour"`
+	Window      string   `json:"window,omitempty"`
+	Pings       int64    `json:"pings"`
+	NumDevices  uint64   `json:"unique_devices"`
+	NumApikeys  int      `json:"unique_apikeys"`
+	Histogram   []int64  `json:"distance_histogram"`
+	DeviceHLL   []byte   `json:"devices_hll"`
+	ApikeyList  []string `json:"apikeys"`
+	BucketEdges []int    `json:"distance_buckets"`
+}
+
+func newHourlyFootfall(uid, hour string) *HourlyFootfall {
+	devices, _ := hll.New(footfallPrecision)
+	return &HourlyFootfall{UID: uid, Hour: hour, Devices: devices,
+		Apikeys: make(map[string]bool), Histogram: make([]int64, len(DistanceBuckets)+1)}
+}
+
+//MarshalJSON writes the aggregate with its unique counts
+func (hf *HourlyFootfall) MarshalJSON() ([]byte, error) {
+	devices, err := hf.Devices.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(footfallJSON{UID: hf.UID, Hour: hf.Hour, Window: hf.Window, Pings: hf.Pings,
+		NumDevices: hf.Devices.Count(), NumApikeys: len(hf.Apikeys), Histogram: hf.Histogram,
+		DeviceHLL: devices, ApikeyList: sortedKeys(hf.Apikeys), BucketEdges: DistanceBuckets})
+}
+
+//UnmarshalJSON reads an aggregate written by MarshalJSON
+func (hf *HourlyFootfall) UnmarshalJSON(data []byte) error {
+	var fj footfallJSON
+	if err := json.Unmarshal(data, &fj); err != nil {
+		return err
+	}
+	*hf = *newHourlyFootfall(fj.UID, fj.Hour)
+	hf.Window = fj.Window
+	hf.Pings = fj.Pings
+	if err := hf.Devices.UnmarshalBinary(fj.DeviceHLL); err != nil {
+		return err
+	}
+	for _, a := range fj.ApikeyList {
+		hf.Apikeys[a] = true
+	}
+	for i, n := range fj.Histogram {
+		if i < len(hf.Histogram) {
+			hf.Histogram[i] += n
+		} else {
+			hf.Histogram[len(hf.Histogram)-1] += n
+		}
+	}
+	return nil
+}
+
+//Merge adds the counts of other into hf
+func (hf *HourlyFootfall) Merge(other *HourlyFootfall) {
+	hf.Pings += other.Pings
+	hf.Devices.Merge(other.Devices)
+	for a := range other.Apikeys {
+		hf.Apikeys[a] = true
+	}
+	for i, n := range other.Histogram {
+		hf.Histogram[i] += n
+	}
+}
+
+func distanceBucket(dist int) int {
+	return sort.SearchInts(DistanceBuckets, dist)
+}
+
+//Footfall per store, per hour aggregates. It is not safe for concurrent
+//use, aggregate per worker and Merge the results
+type Footfall struct {
+	hours map[string]*HourlyFootfall
+}
+
+//NewFootfall constructs an empty aggregation
+func NewFootfall() *Footfall {
+	return &Footfall{hours: make(map[string]*HourlyFootfall)}
+}
+
+func footfallKey(uid, hour string) string {
+	return uid + "|" + hour
+}
+
+func (ff *Footfall) get(uid, hour string) *HourlyFootfall {
+	key := footfallKey(uid, hour)
+	hf, ok := ff.hours[key]
+	if !ok {
+		hf = newHourlyFootfall(uid, hour)
+		ff.hours[key] = hf
+	}
+	return hf
+}
+
+//Add counts a matched ping against its store and hour
+func (ff *Footfall) Add(rec GeoLocOutput) {
+	at, err := CreatedAtTime(rec.Createdat)
+	if err != nil || rec.UID == "" {
+		return
+	}
+	hf := ff.get(rec.UID, at.UTC().Format(FootfallHourFormat))
+	hf.Pings++
+	hf.Devices.AddString(rec.Gid)
+	hf.Apikeys[rec.Apikey.String()] = true
+	hf.Histogram[distanceBucket(rec.Distance)]++
+}
+
+//Merge adds all aggregates of other into ff
+func (ff *Footfall) Merge(other *Footfall) {
+	for _, hf := range other.hours {
+		ff.get(hf.UID, hf.Hour).Merge(hf)
+	}
+}
+
+//Len returns the number of store hours
+func (ff *Footfall) Len() int {
+	return len(ff.hours)
+}
+
+//Get returns the aggregate of a store hour, nil if there were no pings
+func (ff *Footfall) Get(uid string, hour time.Time) *HourlyFootfall {
+	return ff.hours[footfallKey(uid, hour.UTC().Format(FootfallHourFormat))]
+}
+
+//Hours returns the store hour aggregates ordered by store and hour
+func (ff *Footfall) Hours() []*HourlyFootfall {
+	keys := make([]string, 0, len(ff.hours))
+	for k := range ff.hours {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	hours := make([]*HourlyFootfall, len(keys))
+	for i, k := range keys {
+		hours[i] = ff.hours[k]
+	}
+	return hours
+}
+
+//Encode writes one json line per store hour ordered by store and hour
+func (ff *Footfall) Encode(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	for _, hf := range ff.Hours() {
+		if err := enc.Encode(hf); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+//DecodeFootfall reads aggregates written by Encode
+func DecodeFootfall(r io.Reader) (*Footfall, error) {
+	ff := NewFootfall()
+	dec := json.NewDecoder(r)
+	for {
+		hf := &HourlyFootfall{}
+		if err := dec.Decode(hf); err == io.EOF {
+			return ff, nil
+		} else if err != nil {
+			return nil, err
+		}
+		ff.get(hf.UID, hf.Hour).Merge(hf)
+	}
+}
+
+//FootfallWindow returns the window key of the aggregates of a run
+func FootfallWindow(from, to time.Time) string {
+	return from.UTC().Format(FootfallHourFormat) + "_" + to.UTC().Format(FootfallHourFormat)
+}
+
+//FootfallDayFile returns the file of the aggregates of a day, the day is
+//added to the name ahead of the extension
+func FootfallDayFile(file, day string) string {
+	ext := filepath.Ext(file)
+	return strings.TrimSuffix(file, ext) + "-" + day + ext
+}
+
+//MergeFootfallFiles merges the aggregates counted by the run window into
+//one file per day, replacing the aggregates of an earlier run of the same
+//window so re-runs don't double count. Returns the day files written
+func MergeFootfallFiles(file, window string, ff *Footfall) ([]string, error) {
+	days := make(map[string][]*HourlyFootfall)
+	for _, hf := range ff.Hours() {
+		day := hf.Hour[:len(FootfallDateFormat)]
+		days[day] = append(days[day], hf)
+	}
+	var files []string
+	for day, hours := range days {
+		dayFile := FootfallDayFile(file, day)
+		if err := mergeFootfallDay(dayFile, window, hours); err != nil {
+			return files, err
+		}
+		files = append(files, dayFile)
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+//mergeFootfallDay replaces the aggregates of the window in the day file
+//with hours and replaces the file atomically
+func mergeFootfallDay(file, window string, hours []*HourlyFootfall) error {
+	var kept []*HourlyFootfall
+	if fh, err := os.Open(file); err == nil {
+		dec := json.NewDecoder(fh)
+		for {
+			hf := &HourlyFootfall{}
+			if err = dec.Decode(hf); err != nil {
+				break
+			}
+			if hf.Window != window {
+				kept = append(kept, hf)
+			}
+		}
+		fh.Close()
+		if err != io.EOF {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	for _, hf := range hours {
+		whf := *hf
+		whf.Window = window
+		kept = append(kept, &whf)
+	}
+	sort.Slice(kept, func(i, j int) bool {
+		a, b := kept[i], kept[j]
+		if a.UID != b.UID {
+			return a.UID < b.UID
+		}
+		if a.Hour != b.Hour {
+			return a.Hour < b.Hour
+		}
+		return a.Window < b.Window
+	})
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+	tmp := file + ".tmp"
+	fh, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(fh)
+	enc := json.NewEncoder(bw)
+	for _, hf := range kept {
+		if err = enc.Encode(hf); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = bw.Flush()
+	}
+	if cerr := fh.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+//ReadFootfallFile reads a day file, the aggregates of all windows are
+//merged per store hour
+func ReadFootfallFile(file string) (*Footfall, error) {
+	fh, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+	return DecodeFootfall(fh)
+}
+
+//ExpireFootfallFiles removes the day files of days more than keepDays
+//before now and returns them, keepDays 0 keeps every day
+func ExpireFootfallFiles(file string, keepDays int, now time.Time) ([]string, error) {
+	if keepDays <= 0 {
+		return nil, nil
+	}
+	ext := filepath.Ext(file)
+	prefix := strings.TrimSuffix(file, ext) + "-"
+	matches, err := filepath.Glob(prefix + "*" + ext)
+	if err != nil {
+		return nil, err
+	}
+	oldest := now.UTC().AddDate(0, 0, -keepDays).Format(FootfallDateFormat)
+	var removed []string
+	for _, m := range matches {
+		day := strings.TrimSuffix(strings.TrimPrefix(m, prefix), ext)
+		if _, err := time.Parse(FootfallDateFormat, day); err != nil || day >= oldest {
+			continue
+		}
+		if err := os.Remove(m); err != nil {
+			return removed, err
+		}
+		removed = append(removed, m)
+	}
+	return removed, nil
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,89 @@
+package trapyz
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func footfallPing(gid, uid string, apikey APIKeyID, at time.Duration, dist int) GeoLocOutput {
+	rec := ping(gid, uid, at, dist)
+	rec.Apikey = apikey
+	return rec
+}
+
+func TestFootfall(t *testing.T) {
+	assert := assert.New(t)
+	w1, w2 := NewFootfall(), NewFootfall()
+	w1.Add(footfallPing("g1", "s1", 1, 5*time.Minute, 10))
+	w1.Add(footfallPing("g1", "s1", 1, 10*time.Minute, 60))
+	w1.Add(footfallPing("g2", "s1", 2, 70*time.Minute, 2000))
+	w2.Add(footfallPing("g1", "s1", 1, 20*time.Minute, 25))
+	w2.Add(footfallPing("g3", "s1", 1, 30*time.Minute, 300))
+	w2.Add(footfallPing("g3", "s2", 1, 30*time.Minute, 300))
+	w1.Merge(w2)
+	assert.Equal(3, w1.Len())
+
+	hf := w1.Get("s1", visitStart)
+	assert.Equal(int64(4), hf.Pings)
+	assert.Equal(uint64(2), hf.Devices.Count())
+	assert.Len(hf.Apikeys, 1)
+	assert.Equal([]int64{2, 0, 1, 0, 1, 0, 0}, hf.Histogram)
+	assert.Equal(int64(1), w1.Get("s1", visitStart.Add(time.Hour)).Histogram[6])
+	assert.Nil(w1.Get("s2", visitStart.Add(time.Hour)))
+
+	var buf bytes.Buffer
+	assert.Nil(w1.Encode(&buf))
+	decoded, err := DecodeFootfall(&buf)
+	assert.Nil(err)
+	assert.Equal(w1, decoded)
+}
+
+func TestMergeFootfallFiles(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "footfall")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "footfall.out")
+	w1 := FootfallWindow(visitStart, visitStart.Add(time.Hour))
+	w2 := FootfallWindow(visitStart.Add(time.Hour), visitStart.Add(2*time.Hour))
+
+	run1, run2 := NewFootfall(), NewFootfall()
+	run1.Add(footfallPing("g1", "s1", 1, 5*time.Minute, 10))
+	//a late ping of the first hour read by the next window
+	run2.Add(footfallPing("g1", "s1", 1, 50*time.Minute, 10))
+	run2.Add(footfallPing("g2", "s1", 1, 55*time.Minute, 10))
+	run2.Add(footfallPing("g2", "s1", 1, 24*time.Hour, 10))
+	files, err := MergeFootfallFiles(file, w1, run1)
+	assert.Nil(err)
+	assert.Equal([]string{filepath.Join(dir, "footfall-2018-09-06.out")}, files)
+	files, err = MergeFootfallFiles(file, w2, run2)
+	assert.Nil(err)
+	assert.Len(files, 2)
+	//a re-run of the first window replaces its aggregates
+	_, err = MergeFootfallFiles(file, w1, run1)
+	assert.Nil(err)
+
+	merged, err := ReadFootfallFile(files[0])
+	assert.Nil(err)
+	hf := merged.Get("s1", visitStart)
+	assert.Equal(int64(3), hf.Pings)
+	assert.Equal(uint64(2), hf.Devices.Count())
+	next, err := ReadFootfallFile(files[1])
+	assert.Nil(err)
+	assert.Equal(1, next.Len())
+
+	removed, err := ExpireFootfallFiles(file, 1, visitStart.Add(48*time.Hour))
+	assert.Nil(err)
+	assert.Equal(files[:1], removed)
+	_, err = os.Stat(files[1])
+	assert.Nil(err)
+	removed, err = ExpireFootfallFiles(file, 0, visitStart.Add(480*time.Hour))
+	assert.Nil(err)
+	assert.Empty(removed)
+}
@@ -1,18 +1,25 @@
 package trapyz
 
 import (
-	"bufio"
-	"encoding/json"
+	"context"
+	"io"
 	"io/ioutil"
-	"os"
+	"math"
 	"path"
 	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/bamarb/aws-pipeline-go/pkg/geomath"
 	"github.com/bamarb/aws-pipeline-go/pkg/geostore"
+	"github.com/bamarb/aws-pipeline-go/pkg/input"
+	"github.com/bamarb/aws-pipeline-go/pkg/metrics"
 	"github.com/bamarb/aws-pipeline-go/pkg/task"
+	"github.com/bamarb/aws-pipeline-go/pkg/tracing"
 	radix "github.com/mediocregopher/radix.v3"
 	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 // GeoLocCalcTask calculates the Geolocation for a bunch of files
@@ -33,6 +40,18 @@ type GeoLocCalcTask struct {
 	Wg *sync.WaitGroup
 	//worker id
 	ID int
+	//default radius in meters parsed from config
+	Radius float64
+	//GPS quality filter shared by all workers
+	Filter *PingFilter
+	//Duplicates dropped by all workers
+	Dropped *uint64
+	//Rejected records of all workers
+	DeadLetters *DeadLetterQueue
+	//Run report, may be nil
+	Report *RunReport
+	//Parent of the per file spans, background if nil
+	Ctx context.Context
 }
 
 //Task calculates the geo distances from a store
@@ -41,45 +60,108 @@ func (gct GeoLocCalcTask) Task() {
 	indexKey := gct.Cfg.RedisCacheKey
 	store := geostore.NewGeoLocationStore(gct.RedisPool)
 	requiredJSONKeys := []string{"apikey", "gid", "lat", "lng", "createdAt"}
+	//dedup spans all the files this worker processes
+	//the config is validated in FillGeoStores
+	dedup, _ := DeduperFromConfig(gct.Cfg)
+	inputCfg := InputConfig(gct.Cfg)
+	ctx := gct.Ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
 	for file := range gct.Inchan {
-		var lineCount, errorCount uint
+		var stats FileStats
+		var queries QueryStats
 		absFile := path.Join(gct.Cfg.Inputdir, file)
 		log.Debugf("Worker %d processing file %s", gct.ID, absFile)
-		fh, err := os.OpenFile(path.Join(absFile), os.O_RDONLY, 0644)
+		_, span := tracing.Start(ctx, "geocalc.file", attribute.String("file", file),
+			attribute.Int("worker", gct.ID))
+		records, err := input.Open(absFile, inputCfg)
 		if err != nil {
 			log.Errorf("Worker %d Error opening data file %s: %s", gct.ID, absFile, err)
-			errorCount++
+			tracing.End(span, err)
 			continue
 		}
+		//only records that are not json lines are kept in normalized form
+		keepRecord := inputCfg.FormatOf(file) != input.FormatNDJSON
+		scaleTime := gct.scaleTime(inputCfg.FormatOf(file))
+		reject := func(class ErrorClass, reason string, rec input.Record) {
+			stats.Reject(class)
+			gct.Report.Reject(class, reason)
+			metrics.RecordsRejected.WithLabelValues(class.String()).Inc()
+			dl := DeadLetter{File: file, Line: records.Line(), Class: class.String(),
+				Reason: reason, Worker: gct.ID, Raw: string(records.Raw())}
+			if keepRecord {
+				dl.Record = rec
+			}
+			if err := gct.DeadLetters.Write(dl); err != nil {
+				log.Errorf("Worker %d Error writing dead letter %s: %s", gct.ID, gct.DeadLetters.Name(), err)
+			}
+		}
 
-		scanner := bufio.NewScanner(fh)
-		for scanner.Scan() {
-			var jsonMap map[string]interface{}
-			json.Unmarshal(scanner.Bytes(), &jsonMap)
-			parsedMap, ok := gct.convertJSONMap(jsonMap, requiredJSONKeys)
+		for {
+			rec, err := records.Read()
+			if err == io.EOF {
+				break
+			}
+			stats.Lines++
+			if err != nil {
+				if re, ok := err.(*input.RecordError); ok {
+					reject(ErrorParse, re.Err.Error(), nil)
+					continue
+				}
+				reject(ErrorParse, err.Error(), nil)
+				log.Errorf("Worker %d Error reading data file %s: %s", gct.ID, absFile, err)
+				break
+			}
+			parsedMap, ok := gct.convertJSONMap(rec, requiredJSONKeys, scaleTime)
 			if !ok {
-				//log.Errorf("Error Keys Missing:%s", scanner.Text())
-				errorCount++
+				reject(ErrorValidation, "missing_keys", rec)
 				continue
 			}
-			if !gct.InputValid(parsedMap) {
-				//log.Errorf("Error NULL/invalid values:%s", scanner.Text())
-				errorCount++
+			if reason := gct.Filter.Check(parsedMap); reason != RejectNone {
+				reject(ErrorValidation, reason.String(), rec)
+				continue
+			}
+			if dedup.Duplicate(parsedMap) {
+				stats.Duplicates++
 				continue
 			}
 
-			err = gct.OutputToWriter(parsedMap, store, indexKey)
-			if err != nil {
-				errorCount++
+			if err := gct.OutputToWriter(&queries, parsedMap, store, indexKey); err != nil {
+				reject(matchErrorClass(err), err.Error(), rec)
+				continue
 			}
-			lineCount++
+			stats.Matched++
+		}
+		records.Close()
+		if gct.Dropped != nil {
+			atomic.AddUint64(gct.Dropped, uint64(stats.Duplicates))
 		}
-		fh.Close()
-		log.Infof("Worker %d processed file:%s records:%d errors:%d", gct.ID, file, lineCount, errorCount)
+		gct.Report.AddFile(stats)
+		metrics.RecordsRead.Add(float64(stats.Lines))
+		metrics.RecordsMatched.Add(float64(stats.Matched))
+		span.SetAttributes(attribute.Int("lines", int(stats.Lines)), attribute.Int("matched", int(stats.Matched)),
+			attribute.Int("duplicates", int(stats.Duplicates)), attribute.Int("parse_errors", int(stats.Errors[ErrorParse])),
+			attribute.Int("validation_errors", int(stats.Errors[ErrorValidation])),
+			attribute.Int("lookup_errors", int(stats.Errors[ErrorLookup])))
+		span.SetAttributes(queries.Attributes()...)
+		span.End()
+		log.Infof("Worker %d processed file:%s %s", gct.ID, file, stats)
 	}
 }
 
-func (gct GeoLocCalcTask) convertJSONMap(jmap map[string]interface{}, requiredKeys []string) (map[string]string, bool) {
+//scaleTime returns true if createdAt of the input format is scaled from
+//seconds, scale_time applies to json lines only since the csv and
+//Parquet readers emit milliseconds
+func (gct GeoLocCalcTask) scaleTime(format string) bool {
+	return format == input.FormatNDJSON && gct.Cfg.Aws[CfgKey(gct.Cfg, "s3")].ScaleTime
+}
+
+//convertJSONMap returns the required keys of a record as strings, false
+//if one is missing. scaleTime converts a createdAt in seconds to
+//milliseconds
+func (gct GeoLocCalcTask) convertJSONMap(jmap map[string]interface{}, requiredKeys []string,
+	scaleTime bool) (map[string]string, bool) {
 	retMap := make(map[string]string)
 	awsCfgInfo := gct.Cfg.Aws[CfgKey(gct.Cfg, "s3")]
 	if awsCfgInfo.Apikey != "" {
@@ -90,7 +172,7 @@ func (gct GeoLocCalcTask) convertJSONMap(jmap map[string]interface{}, requiredKe
 		if _, ok := jmap[rkey]; !ok {
 			return nil, false
 		}
-		if rkey == "createdAt" && awsCfgInfo.ScaleTime {
+		if rkey == "createdAt" && scaleTime {
 			createdAtInt, ok := jmap[rkey].(float64)
 			if !ok {
 				log.Errorf("Error converting created At to int got:[%s]", jmap[rkey])
@@ -101,23 +183,35 @@ func (gct GeoLocCalcTask) convertJSONMap(jmap map[string]interface{}, requiredKe
 			retMap[rkey] = valToString(jmap[rkey])
 		}
 	}
+	//Optional fields used by the ping filter
+	if accKey := gct.Cfg.Filter.AccuracyKey; accKey != "" {
+		if acc, ok := jmap[accKey]; ok {
+			retMap["accuracy"] = valToString(acc)
+		}
+	}
 
 	return retMap, true
 }
 
-//InputValid input reject invalid gids, lat, lng
-func (gct GeoLocCalcTask) InputValid(vars map[string]string) bool {
-	//TODO: use regexp for gid lat and lng
-	if vars["gid"] == "" || vars["gid"] == "NULL" {
-		return false
-	}
-	if vars["lat"] == "" || vars["lat"] == "NULL" {
-		return false
+//InputConfig returns the input reader config
+func InputConfig(cfg *Config) input.Config {
+	return input.Config{
+		Format:   cfg.Input.Format,
+		Prefixes: cfg.Input.Prefixes,
+		CSV: input.CSVConfig{
+			Delimiter: cfg.Input.CSV.Delimiter,
+			Columns:   cfg.Input.CSV.Columns,
+			Mapping:   cfg.Input.CSV.Mapping,
+		},
+		AccuracyKey:  cfg.Filter.AccuracyKey,
+		MaxLineBytes: cfg.Input.MaxLineBytes,
 	}
-	if vars["lng"] == "" || vars["lng"] == "NULL" {
-		return false
-	}
-	return true
+}
+
+//InputValid input reject empty or NULL gids, lat, lng.
+//See PingFilter for the full set of checks
+func (gct GeoLocCalcTask) InputValid(vars map[string]string) bool {
+	return !isNull(vars["gid"]) && !isNull(vars["lat"]) && !isNull(vars["lng"])
 }
 
 func valToString(v interface{}) string {
@@ -144,60 +238,174 @@ func valToString(v interface{}) string {
 }
 
 func validateGeoLoc(geoloc *GeoLocOutput) bool {
-	if geoloc.City == "" || geoloc.Pin == "" || geoloc.Cat == "" || geoloc.Subcat == "" {
-		return false
+	return geoloc.City.Known() && geoloc.Pin.Known() && geoloc.Cat.Known() &&
+		geoloc.Subcat.Known() && geoloc.Apikey.Known()
+}
+
+//searchSlack widens the redis search so stores whose geohash distance
+//is a little over the radius still reach the exact distance check
+const searchSlack = 1.01
+
+//QueryStats latency of the redis nearby queries of an input file. It is
+//recorded on the file span, a span per query would swamp the exporter
+type QueryStats struct {
+	Count  int
+	Errors int
+	Total  time.Duration
+	Max    time.Duration
+}
+
+//Observe adds a query, a nil QueryStats records nothing
+func (qs *QueryStats) Observe(took time.Duration, err error) {
+	if qs == nil {
+		return
+	}
+	qs.Count++
+	if err != nil {
+		qs.Errors++
+	}
+	qs.Total += took
+	if took > qs.Max {
+		qs.Max = took
 	}
-	return true
 }
 
-//OutputToWriter outputs the filled GeoLocOutput struct to the writer
-func (gct GeoLocCalcTask) OutputToWriter(vars map[string]string, store geostore.GeoLocationStore, indexKey string) error {
+//Attributes returns the query counts and latencies in milliseconds as
+//span attributes
+func (qs *QueryStats) Attributes() []attribute.KeyValue {
+	var avg float64
+	if qs.Count > 0 {
+		avg = millis(qs.Total) / float64(qs.Count)
+	}
+	return []attribute.KeyValue{attribute.Int("redis.queries", qs.Count),
+		attribute.Int("redis.errors", qs.Errors), attribute.Float64("redis.total_ms", millis(qs.Total)),
+		attribute.Float64("redis.avg_ms", avg), attribute.Float64("redis.max_ms", millis(qs.Max))}
+}
+
+func millis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+//OutputToWriter outputs the filled GeoLocOutput struct to the writer,
+//the nearby query is counted in queries
+func (gct GeoLocCalcTask) OutputToWriter(queries *QueryStats, vars map[string]string,
+	store geostore.GeoLocationStore, indexKey string) error {
 	var lat = vars["lat"]
 	var lng = vars["lng"]
 	var apik = vars["apikey"]
 	var cat = vars["createdAt"]
 	var gid = vars["gid"]
-	radius, _ := strconv.Atoi(gct.Cfg.Radius)
-	nearbyStores, err := store.NearbyWithDist(indexKey, lat, lng, gct.Cfg.Radius)
+	flat, err := strconv.ParseFloat(lat, 64)
+	if err != nil {
+		return err
+	}
+	flng, err := strconv.ParseFloat(lng, 64)
+	if err != nil {
+		return err
+	}
+	ping := geomath.Point{Lat: flat, Lng: flng}
+	queryStart := time.Now()
+	nearbyStores, err := gct.nearby(store, indexKey, lat, lng)
+	took := time.Since(queryStart)
+	metrics.RedisQueryDuration.Observe(took.Seconds())
+	queries.Observe(took, err)
 	if err != nil {
+		metrics.RedisQueryErrors.Inc()
 		log.Errorf("Error Redis nearby-query: %s", err)
 		return err
 	}
-	apiID := strconv.Itoa(gct.Cache.APIKeyMap[apik])
+	apiID := gct.Cache.APIKeyMap[apik]
+	if !apiID.Known() {
+		return ErrorUnknownAPIKey
+	}
 	for _, store := range nearbyStores {
-		distRounded := int(store.Distance)
-		if distRounded < radius {
-			template, ok := gct.Cache.LocCache[store.LocID]
-			if !ok {
-				continue
-			}
-			out := GeoLocOutput{
-				UID:       store.LocID,
-				Sname:     template.Sname,
-				Cat:       template.Cat,
-				Subcat:    template.Subcat,
-				City:      template.City,
-				Pin:       template.Pin,
-				Apikey:    apiID,
-				Lat:       lat,
-				Lng:       lng,
-				Gid:       gid,
-				Distance:  distRounded,
-				Createdat: cat,
-			}
-			if validateGeoLoc(&out) {
-				gct.Outchan <- out
-			}
+		dist := store.Distance
+		if loc, ok := gct.Cache.StoreLoc[store.LocID]; ok {
+			dist = geomath.Haversine(ping, loc)
+		}
+		if !gct.inFence(store.LocID, dist, ping) {
+			continue
+		}
+		template, ok := gct.Cache.LocCache[store.LocID]
+		if !ok {
+			continue
+		}
+		out := GeoLocOutput{
+			UID:       store.LocID,
+			Sname:     template.Sname,
+			Cat:       template.Cat,
+			Subcat:    template.Subcat,
+			City:      template.City,
+			Pin:       template.Pin,
+			Apikey:    apiID,
+			Lat:       lat,
+			Lng:       lng,
+			Gid:       gid,
+			Distance:  int(math.Round(dist)),
+			Createdat: cat,
+		}
+		if validateGeoLoc(&out) {
+			gct.Outchan <- out
 		}
 	}
 	return nil
 }
 
-//FillGeoStores fills nearby stores based on Lat,Long data
-func FillGeoStores(config *Config, cache *Cache, redisPool *radix.Pool,
+//nearby returns the stores near the point. The redis search is a coarse
+//filter, the exact fence test is applied per store. The index of all
+//stores is searched with the default radius, stores with fences reaching
+//further are searched in the wide index with the largest reach
+func (gct GeoLocCalcTask) nearby(store geostore.GeoLocationStore, indexKey, lat, lng string) ([]geostore.GeoRadiusDistInfo, error) {
+	stores, err := store.NearbyWithDist(indexKey, lat, lng,
+		strconv.FormatFloat(gct.Radius*searchSlack, 'f', 2, 64))
+	if err != nil || gct.Cache.MaxReach <= gct.Radius {
+		return stores, err
+	}
+	wide, err := store.NearbyAllWithDist(WideIndexKey(indexKey), lat, lng,
+		strconv.FormatFloat(gct.Cache.MaxReach*searchSlack, 'f', 2, 64))
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool, len(stores))
+	for _, s := range stores {
+		seen[s.LocID] = true
+	}
+	for _, s := range wide {
+		if !seen[s.LocID] {
+			stores = append(stores, s)
+		}
+	}
+	return stores, nil
+}
+
+//inFence checks a nearby store against its geofence. Stores with a polygon
+//match when the point lies inside it, others match within their own radius
+//or the configured default radius
+func (gct GeoLocCalcTask) inFence(storeID string, dist float64, ping geomath.Point) bool {
+	fence, ok := gct.Cache.Fences[storeID]
+	if !ok {
+		return dist < gct.Radius
+	}
+	if fence.IsPolygon() {
+		return fence.Polygon.Contains(ping)
+	}
+	if fence.Radius > 0 {
+		return dist < fence.Radius
+	}
+	return dist < gct.Radius
+}
+
+//FillGeoStores fills nearby stores based on Lat,Long data. Input
+//accounting goes to the run report of ctx, if any
+func FillGeoStores(ctx context.Context, config *Config, cache *Cache, redisPool *radix.Pool,
 	taskPool *task.Pool, outchan chan GeoLocOutput) *sync.WaitGroup {
+	return FillGeoStoresFrom(ctx, FindOrCreateDestDir(config), config, cache, redisPool, taskPool, outchan)
+}
+
+//FillGeoStoresFrom fills nearby stores from the files in inputDir
+func FillGeoStoresFrom(ctx context.Context, inputDir string, config *Config, cache *Cache,
+	redisPool *radix.Pool, taskPool *task.Pool, outchan chan GeoLocOutput) *sync.WaitGroup {
 	var wg sync.WaitGroup
-	inputDir := FindOrCreateDestDir(config)
 	config.Inputdir = inputDir
 	filesToProcess, err := ioutil.ReadDir(inputDir)
 	if err != nil {
@@ -206,26 +414,71 @@ func FillGeoStores(config *Config, cache *Cache, redisPool *radix.Pool,
 	if len(filesToProcess) == 0 {
 		return &wg
 	}
+	radius, err := ParseRadius(config.Radius)
+	if err != nil {
+		log.Fatalf("Invalid radius [%s]: %s", config.Radius, err)
+	}
+	filter, err := NewPingFilter(config.Filter)
+	if err != nil {
+		log.Fatalf("Invalid filter config: %s", err)
+	}
+	if _, err := DeduperFromConfig(config); err != nil {
+		log.Fatalf("Invalid dedup config: %s", err)
+	}
+	if err := InputConfig(config).Validate(); err != nil {
+		log.Fatalf("Invalid input config: %s", err)
+	}
 	inChan := make(chan string)
 	var nw = 4
 	if config.Nworkers > 0 {
 		nw = config.Nworkers
 	}
+	ctx, span := tracing.Start(ctx, "geocalc.fill", attribute.Int("files", len(filesToProcess)),
+		attribute.Int("workers", nw))
+	//the files are handed over one at a time, the ones not yet sent are
+	//the backlog of the workers
+	metrics.InputFilesPending.Set(float64(len(filesToProcess)))
 	go func() {
 		for _, file := range filesToProcess {
 			inChan <- file.Name()
+			metrics.InputFilesPending.Dec()
 		}
 		close(inChan)
 	}()
-	wg.Add(nw)
+	//workers signal on their own wait group so the filter
+	//counts can be logged once all of them are done
+	var workerWg sync.WaitGroup
+	var dropped uint64
+	deadLetters := NewDeadLetterQueue(config.Output.DeadLetterDir, time.Now())
+	workerWg.Add(nw)
+	wg.Add(1)
+	go func() {
+		workerWg.Wait()
+		filter.LogCounts()
+		log.Infof("Duplicate pings dropped: %d", atomic.LoadUint64(&dropped))
+		if err := deadLetters.Close(); err != nil {
+			log.Errorf("Error closing dead letter file %s: %s", deadLetters.Name(), err)
+		}
+		if n := deadLetters.Count(); n > 0 {
+			log.Infof("Rejected records dead lettered: %d to %s", n, deadLetters.Name())
+		}
+		span.End()
+		wg.Done()
+	}()
 	for i := 0; i < nw; i++ {
 		taskPool.Submit(GeoLocCalcTask{Inchan: inChan,
-			Outchan:   outchan,
-			Cache:     cache,
-			ID:        i,
-			RedisPool: redisPool,
-			Wg:        &wg,
-			Cfg:       config,
+			Outchan:     outchan,
+			Cache:       cache,
+			ID:          i,
+			RedisPool:   redisPool,
+			Wg:          &workerWg,
+			Cfg:         config,
+			Radius:      radius,
+			Filter:      filter,
+			Dropped:     &dropped,
+			DeadLetters: deadLetters,
+			Report:      ReportFromContext(ctx),
+			Ctx:         ctx,
 		})
 	}
 	return &wg
@@ -0,0 +1,112 @@
+package trapyz
+
+import (
+	"errors"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bamarb/aws-pipeline-go/pkg/geofence"
+	"github.com/bamarb/aws-pipeline-go/pkg/geostore"
+	"github.com/bamarb/aws-pipeline-go/pkg/input"
+	"github.com/stretchr/testify/assert"
+)
+
+//fakeGeoStore answers nearby queries from fixed results per index and
+//records the radius asked for
+type fakeGeoStore struct {
+	geostore.GeoLocationStore
+	results map[string][]geostore.GeoRadiusDistInfo
+	radius  map[string]string
+	counted map[string]bool
+}
+
+func (fs *fakeGeoStore) NearbyWithDist(idx, lat, lng, radius string) ([]geostore.GeoRadiusDistInfo, error) {
+	fs.radius[idx], fs.counted[idx] = radius, true
+	return fs.results[idx], nil
+}
+
+func (fs *fakeGeoStore) NearbyAllWithDist(idx, lat, lng, radius string) ([]geostore.GeoRadiusDistInfo, error) {
+	fs.radius[idx], fs.counted[idx] = radius, false
+	return fs.results[idx], nil
+}
+
+func TestNearby(t *testing.T) {
+	assert := assert.New(t)
+	fs := &fakeGeoStore{radius: map[string]string{}, counted: map[string]bool{},
+		results: map[string][]geostore.GeoRadiusDistInfo{
+			"idx":      {{LocID: "s1", Distance: 50}, {LocID: "mall", Distance: 200}},
+			"idx:wide": {{LocID: "mall", Distance: 200}, {LocID: "park", Distance: 1800}},
+		}}
+	gct := GeoLocCalcTask{Radius: 300, Cache: &Cache{MaxReach: 300}}
+	stores, err := gct.nearby(fs, "idx", "12.9", "77.6")
+	assert.Nil(err)
+	assert.Len(stores, 2)
+	assert.Equal("303.00", fs.radius["idx"])
+	_, asked := fs.radius["idx:wide"]
+	assert.False(asked, "no wide search without large fences")
+
+	gct.Cache.MaxReach = 2000
+	stores, err = gct.nearby(fs, "idx", "12.9", "77.6")
+	assert.Nil(err)
+	assert.Equal([]string{"s1", "mall", "park"}, []string{stores[0].LocID, stores[1].LocID, stores[2].LocID})
+	assert.Equal("303.00", fs.radius["idx"], "the main index keeps the default radius")
+	assert.True(fs.counted["idx"])
+	assert.Equal("2020.00", fs.radius["idx:wide"])
+	assert.False(fs.counted["idx:wide"], "the wide index is searched without a count")
+}
+
+func TestWidePoints(t *testing.T) {
+	points := []GeoPoint{{ID: "s1"}, {ID: "mall"}, {ID: "small"}}
+	fences := map[string]geofence.Fence{"mall": {Radius: 1500}, "small": {Radius: 100}}
+	wide := widePoints(points, fences, 300)
+	assert.Equal(t, []GeoPoint{{ID: "mall"}}, wide)
+}
+
+func TestScaleTime(t *testing.T) {
+	assert := assert.New(t)
+	cfg := &Config{Aws: map[string]AwsS3Info{"s3-dev": {ScaleTime: true}}}
+	gct := GeoLocCalcTask{Cfg: cfg}
+	keys := []string{"gid", "createdAt"}
+	read := func(r input.Reader, err error) input.Record {
+		assert.Nil(err)
+		rec, err := r.Read()
+		assert.Nil(err)
+		return rec
+	}
+
+	//json lines carry seconds
+	rec := read(input.NewNDJSONReader(ioutil.NopCloser(strings.NewReader(
+		`{"gid":"g1","createdAt":1536197400}`)), 0), nil)
+	got, ok := gct.convertJSONMap(rec, keys, gct.scaleTime(input.FormatNDJSON))
+	assert.True(ok)
+	assert.Equal("1536197400000", got["createdAt"])
+
+	//csv is already in milliseconds
+	rec = read(input.NewCSVReader(ioutil.NopCloser(strings.NewReader(
+		"gid,createdAt\ng1,1536197400000\n")), input.CSVConfig{}))
+	got, ok = gct.convertJSONMap(rec, keys, gct.scaleTime(input.FormatCSV))
+	assert.True(ok)
+	assert.Equal("1536197400000", got["createdAt"])
+	assert.False(gct.scaleTime(input.FormatParquet))
+
+	cfg.Aws["s3-dev"] = AwsS3Info{}
+	assert.False(gct.scaleTime(input.FormatNDJSON))
+}
+
+func TestQueryStats(t *testing.T) {
+	assert := assert.New(t)
+	var qs QueryStats
+	qs.Observe(2*time.Millisecond, nil)
+	qs.Observe(4*time.Millisecond, errors.New("timeout"))
+	(*QueryStats)(nil).Observe(time.Second, nil)
+	assert.Equal(QueryStats{Count: 2, Errors: 1, Total: 6 * time.Millisecond, Max: 4 * time.Millisecond}, qs)
+	attrs := map[string]interface{}{}
+	for _, kv := range qs.Attributes() {
+		attrs[string(kv.Key)] = kv.Value.AsInterface()
+	}
+	assert.Equal(int64(2), attrs["redis.queries"])
+	assert.Equal(3.0, attrs["redis.avg_ms"])
+	assert.Equal(4.0, attrs["redis.max_ms"])
+}
@@ -0,0 +1,110 @@
+package trapyz
+
+import (
+	"bytes"
+	"strconv"
+)
+
+//UnknownID the zero id, used when a name has no mapping in the lookup tables
+const UnknownID = 0
+
+//PinID a PincodeMap id
+type PinID int
+
+//CatID a CategoryMap id
+type CatID int
+
+//SubcatID a SubCategoryMap id
+type SubcatID int
+
+//CityID a CityMap id
+type CityID int
+
+//APIKeyID an ApikeyMap id
+type APIKeyID int
+
+//Known returns false for an unmapped pincode
+func (id PinID) Known() bool { return id != UnknownID }
+
+//Known returns false for an unmapped category
+func (id CatID) Known() bool { return id != UnknownID }
+
+//Known returns false for an unmapped sub category
+func (id SubcatID) Known() bool { return id != UnknownID }
+
+//Known returns false for an unmapped city
+func (id CityID) Known() bool { return id != UnknownID }
+
+//Known returns false for an unmapped apikey
+func (id APIKeyID) Known() bool { return id != UnknownID }
+
+func (id PinID) String() string    { return strconv.Itoa(int(id)) }
+func (id CatID) String() string    { return strconv.Itoa(int(id)) }
+func (id SubcatID) String() string { return strconv.Itoa(int(id)) }
+func (id CityID) String() string   { return strconv.Itoa(int(id)) }
+func (id APIKeyID) String() string { return strconv.Itoa(int(id)) }
+
+//The ids are encoded as json strings, the way they were written when
+//GeoLocOutput held plain strings, an unknown id is written as "0"
+
+//MarshalJSON encodes the id as a quoted decimal string
+func (id PinID) MarshalJSON() ([]byte, error) { return marshalID(int(id)) }
+
+//MarshalJSON encodes the id as a quoted decimal string
+func (id CatID) MarshalJSON() ([]byte, error) { return marshalID(int(id)) }
+
+//MarshalJSON encodes the id as a quoted decimal string
+func (id SubcatID) MarshalJSON() ([]byte, error) { return marshalID(int(id)) }
+
+//MarshalJSON encodes the id as a quoted decimal string
+func (id CityID) MarshalJSON() ([]byte, error) { return marshalID(int(id)) }
+
+//MarshalJSON encodes the id as a quoted decimal string
+func (id APIKeyID) MarshalJSON() ([]byte, error) { return marshalID(int(id)) }
+
+//UnmarshalJSON accepts a quoted or bare number, "" and null are unknown
+func (id *PinID) UnmarshalJSON(b []byte) error {
+	v, err := unmarshalID(b)
+	*id = PinID(v)
+	return err
+}
+
+//UnmarshalJSON accepts a quoted or bare number, "" and null are unknown
+func (id *CatID) UnmarshalJSON(b []byte) error {
+	v, err := unmarshalID(b)
+	*id = CatID(v)
+	return err
+}
+
+//UnmarshalJSON accepts a quoted or bare number, "" and null are unknown
+func (id *SubcatID) UnmarshalJSON(b []byte) error {
+	v, err := unmarshalID(b)
+	*id = SubcatID(v)
+	return err
+}
+
+//UnmarshalJSON accepts a quoted or bare number, "" and null are unknown
+func (id *CityID) UnmarshalJSON(b []byte) error {
+	v, err := unmarshalID(b)
+	*id = CityID(v)
+	return err
+}
+
+//UnmarshalJSON accepts a quoted or bare number, "" and null are unknown
+func (id *APIKeyID) UnmarshalJSON(b []byte) error {
+	v, err := unmarshalID(b)
+	*id = APIKeyID(v)
+	return err
+}
+
+func marshalID(id int) ([]byte, error) {
+	return []byte(strconv.Quote(strconv.Itoa(id))), nil
+}
+
+func unmarshalID(b []byte) (int, error) {
+	b = bytes.Trim(b, `"`)
+	if len(b) == 0 || string(b) == "null" {
+		return UnknownID, nil
+	}
+	return strconv.Atoi(string(b))
+}
@@ -0,0 +1,34 @@
+package trapyz
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGeoLocOutputJSON(t *testing.T) {
+	assert := assert.New(t)
+	out := GeoLocOutput{UID: "42", Gid: "g1", Pin: 11, Cat: 3, Subcat: 31, City: 7, Distance: 12}
+	data, err := json.Marshal(out)
+	assert.Nil(err)
+	//ids are written as strings like before, an unknown apikey as "0"
+	assert.Contains(string(data), `"pin":"11"`)
+	assert.Contains(string(data), `"cat":"3"`)
+	assert.Contains(string(data), `"apikey":"0"`)
+
+	var got GeoLocOutput
+	assert.Nil(json.Unmarshal(data, &got))
+	assert.Equal(out, got)
+	assert.False(got.Apikey.Known())
+	assert.False(validateGeoLoc(&got))
+
+	legacy := `{"pin":"","cat":3,"subcat":"31","city":null,"apikey":"5"}`
+	assert.Nil(json.Unmarshal([]byte(legacy), &got))
+	assert.False(got.Pin.Known())
+	assert.Equal(CatID(3), got.Cat)
+	assert.False(got.City.Known())
+	assert.Equal(APIKeyID(5), got.Apikey)
+
+	assert.Error(json.Unmarshal([]byte(`{"pin":"abc"}`), &got))
+}
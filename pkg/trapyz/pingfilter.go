@@ -0,0 +1,280 @@
+package trapyz
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bamarb/aws-pipeline-go/pkg/geomath"
+	log "github.com/sirupsen/logrus"
+)
+
+//RejectReason the reason a ping was dropped by the filter
+type RejectReason int
+
+const (
+	// RejectNone the ping was accepted
+	RejectNone RejectReason = iota
+	// RejectMissing gid, lat or lng is empty or NULL
+	RejectMissing
+	// RejectBadCoord lat or lng is not a number
+	RejectBadCoord
+	// RejectOutOfRange lat or lng is out of range
+	RejectOutOfRange
+	// RejectNullIsland the ping is at 0,0
+	RejectNullIsland
+	// RejectBogus the ping is at a known bogus location
+	RejectBogus
+	// RejectAccuracy the reported accuracy is too coarse
+	RejectAccuracy
+	// RejectSpeed the device would have to move impossibly fast to get here
+	RejectSpeed
+	numRejectReasons
+)
+
+var rejectReasonNames = [...]string{"none", "missing", "bad_coord", "out_of_range",
+	"null_island", "bogus_coord", "accuracy", "speed"}
+
+func (r RejectReason) String() string {
+	if r < RejectNone || r >= numRejectReasons {
+		return "unknown"
+	}
+	return rejectReasonNames[r]
+}
+
+//defaultBogusCoords well known fake locations reported by emulators
+//and simulators, lat,lng
+var defaultBogusCoords = []string{
+	"37.4219983,-122.084",
+	"37.785834,-122.406417",
+}
+
+//bogusPrecision coordinates are compared after rounding to this many decimals
+const bogusPrecision = 4
+
+//fix a recent ping of a device. Rejected fixes are kept to recognise an
+//accepted fix as the outlier when later pings agree with them
+type fix struct {
+	at        time.Time
+	loc       geomath.Point
+	rejected  bool
+	confirmed bool
+}
+
+//Bounds of the speed check state
+const (
+	//maxFixes recent fixes kept per device
+	maxFixes = 8
+	//fixTTL devices without a fix this close to the latest ping are forgotten
+	fixTTL = time.Hour
+	//sweepEvery the number of speed checks between expiry sweeps
+	sweepEvery = 100000
+)
+
+//PingFilter rejects pings with bad GPS data. It is shared between workers
+//so the speed check sees every ping of a device
+type PingFilter struct {
+	maxAccuracy float64
+	//meters per second
+	maxSpeed  float64
+	bogus     map[string]bool
+	lock      sync.Mutex
+	fixes     map[string][]fix
+	watermark time.Time
+	checks    int
+	counts    [numRejectReasons]uint64
+}
+
+//NewPingFilter constructs a filter from the filter config section
+func NewPingFilter(cfg FilterInfo) (*PingFilter, error) {
+	pf := &PingFilter{
+		maxAccuracy: cfg.MaxAccuracy,
+		maxSpeed:    cfg.MaxSpeed * 1000 / 3600,
+		bogus:       make(map[string]bool),
+		fixes:       make(map[string][]fix),
+	}
+	for _, c := range append(defaultBogusCoords, cfg.BogusCoords...) {
+		parts := strings.Split(c, ",")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("Invalid bogus coordinate [%s] expected lat,lng", c)
+		}
+		lat, err := strconv.ParseFloat(strings.TrimSpace(parts[0]), 64)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid bogus coordinate [%s]: %s", c, err)
+		}
+		lng, err := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid bogus coordinate [%s]: %s", c, err)
+		}
+		pf.bogus[bogusKey(lat, lng)] = true
+	}
+	return pf, nil
+}
+
+func bogusKey(lat, lng float64) string {
+	return strconv.FormatFloat(lat, 'f', bogusPrecision, 64) + "," +
+		strconv.FormatFloat(lng, 'f', bogusPrecision, 64)
+}
+
+func isNull(s string) bool {
+	return s == "" || s == "NULL"
+}
+
+//Check validates a ping and returns the reason it was rejected or RejectNone.
+//Every ping is counted against its reason
+func (pf *PingFilter) Check(vars map[string]string) RejectReason {
+	r := pf.check(vars)
+	atomic.AddUint64(&pf.counts[r], 1)
+	return r
+}
+
+func (pf *PingFilter) check(vars map[string]string) RejectReason {
+	gid := vars["gid"]
+	if isNull(gid) || isNull(vars["lat"]) || isNull(vars["lng"]) {
+		return RejectMissing
+	}
+	lat, err := strconv.ParseFloat(vars["lat"], 64)
+	if err != nil || math.IsNaN(lat) {
+		return RejectBadCoord
+	}
+	lng, err := strconv.ParseFloat(vars["lng"], 64)
+	if err != nil || math.IsNaN(lng) {
+		return RejectBadCoord
+	}
+	loc := geomath.Point{Lat: lat, Lng: lng}
+	if !loc.Valid() {
+		return RejectOutOfRange
+	}
+	if lat == 0 && lng == 0 {
+		return RejectNullIsland
+	}
+	if pf.bogus[bogusKey(lat, lng)] {
+		return RejectBogus
+	}
+	if acc, ok := vars["accuracy"]; ok && pf.maxAccuracy > 0 && !isNull(acc) {
+		if a, err := strconv.ParseFloat(acc, 64); err == nil && a > pf.maxAccuracy {
+			return RejectAccuracy
+		}
+	}
+	if pf.maxSpeed > 0 {
+		if at, err := CreatedAtTime(vars["createdAt"]); err == nil && !pf.plausible(gid, at, loc) {
+			return RejectSpeed
+		}
+	}
+	return RejectNone
+}
+
+//plausible checks the speed needed to reach the ping from the time
+//adjacent accepted fixes of the device, pings arrive in any order. The
+//ping is rejected only when it disagrees with its neighbours, unless a
+//single unconfirmed neighbour disagrees and the ping agrees with an
+//earlier rejected fix, then the neighbour was the outlier and is dropped
+func (pf *PingFilter) plausible(gid string, at time.Time, loc geomath.Point) bool {
+	pf.lock.Lock()
+	defer pf.lock.Unlock()
+	pf.sweep(at)
+	fixes := pf.fixes[gid]
+	i := sort.Search(len(fixes), func(i int) bool { return fixes[i].at.After(at) })
+	cur := fix{at: at, loc: loc}
+	prev, next := adjacent(fixes, i, false)
+	var outliers []int
+	ok := prev < 0 && next < 0
+	for _, n := range []int{prev, next} {
+		if n < 0 {
+			continue
+		}
+		if pf.reachable(fixes[n], cur) {
+			fixes[n].confirmed = true
+			cur.confirmed, ok = true, true
+		} else if !fixes[n].confirmed {
+			outliers = append(outliers, n)
+		}
+	}
+	if !ok && len(outliers) > 0 && (prev < 0 || next < 0) {
+		rprev, rnext := adjacent(fixes, i, true)
+		for _, n := range []int{rprev, rnext} {
+			if n >= 0 && pf.reachable(fixes[n], cur) {
+				ok = true
+			}
+		}
+		if ok {
+			for k := len(outliers) - 1; k >= 0; k-- {
+				if outliers[k] < i {
+					i--
+				}
+				fixes = append(fixes[:outliers[k]], fixes[outliers[k]+1:]...)
+			}
+		}
+	}
+	cur.rejected = !ok
+	fixes = append(fixes, fix{})
+	copy(fixes[i+1:], fixes[i:])
+	fixes[i] = cur
+	if len(fixes) > maxFixes {
+		fixes = fixes[len(fixes)-maxFixes:]
+	}
+	pf.fixes[gid] = fixes
+	return ok
+}
+
+//adjacent returns the index of the fixes before and after position i
+//that are rejected or not, -1 if there is none
+func adjacent(fixes []fix, i int, rejected bool) (int, int) {
+	prev, next := -1, -1
+	for k := i - 1; k >= 0; k-- {
+		if fixes[k].rejected == rejected {
+			prev = k
+			break
+		}
+	}
+	for k := i; k < len(fixes); k++ {
+		if fixes[k].rejected == rejected {
+			next = k
+			break
+		}
+	}
+	return prev, next
+}
+
+//reachable returns true if the device can move between the fixes within
+//the max speed, fixes less than a second apart are taken as a second
+func (pf *PingFilter) reachable(a, b fix) bool {
+	secs := math.Max(math.Abs(a.at.Sub(b.at).Seconds()), 1)
+	return geomath.Haversine(a.loc, b.loc)/secs <= pf.maxSpeed
+}
+
+//sweep forgets devices without a fix within fixTTL of the latest ping
+//every sweepEvery checks, the lock is held
+func (pf *PingFilter) sweep(at time.Time) {
+	if at.After(pf.watermark) {
+		pf.watermark = at
+	}
+	if pf.checks++; pf.checks%sweepEvery != 0 {
+		return
+	}
+	before := pf.watermark.Add(-fixTTL)
+	for gid, fixes := range pf.fixes {
+		if fixes[len(fixes)-1].at.Before(before) {
+			delete(pf.fixes, gid)
+		}
+	}
+}
+
+//Counts returns the number of pings accepted and rejected per reason
+func (pf *PingFilter) Counts() map[string]uint64 {
+	ret := make(map[string]uint64, numRejectReasons)
+	for r := RejectNone; r < numRejectReasons; r++ {
+		ret[r.String()] = atomic.LoadUint64(&pf.counts[r])
+	}
+	return ret
+}
+
+//LogCounts logs the per reason counts
+func (pf *PingFilter) LogCounts() {
+	log.Infof("Ping filter counts: %v", pf.Counts())
+}
@@ -0,0 +1,84 @@
+package trapyz
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPingFilter(t *testing.T) {
+	assert := assert.New(t)
+	pf, err := NewPingFilter(FilterInfo{MaxAccuracy: 100, MaxSpeed: 200, BogusCoords: []string{"12.5, 77.5"}})
+	assert.Nil(err)
+
+	p := func(gid, lat, lng, createdAt string) map[string]string {
+		return map[string]string{"gid": gid, "lat": lat, "lng": lng, "createdAt": createdAt}
+	}
+	tests := []struct {
+		vars map[string]string
+		want RejectReason
+	}{
+		{p("NULL", "12.9", "77.6", "1536228000000"), RejectMissing},
+		{p("g1", "", "77.6", "1536228000000"), RejectMissing},
+		{p("g1", "12.9x", "77.6", "1536228000000"), RejectBadCoord},
+		{p("g1", "91", "77.6", "1536228000000"), RejectOutOfRange},
+		{p("g1", "0", "0.0", "1536228000000"), RejectNullIsland},
+		{p("g1", "12.50001", "77.5", "1536228000000"), RejectBogus},
+		{p("g1", "37.4219983", "-122.084", "1536228000000"), RejectBogus},
+		{map[string]string{"gid": "g1", "lat": "12.9", "lng": "77.6", "accuracy": "1500"}, RejectAccuracy},
+		{p("g1", "12.9716", "77.5946", "1536228000000"), RejectNone},
+		//~845km in an hour
+		{p("g1", "19.0760", "72.8777", "1536231600000"), RejectSpeed},
+		//~2km in a minute is 120km/h
+		{p("g1", "12.99", "77.5946", "1536228060000"), RejectNone},
+		//other devices are tracked separately
+		{p("g2", "19.0760", "72.8777", "1536231600000"), RejectNone},
+	}
+	for i, tt := range tests {
+		assert.Equal(tt.want, pf.Check(tt.vars), "case %d %v", i, tt.vars)
+	}
+	counts := pf.Counts()
+	assert.Equal(uint64(3), counts["none"])
+	assert.Equal(uint64(2), counts["missing"])
+	assert.Equal(uint64(2), counts["bogus_coord"])
+	assert.Equal(uint64(1), counts["speed"])
+
+	_, err = NewPingFilter(FilterInfo{BogusCoords: []string{"12.5"}})
+	assert.Error(err)
+}
+
+func TestPingFilterSpeedOrder(t *testing.T) {
+	assert := assert.New(t)
+	pf, err := NewPingFilter(FilterInfo{MaxSpeed: 200})
+	assert.Nil(err)
+	p := func(gid, lat, lng, createdAt string) map[string]string {
+		return map[string]string{"gid": gid, "lat": lat, "lng": lng, "createdAt": createdAt}
+	}
+	tests := []struct {
+		vars map[string]string
+		want RejectReason
+	}{
+		//a device walking in Bangalore, its pings read out of order
+		{p("g1", "12.9716", "77.5946", "1536228600000"), RejectNone},
+		{p("g1", "12.9720", "77.5950", "1536228000000"), RejectNone},
+		{p("g1", "12.9718", "77.5948", "1536228300000"), RejectNone},
+		//a jump to Mumbai between two Bangalore fixes is the outlier
+		{p("g1", "19.0760", "72.8777", "1536228400000"), RejectSpeed},
+		//as is a second fix in Mumbai at the same instant
+		{p("g1", "19.0760", "72.8777", "1536228600000"), RejectSpeed},
+		//a device whose first fix is the outlier, the fixes after it
+		//agree with each other and replace it
+		{p("g2", "19.0760", "72.8777", "1536228000000"), RejectNone},
+		{p("g2", "12.9716", "77.5946", "1536228300000"), RejectSpeed},
+		{p("g2", "12.9718", "77.5948", "1536228600000"), RejectNone},
+		{p("g2", "12.9720", "77.5950", "1536228900000"), RejectNone},
+	}
+	for i, tt := range tests {
+		assert.Equal(tt.want, pf.Check(tt.vars), "case %d %v", i, tt.vars)
+	}
+	//the Mumbai fix of g2 was dropped
+	assert.Len(pf.fixes["g2"], 3)
+	for _, f := range pf.fixes["g2"] {
+		assert.InDelta(12.97, f.loc.Lat, 0.01)
+	}
+}
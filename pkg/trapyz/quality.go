@@ -0,0 +1,125 @@
+package trapyz
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+//ErrorCatalogBroken is returned when too many stores have unmapped fields
+var ErrorCatalogBroken = errors.New("Too many stores with unmapped category, city or pincode")
+
+//CacheError reports the table and stage at which building the cache failed
+type CacheError struct {
+	Table string
+	Stage string
+	Err   error
+}
+
+func (ce *CacheError) Error() string {
+	return fmt.Sprintf("cache %s %s: %s", ce.Stage, ce.Table, ce.Err)
+}
+
+//QualityReportFile the name of the report written to the output directory
+const QualityReportFile = "catalog-quality.json"
+
+//Names of the store fields checked by the quality report
+const (
+	FieldCat    = "cat"
+	FieldSubcat = "subcat"
+	FieldCity   = "city"
+	FieldPin    = "pincode"
+)
+
+//UnmappedStore a store whose category, subcategory, city or pincode
+//has no id in the lookup tables
+type UnmappedStore struct {
+	UID     string   `json:"uuid"`
+	Sname   string   `json:"sname"`
+	Fields  []string `json:"fields"`
+	Cat     string   `json:"cat"`
+	Subcat  string   `json:"subcat"`
+	City    string   `json:"city"`
+	Pincode int      `json:"pincode"`
+}
+
+//QualityReport the data quality of the store catalog
+type QualityReport struct {
+	Generated   time.Time       `json:"generated"`
+	TotalStores int             `json:"total_stores"`
+	BadStores   int             `json:"bad_stores"`
+	Unmapped    map[string]int  `json:"unmapped"`
+	ScanErrors  map[string]int  `json:"scan_errors"`
+	Stores      []UnmappedStore `json:"stores"`
+}
+
+//NewQualityReport constructs an empty report
+func NewQualityReport() *QualityReport {
+	return &QualityReport{Generated: time.Now(), Unmapped: make(map[string]int),
+		ScanErrors: make(map[string]int)}
+}
+
+//ScanError records a catalog row of table that could not be read, the
+//row is skipped. A nil report only logs
+func (qr *QualityReport) ScanError(table string, err error) {
+	log.Errorf("SCAN-ERROR: table:[%s]: %s", table, err)
+	if qr == nil {
+		return
+	}
+	qr.ScanErrors[table]++
+}
+
+//BadStoreRow records an unreadable row of the stores counted in
+//TotalStores, it is a scan error and a bad store
+func (qr *QualityReport) BadStoreRow(table string, err error) {
+	qr.ScanError(table, err)
+	if qr == nil {
+		return
+	}
+	qr.BadStores++
+}
+
+//Add records a store with unmapped fields
+func (qr *QualityReport) Add(st UnmappedStore) {
+	qr.BadStores++
+	for _, f := range st.Fields {
+		qr.Unmapped[f]++
+	}
+	qr.Stores = append(qr.Stores, st)
+}
+
+//BadRatio the fraction of stores with at least one unmapped field or
+//an unreadable row
+func (qr *QualityReport) BadRatio() float64 {
+	if qr.TotalStores == 0 {
+		return 0
+	}
+	return float64(qr.BadStores) / float64(qr.TotalStores)
+}
+
+//Check returns ErrorCatalogBroken if the bad ratio exceeds maxRatio,
+//a maxRatio of zero disables the check
+func (qr *QualityReport) Check(maxRatio float64) error {
+	if maxRatio > 0 && qr.BadRatio() > maxRatio {
+		return ErrorCatalogBroken
+	}
+	return nil
+}
+
+//WriteFile writes the report as json to the output directory
+func (qr *QualityReport) WriteFile(dir, name string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(qr, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path.Join(dir, name), data, 0644)
+}
@@ -0,0 +1,45 @@
+package trapyz
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQualityReportCheck(t *testing.T) {
+	assert := assert.New(t)
+	qr := NewQualityReport()
+	qr.TotalStores = 10
+	qr.Add(UnmappedStore{UID: "1", Fields: []string{FieldCat, FieldCity}})
+	qr.Add(UnmappedStore{UID: "2", Fields: []string{FieldCity}})
+	assert.Equal(2, qr.BadStores)
+	assert.Equal(2, qr.Unmapped[FieldCity])
+	assert.Equal(1, qr.Unmapped[FieldCat])
+	assert.InDelta(0.2, qr.BadRatio(), 1e-9)
+
+	assert.Nil(qr.Check(0))
+	assert.Nil(qr.Check(0.25))
+	assert.Equal(ErrorCatalogBroken, qr.Check(0.1))
+}
+
+func TestQualityReportScanError(t *testing.T) {
+	assert := assert.New(t)
+	qr := NewQualityReport()
+	qr.TotalStores = 4
+	qr.BadStoreRow("MasterRecords", errors.New("converting NULL to string is unsupported"))
+	qr.BadStoreRow("MasterRecords", errors.New("converting NULL to int is unsupported"))
+	//rows of the lookup tables are not stores
+	qr.ScanError("CityMap", errors.New("converting NULL to int is unsupported"))
+	qr.ScanError("CategoryMap", errors.New("converting NULL to string is unsupported"))
+	assert.Equal(2, qr.BadStores)
+	assert.Equal(2, qr.ScanErrors["MasterRecords"])
+	assert.Equal(1, qr.ScanErrors["CityMap"])
+	assert.Equal(1, qr.ScanErrors["CategoryMap"])
+	assert.InDelta(0.5, qr.BadRatio(), 1e-9)
+	assert.Equal(ErrorCatalogBroken, qr.Check(0.25))
+
+	var none *QualityReport
+	none.ScanError("CityMap", errors.New("bad row"))
+	none.BadStoreRow("MasterRecords", errors.New("bad row"))
+}
@@ -0,0 +1,236 @@
+package trapyz
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+//ErrorRunAborted run ended by a fatal error
+var ErrorRunAborted = errors.New("Error run aborted, see the log")
+
+//Run report statuses. A partial run finished but lost files or output
+//records on the way
+const (
+	StatusRunning = "running"
+	StatusOK      = "ok"
+	StatusPartial = "partial"
+	StatusFailed  = "failed"
+)
+
+//FetchReport s3 download accounting
+type FetchReport struct {
+	Listed     int64 `json:"listed"`
+	Downloaded int64 `json:"downloaded"`
+	Failed     int64 `json:"failed"`
+	Bytes      int64 `json:"bytes"`
+}
+
+//InputReport input record accounting, rejects are counted by error class
+//and by class:reason
+type InputReport struct {
+	Files            int64             `json:"files"`
+	Lines            uint64            `json:"lines"`
+	Matched          uint64            `json:"matched"`
+	Duplicates       uint64            `json:"duplicates"`
+	RejectedByClass  map[string]uint64 `json:"rejected_by_class"`
+	RejectedByReason map[string]uint64 `json:"rejected_by_reason"`
+}
+
+//OutputReport records written to and failed by one sink
+type OutputReport struct {
+	Written uint64 `json:"written"`
+	Failed  uint64 `json:"failed"`
+}
+
+//StageReport a timed pipeline stage
+type StageReport struct {
+	Name     string    `json:"name"`
+	Start    time.Time `json:"start"`
+	Duration float64   `json:"duration_seconds"`
+}
+
+//RunReport machine readable summary of a pipeline run. It is safe for
+//concurrent use, all methods are no-ops on a nil report
+type RunReport struct {
+	lock       sync.Mutex
+	Command    string                  `json:"command"`
+	From       time.Time               `json:"window_from"`
+	To         time.Time               `json:"window_to"`
+	ConfigHash string                  `json:"config_hash"`
+	Started    time.Time               `json:"started"`
+	Finished   time.Time               `json:"finished"`
+	Status     string                  `json:"status"`
+	Error      string                  `json:"error,omitempty"`
+	Fetch      FetchReport             `json:"fetch"`
+	Input      InputReport             `json:"input"`
+	Outputs    map[string]OutputReport `json:"outputs"`
+	Stages     []StageReport           `json:"stages"`
+}
+
+//NewRunReport starts the report of a run over the window from, to
+func NewRunReport(command string, from, to time.Time) *RunReport {
+	return &RunReport{Command: command, From: from, To: to, Started: time.Now(),
+		Status: StatusRunning, Outputs: make(map[string]OutputReport),
+		Input: InputReport{RejectedByClass: make(map[string]uint64),
+			RejectedByReason: make(map[string]uint64)}}
+}
+
+//ConfigHash returns the sha256 of the config file
+func ConfigHash(cfgFile string) (string, error) {
+	data, err := ioutil.ReadFile(cfgFile)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+//ReportDir returns the run report directory, <output dir>/reports
+//unless configured
+func ReportDir(cfg *Config) string {
+	if cfg.Output.ReportDir != "" {
+		return cfg.Output.ReportDir
+	}
+	return filepath.Join(cfg.Output.Directory, "reports")
+}
+
+type reportKey struct{}
+
+//ContextWithReport returns a context carrying the run report
+func ContextWithReport(ctx context.Context, r *RunReport) context.Context {
+	return context.WithValue(ctx, reportKey{}, r)
+}
+
+//ReportFromContext returns the run report of the context, nil if none
+func ReportFromContext(ctx context.Context) *RunReport {
+	r, _ := ctx.Value(reportKey{}).(*RunReport)
+	return r
+}
+
+//StartStage times a stage until the returned func is called
+func (r *RunReport) StartStage(name string) func() {
+	start := time.Now()
+	return func() {
+		if r == nil {
+			return
+		}
+		r.lock.Lock()
+		defer r.lock.Unlock()
+		r.Stages = append(r.Stages, StageReport{Name: name, Start: start,
+			Duration: time.Since(start).Seconds()})
+	}
+}
+
+//Listed counts files listed for download
+func (r *RunReport) Listed(n int) {
+	if r == nil {
+		return
+	}
+	r.lock.Lock()
+	r.Fetch.Listed += int64(n)
+	r.lock.Unlock()
+}
+
+//Downloaded counts a download, failed or not
+func (r *RunReport) Downloaded(size int64, err error) {
+	if r == nil {
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if err != nil {
+		r.Fetch.Failed++
+		return
+	}
+	r.Fetch.Downloaded++
+	r.Fetch.Bytes += size
+}
+
+//Reject counts a rejected input record
+func (r *RunReport) Reject(class ErrorClass, reason string) {
+	if r == nil {
+		return
+	}
+	r.lock.Lock()
+	r.Input.RejectedByClass[class.String()]++
+	r.Input.RejectedByReason[class.String()+":"+reason]++
+	r.lock.Unlock()
+}
+
+//AddFile adds the accounting of a processed input file, its rejects
+//are counted by Reject
+func (r *RunReport) AddFile(stats FileStats) {
+	if r == nil {
+		return
+	}
+	r.lock.Lock()
+	r.Input.Files++
+	r.Input.Lines += uint64(stats.Lines)
+	r.Input.Matched += uint64(stats.Matched)
+	r.Input.Duplicates += uint64(stats.Duplicates)
+	r.lock.Unlock()
+}
+
+//SetOutput records the counts of a sink
+func (r *RunReport) SetOutput(name string, written, failed uint64) {
+	if r == nil {
+		return
+	}
+	r.lock.Lock()
+	r.Outputs[name] = OutputReport{Written: written, Failed: failed}
+	r.lock.Unlock()
+}
+
+//Finish ends the run. A nil err finishes ok, or partial if downloads or
+//output records failed
+func (r *RunReport) Finish(err error) {
+	if r == nil {
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.Finished = time.Now()
+	if err != nil {
+		r.Status = StatusFailed
+		r.Error = err.Error()
+		return
+	}
+	r.Status = StatusOK
+	if r.Fetch.Failed > 0 {
+		r.Status = StatusPartial
+	}
+	for _, o := range r.Outputs {
+		if o.Failed > 0 {
+			r.Status = StatusPartial
+		}
+	}
+}
+
+//WriteFile writes the report as json to <dir>/run-<start>.json, replacing
+//the file atomically. Returns the file name
+func (r *RunReport) WriteFile(dir string) (string, error) {
+	r.lock.Lock()
+	data, err := json.MarshalIndent(r, "", "  ")
+	r.lock.Unlock()
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	name := filepath.Join(dir, "run-"+r.Started.Format("20060102-150405")+".json")
+	tmp := name + ".tmp"
+	if err := ioutil.WriteFile(tmp, append(data, '\n'), 0644); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	return name, os.Rename(tmp, name)
+}
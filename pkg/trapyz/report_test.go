@@ -0,0 +1,72 @@
+package trapyz
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRunReport(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "report")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	var none *RunReport
+	none.Listed(1)
+	none.Reject(ErrorParse, "bad")
+	none.StartStage("noop")()
+	none.Finish(nil)
+	assert.Nil(ReportFromContext(context.Background()))
+
+	from := time.Date(2018, 9, 6, 0, 0, 0, 0, time.UTC)
+	r := NewRunReport("test", from, from.Add(time.Hour))
+	assert.Equal(r, ReportFromContext(ContextWithReport(context.Background(), r)))
+	r.Listed(3)
+	r.Downloaded(100, nil)
+	r.Downloaded(50, nil)
+	r.StartStage("s3_fetch")()
+	r.AddFile(FileStats{Lines: 10, Matched: 7, Duplicates: 1})
+	r.Reject(ErrorParse, "unexpected end of JSON input")
+	r.Reject(ErrorLookup, "Unknown apikey")
+	r.Reject(ErrorLookup, "Unknown apikey")
+	r.SetOutput("file", 7, 0)
+	r.Finish(nil)
+	assert.Equal(StatusOK, r.Status)
+	assert.Equal(FetchReport{Listed: 3, Downloaded: 2, Bytes: 150}, r.Fetch)
+	assert.Equal(uint64(2), r.Input.RejectedByClass["lookup"])
+	assert.Equal(uint64(2), r.Input.RejectedByReason["lookup:Unknown apikey"])
+	assert.Len(r.Stages, 1)
+
+	r.Downloaded(10, errors.New("timeout"))
+	r.Finish(nil)
+	assert.Equal(StatusPartial, r.Status)
+	r.Finish(ErrorRunAborted)
+	assert.Equal(StatusFailed, r.Status)
+
+	name, err := r.WriteFile(filepath.Join(dir, "reports"))
+	assert.Nil(err)
+	assert.Equal("run-", filepath.Base(name)[:4])
+	data, err := ioutil.ReadFile(name)
+	assert.Nil(err)
+	var got map[string]interface{}
+	assert.Nil(json.Unmarshal(data, &got))
+	assert.Equal("failed", got["status"])
+	assert.Equal(ErrorRunAborted.Error(), got["error"])
+	assert.Equal(float64(7), got["input"].(map[string]interface{})["matched"])
+
+	cfgFile := filepath.Join(dir, "config.toml")
+	assert.Nil(ioutil.WriteFile(cfgFile, []byte("tpzenv = \"dev\"\n"), 0644))
+	hash, err := ConfigHash(cfgFile)
+	assert.Nil(err)
+	assert.Len(hash, 64)
+	_, err = ConfigHash(filepath.Join(dir, "missing.toml"))
+	assert.Error(err)
+}
@@ -0,0 +1,237 @@
+package trapyz
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+//DefaultRunHistory runs kept in the state file
+const DefaultRunHistory = 1000
+
+//DefaultMaxAttempts runs of a window before it is no longer caught up
+const DefaultMaxAttempts = 3
+
+//RunRecord a scheduled run of a window. Attempts counts the runs of
+//the window, Report is the run report file. Output is set once a run of
+//the window started writing output
+type RunRecord struct {
+	From     time.Time `json:"window_from"`
+	To       time.Time `json:"window_to"`
+	Status   string    `json:"status"`
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished,omitempty"`
+	Attempts int       `json:"attempts"`
+	Report   string    `json:"report,omitempty"`
+	Error    string    `json:"error,omitempty"`
+	Output   bool      `json:"output,omitempty"`
+}
+
+//Completed returns true if the run finished ok, partial runs are caught
+//up like failed ones unless they wrote output
+func (rr RunRecord) Completed() bool {
+	return rr.Status == StatusOK
+}
+
+//RunState the scheduler run history persisted as a json file, one record
+//per window ordered by window. It is safe for concurrent use, a nil state
+//records nothing
+type RunState struct {
+	lock    sync.Mutex
+	file    string
+	history int
+	runs    []RunRecord
+}
+
+//StateFile returns the run state file, <output dir>/run-state.json
+//unless configured
+func StateFile(cfg *Config) string {
+	if cfg.State.File != "" {
+		return cfg.State.File
+	}
+	return filepath.Join(cfg.Output.Directory, "run-state.json")
+}
+
+//LoadRunState reads the run state file keeping at most history runs, a
+//missing file is an empty state
+func LoadRunState(file string, history int) (*RunState, error) {
+	if history <= 0 {
+		history = DefaultRunHistory
+	}
+	s := &RunState{file: file, history: history}
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &s.runs); err != nil {
+		return nil, err
+	}
+	sort.Slice(s.runs, func(i, j int) bool { return s.runs[i].From.Before(s.runs[j].From) })
+	return s, nil
+}
+
+//Runs returns a copy of the recorded runs ordered by window
+func (s *RunState) Runs() []RunRecord {
+	if s == nil {
+		return nil
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]RunRecord(nil), s.runs...)
+}
+
+//find returns the index of the run of the window or where it goes, the
+//lock is held
+func (s *RunState) find(from, to time.Time) (int, bool) {
+	i := sort.Search(len(s.runs), func(i int) bool { return !s.runs[i].From.Before(from) })
+	return i, i < len(s.runs) && s.runs[i].From.Equal(from) && s.runs[i].To.Equal(to)
+}
+
+//Record adds or replaces the run of the window and saves the state. A
+//running record starts a new attempt of the window, the output flag of
+//earlier attempts is kept
+func (s *RunState) Record(rr RunRecord) error {
+	if s == nil {
+		return nil
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	i, found := s.find(rr.From, rr.To)
+	if found {
+		rr.Attempts = s.runs[i].Attempts
+		if rr.Status == StatusRunning {
+			rr.Attempts++
+		}
+		rr.Output = rr.Output || s.runs[i].Output
+		s.runs[i] = rr
+	} else {
+		if rr.Attempts == 0 {
+			rr.Attempts = 1
+		}
+		s.runs = append(s.runs, RunRecord{})
+		copy(s.runs[i+1:], s.runs[i:])
+		s.runs[i] = rr
+	}
+	if len(s.runs) > s.history {
+		s.runs = append([]RunRecord(nil), s.runs[len(s.runs)-s.history:]...)
+	}
+	return s.save()
+}
+
+//Begin records the start of a run of the window
+func (s *RunState) Begin(r *RunReport) error {
+	return s.Record(RunRecord{From: r.From, To: r.To, Status: StatusRunning, Started: r.Started})
+}
+
+//OutputStarted records that the run of the report is about to write
+//output, saved before the sinks are opened. Re-running the window would
+//write its records again so it is no longer caught up
+func (s *RunState) OutputStarted(r *RunReport) error {
+	if s == nil {
+		return nil
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	i, found := s.find(r.From, r.To)
+	if !found {
+		return nil
+	}
+	s.runs[i].Output = true
+	return s.save()
+}
+
+//End records the finished run of the report, reportFile is the written
+//run report
+func (s *RunState) End(r *RunReport, reportFile string) error {
+	if s == nil {
+		return nil
+	}
+	r.lock.Lock()
+	rr := RunRecord{From: r.From, To: r.To, Status: r.Status, Started: r.Started,
+		Finished: r.Finished, Report: reportFile, Error: r.Error}
+	r.lock.Unlock()
+	return s.Record(rr)
+}
+
+//LastCompleted returns the completed run with the latest window
+func (s *RunState) LastCompleted() (RunRecord, bool) {
+	if s == nil {
+		return RunRecord{}, false
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for i := len(s.runs) - 1; i >= 0; i-- {
+		if s.runs[i].Completed() {
+			return s.runs[i], true
+		}
+	}
+	return RunRecord{}, false
+}
+
+//ResumeWindow returns the window the schedule resumes after, the latest
+//window run. Windows that didn't complete are left to PendingWindows.
+//Windows ending more than maxCatchup before now are not caught up, 0
+//catches up everything. Zero times without a run start from the current
+//hour
+func (s *RunState) ResumeWindow(now time.Time, maxCatchup time.Duration) (time.Time, time.Time) {
+	runs := s.Runs()
+	if len(runs) == 0 {
+		return time.Time{}, time.Time{}
+	}
+	last := runs[len(runs)-1]
+	if maxCatchup > 0 {
+		oldest := roundToHour(now.Add(-maxCatchup))
+		if last.To.Before(oldest) {
+			return oldest.Add(-time.Hour), oldest
+		}
+	}
+	return last.From, last.To
+}
+
+//PendingWindows returns the runs that didn't complete, oldest first,
+//that are inside maxCatchup of now and were attempted fewer than
+//maxAttempts times. A running record is a run that was cut short. Runs
+//that wrote output are not run again, the outputs are not idempotent and
+//their records would be written twice. 0 maxCatchup catches up
+//everything, maxAttempts <= 0 uses DefaultMaxAttempts
+func (s *RunState) PendingWindows(now time.Time, maxCatchup time.Duration, maxAttempts int) []RunRecord {
+	if maxAttempts <= 0 {
+		maxAttempts = DefaultMaxAttempts
+	}
+	var oldest time.Time
+	if maxCatchup > 0 {
+		oldest = roundToHour(now.Add(-maxCatchup))
+	}
+	var pending []RunRecord
+	for _, rr := range s.Runs() {
+		if rr.Completed() || rr.Output || rr.Attempts >= maxAttempts || rr.From.Before(oldest) {
+			continue
+		}
+		pending = append(pending, rr)
+	}
+	return pending
+}
+
+//save writes the state atomically, the lock is held
+func (s *RunState) save() error {
+	data, err := json.MarshalIndent(s.runs, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.file), 0755); err != nil {
+		return err
+	}
+	tmp := s.file + ".tmp"
+	if err := ioutil.WriteFile(tmp, append(data, '\n'), 0644); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, s.file)
+}
@@ -0,0 +1,140 @@
+package trapyz
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRunState(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "runstate")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "state", "run-state.json")
+
+	var none *RunState
+	assert.Nil(none.Record(RunRecord{}))
+	_, ok := none.LastCompleted()
+	assert.False(ok)
+
+	state, err := LoadRunState(file, 3)
+	assert.Nil(err)
+	now := time.Date(2018, 9, 6, 12, 20, 0, 0, time.UTC)
+	from, to := state.ResumeWindow(now, 0)
+	assert.True(from.IsZero() && to.IsZero(), "no runs start from the current hour")
+
+	hour := time.Date(2018, 9, 6, 8, 0, 0, 0, time.UTC)
+	run := func(i int, err error) {
+		r := NewRunReport("test", hour.Add(time.Duration(i)*time.Hour), hour.Add(time.Duration(i+1)*time.Hour))
+		assert.Nil(state.Begin(r))
+		r.Finish(err)
+		assert.Nil(state.End(r, "run.json"))
+	}
+	run(0, nil)
+	run(1, nil)
+	run(2, ErrorRunAborted)
+	run(2, ErrorRunAborted)
+
+	//the schedule resumes after the latest window, the failed one is
+	//left to the catch up
+	reloaded, err := LoadRunState(file, 3)
+	assert.Nil(err)
+	runs := reloaded.Runs()
+	assert.Len(runs, 3)
+	assert.Equal(StatusFailed, runs[2].Status)
+	assert.Equal(2, runs[2].Attempts)
+	assert.Equal(ErrorRunAborted.Error(), runs[2].Error)
+	from, to = reloaded.ResumeWindow(now, 0)
+	assert.Equal(hour.Add(2*time.Hour), from)
+	assert.Equal(hour.Add(3*time.Hour), to)
+	next, _ := GetStartEndTime("hourly", from, to)
+	assert.Equal(hour.Add(3*time.Hour), next)
+	pending := reloaded.PendingWindows(now, 0, 0)
+	assert.Len(pending, 1)
+	assert.Equal(hour.Add(2*time.Hour), pending[0].From)
+	assert.Empty(reloaded.PendingWindows(now, 0, 2), "attempts are used up")
+
+	//catch up is limited to max catchup before now
+	from, to = reloaded.ResumeWindow(now, time.Minute)
+	assert.Equal(time.Date(2018, 9, 6, 11, 0, 0, 0, time.UTC), from)
+	assert.Equal(time.Date(2018, 9, 6, 12, 0, 0, 0, time.UTC), to)
+	from, _ = reloaded.ResumeWindow(now, 3*time.Hour)
+	assert.Equal(hour.Add(2*time.Hour), from)
+	assert.Empty(reloaded.PendingWindows(now, time.Hour, 0))
+	assert.Len(reloaded.PendingWindows(now, 2*time.Hour, 0), 1)
+
+	//history is capped, the oldest windows go first
+	state = reloaded
+	run(3, nil)
+	runs = reloaded.Runs()
+	assert.Len(runs, 3)
+	assert.Equal(hour.Add(time.Hour), runs[0].From)
+	last, ok := reloaded.LastCompleted()
+	assert.True(ok)
+	assert.Equal(hour.Add(4*time.Hour), last.To)
+	//a failed window between completed ones is still caught up
+	pending = reloaded.PendingWindows(now, 0, 0)
+	assert.Len(pending, 1)
+	assert.Equal(hour.Add(2*time.Hour), pending[0].From)
+	assert.False(RunRecord{Status: StatusPartial}.Completed(), "partial runs are caught up")
+
+	assert.Nil(ioutil.WriteFile(file, []byte("{"), 0644))
+	_, err = LoadRunState(file, 0)
+	assert.Error(err)
+}
+
+func TestPendingWindowsOutput(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "runstate")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+	state, err := LoadRunState(filepath.Join(dir, "run-state.json"), 0)
+	assert.Nil(err)
+	now := time.Date(2018, 9, 6, 12, 20, 0, 0, time.UTC)
+	hour := time.Date(2018, 9, 6, 8, 0, 0, 0, time.UTC)
+
+	//records written by every run of a window, as appended by the sinks
+	written := make(map[string]int)
+	run := func(from time.Time, failBeforeOutput bool) {
+		r := NewRunReport("test", from, from.Add(time.Hour))
+		assert.Nil(state.Begin(r))
+		if failBeforeOutput {
+			r.Finish(ErrorRunAborted)
+		} else {
+			assert.Nil(state.OutputStarted(r))
+			written[from.Format(DateHourFormat)]++
+			//the upload failed after the records were written
+			r.Finish(ErrorRunAborted)
+		}
+		assert.Nil(state.End(r, "run.json"))
+	}
+	run(hour, true)
+	run(hour.Add(time.Hour), false)
+	catchUp := func() {
+		for _, rr := range state.PendingWindows(now, 0, 0) {
+			run(rr.From, false)
+		}
+	}
+	catchUp()
+	catchUp()
+	assert.Equal(map[string]int{"2018/09/06/08": 1, "2018/09/06/09": 1}, written,
+		"every window wrote its records once")
+	assert.Empty(state.PendingWindows(now, 0, 0))
+	runs := state.Runs()
+	assert.Len(runs, 2)
+	assert.Equal(2, runs[0].Attempts)
+	assert.True(runs[0].Output)
+	assert.Equal(StatusFailed, runs[1].Status)
+	assert.True(runs[1].Output)
+
+	//a new attempt keeps the output of the earlier ones
+	assert.Nil(state.Begin(NewRunReport("test", hour, hour.Add(time.Hour))))
+	assert.True(state.Runs()[0].Output)
+	var none *RunState
+	assert.Nil(none.OutputStarted(NewRunReport("test", hour, hour)))
+}
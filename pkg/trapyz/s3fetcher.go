@@ -10,8 +10,12 @@ import (
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3iface"
 	"github.com/bamarb/aws-pipeline-go/pkg/file"
+	"github.com/bamarb/aws-pipeline-go/pkg/metrics"
 	"github.com/bamarb/aws-pipeline-go/pkg/task"
+	"github.com/bamarb/aws-pipeline-go/pkg/tracing"
 	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 //ErrorNoBucket is thrown when bucket cannot be found in config
@@ -21,6 +25,8 @@ var ErrorNoBucket = errors.New("Error no aws bucket")
 func S3FetchOnRange(ctx context.Context, cfg *Config,
 	taskPool *task.Pool, start, end time.Time) *sync.WaitGroup {
 	var wg sync.WaitGroup
+	ctx, span := tracing.Start(ctx, "s3.fetch", attribute.String("from", start.Format(DateHourFormat)),
+		attribute.String("to", end.Format(DateHourFormat)))
 	awsCfgInfo := cfg.Aws[CfgKey(cfg, "s3")]
 	conMgr := NewConnMgr(cfg)
 	//Parse The dates and get the channel of prefixes
@@ -34,9 +40,16 @@ func S3FetchOnRange(ctx context.Context, cfg *Config,
 		taskPool.Submit(task)
 		wg.Add(1)
 	}
+	go endOnDone(&wg, span)
 	return &wg
 }
 
+//endOnDone ends the span once the fetchers are done
+func endOnDone(wg *sync.WaitGroup, span trace.Span) {
+	wg.Wait()
+	span.End()
+}
+
 //S3FetchOnTimeRange starts a s3 fetcher based on time range in config
 func S3FetchOnTimeRange(ctx context.Context, cfg *Config, taskPool *task.Pool) *sync.WaitGroup {
 	var wg sync.WaitGroup
@@ -46,6 +59,8 @@ func S3FetchOnTimeRange(ctx context.Context, cfg *Config, taskPool *task.Pool) *
 	if err != nil {
 		panic(err)
 	}
+	ctx, span := tracing.Start(ctx, "s3.fetch", attribute.String("from", start.Format(DateHourFormat)),
+		attribute.String("to", end.Format(DateHourFormat)))
 	log.Infof("using date format: [%s]", awsCfgInfo.DateFormat)
 	//Parse The dates and get the channel of prefixes
 	prefixChan := PrefixChan(ctx, start, end, awsCfgInfo.Prefixes, awsCfgInfo.DateFormat)
@@ -57,6 +72,7 @@ func S3FetchOnTimeRange(ctx context.Context, cfg *Config, taskPool *task.Pool) *
 		task := &S3FetcherTask{ctx, s3c, awsCfgInfo.Bucket, prefixChan, dumpDir, true, &wg}
 		taskPool.Submit(task)
 	}
+	go endOnDone(&wg, span)
 	return &wg
 }
 
@@ -75,38 +91,63 @@ type S3FetcherTask struct {
 
 //Task the task the fetcter executes
 func (ft *S3FetcherTask) Task() {
+	report := ReportFromContext(ft.ctx)
 	for prefix := range ft.prefixChan {
-		//List the Files(Objects) for the prefix
-		s3files := ft.filesForPrefix(prefix)
-		for _, s3file := range s3files {
-			//Ignore Zero Length files
-			if s3file.Size() > 0 {
-				log.Infof("Downloading  file:%s  size:%d", s3file, s3file.Size())
-				err := s3file.Download(ft.ctx, ft.dumpDir)
-				if err != nil {
-					log.Errorf("ERROR downloading file: %s", s3file.Relative())
-				}
+		ft.fetchPrefix(prefix, report)
+	}
+	ft.wg.Done()
+}
+
+//fetchPrefix downloads the files of a prefix
+func (ft *S3FetcherTask) fetchPrefix(prefix string, report *RunReport) {
+	ctx, span := tracing.Start(ft.ctx, "s3.prefix", attribute.String("prefix", prefix))
+	defer span.End()
+	var fetched, failed int
+	var bytes int64
+	//List the Files(Objects) for the prefix
+	s3files := ft.filesForPrefix(ctx, prefix)
+	report.Listed(len(s3files))
+	for _, s3file := range s3files {
+		//Ignore Zero Length files
+		if s3file.Size() > 0 {
+			log.Infof("Downloading  file:%s  size:%d", s3file, s3file.Size())
+			start := time.Now()
+			err := s3file.Download(ctx, ft.dumpDir)
+			if err != nil {
+				log.Errorf("ERROR downloading file: %s", s3file.Relative())
+				failed++
+			} else {
+				metrics.S3DownloadDuration.Observe(metrics.Since(start))
+				metrics.S3DownloadBytes.Add(float64(s3file.Size()))
+				fetched++
+				bytes += s3file.Size()
 			}
+			metrics.S3Downloads.WithLabelValues(metrics.Result(err)).Inc()
+			report.Downloaded(s3file.Size(), err)
 		}
 	}
-	ft.wg.Done()
+	span.SetAttributes(attribute.Int("files", len(s3files)), attribute.Int("downloaded", fetched),
+		attribute.Int("failed", failed), attribute.Int64("bytes", bytes))
 }
 
-func (ft *S3FetcherTask) filesForPrefix(pfx string) []file.File {
+func (ft *S3FetcherTask) filesForPrefix(ctx context.Context, pfx string) []file.File {
 	s3files := make([]file.File, 0, 5)
 	s3Input := s3.ListObjectsV2Input{
 		Bucket: aws.String(ft.bucket),
 		Prefix: aws.String(pfx),
 	}
 
-	err := ft.conn.ListObjectsV2PagesWithContext(ft.ctx, &s3Input,
+	start := time.Now()
+	err := ft.conn.ListObjectsV2PagesWithContext(ctx, &s3Input,
 		func(page *s3.ListObjectsV2Output, lastPage bool) bool {
 			for _, obj := range page.Contents {
 				s3files = append(s3files, file.NewS3File(ft.conn, ft.bucket, obj))
 			}
 			return true
 		})
+	metrics.S3ListDuration.Observe(metrics.Since(start))
 	if err != nil {
+		metrics.S3ListErrors.Inc()
 		log.Errorf("Error S3Fetcher listing objects: %s", err)
 		return nil
 	}
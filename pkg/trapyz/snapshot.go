@@ -0,0 +1,180 @@
+package trapyz
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/bamarb/aws-pipeline-go/pkg/tracing"
+	radix "github.com/mediocregopher/radix.v3"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+//SnapshotVersion the version of the snapshot format written by this build
+const SnapshotVersion = 3
+
+const snapshotMagic = "tpz-cache-snapshot"
+
+//ErrorSnapshotFormat is returned when a file is not a cache snapshot
+var ErrorSnapshotFormat = errors.New("Not a cache snapshot file")
+
+//ErrorSnapshotVersion is returned when a snapshot was written by an incompatible version
+var ErrorSnapshotVersion = errors.New("Unsupported cache snapshot version")
+
+//snapshotHeader is encoded ahead of the snapshot so the version
+//can be checked before decoding the body
+type snapshotHeader struct {
+	Magic   string
+	Version int
+	Created time.Time
+}
+
+//Snapshot holds the lookup cache and the store locations for the
+//redis geo index, enough to run the pipeline without mysql
+type Snapshot struct {
+	Created time.Time
+	Cache   *Cache
+	Points  []GeoPoint
+}
+
+//NewSnapshot snapshots a cache along with the store locations it was built from
+func NewSnapshot(cache *Cache) *Snapshot {
+	return &Snapshot{Created: time.Now(), Cache: cache, Points: cache.points}
+}
+
+//WriteFile writes a gzip compressed gob snapshot, the file is replaced atomically
+func (snap *Snapshot) WriteFile(file string) error {
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+	tmp := file + ".tmp"
+	fh, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	err = snap.Encode(fh)
+	if cerr := fh.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+//Encode writes the snapshot to w
+func (snap *Snapshot) Encode(w io.Writer) error {
+	zw := gzip.NewWriter(w)
+	enc := gob.NewEncoder(zw)
+	if err := enc.Encode(snapshotHeader{snapshotMagic, SnapshotVersion, snap.Created}); err != nil {
+		return err
+	}
+	if err := enc.Encode(snap); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+//ReadSnapshot reads a snapshot written by WriteFile
+func ReadSnapshot(file string) (*Snapshot, error) {
+	fh, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+	return DecodeSnapshot(fh)
+}
+
+//DecodeSnapshot reads a snapshot from r
+func DecodeSnapshot(r io.Reader) (*Snapshot, error) {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, ErrorSnapshotFormat
+	}
+	defer zr.Close()
+	dec := gob.NewDecoder(zr)
+	var hdr snapshotHeader
+	if err := dec.Decode(&hdr); err != nil || hdr.Magic != snapshotMagic {
+		return nil, ErrorSnapshotFormat
+	}
+	if hdr.Version != SnapshotVersion {
+		return nil, fmt.Errorf("%s: got %d want %d", ErrorSnapshotVersion, hdr.Version, SnapshotVersion)
+	}
+	var snap Snapshot
+	if err := dec.Decode(&snap); err != nil {
+		return nil, err
+	}
+	if snap.Cache == nil {
+		return nil, ErrorSnapshotFormat
+	}
+	return &snap, nil
+}
+
+//MakeCacheFromSnapshot populates the redis geo index from the snapshot
+//if it does not exist and returns the snapshotted cache. An existing
+//index is kept, it is at least as new as the snapshot
+func MakeCacheFromSnapshot(ctx context.Context, redisPool *radix.Pool, cfg *Config, snap *Snapshot) (*Cache, error) {
+	snap.Cache.points = snap.Points
+	if err := snap.Cache.EnsureGeoIndexes(ctx, redisPool, cfg); err != nil {
+		return nil, err
+	}
+	return snap.Cache, nil
+}
+
+//BuildCache builds the cache from mysql, saving a snapshot if configured.
+//If mysql is unavailable and fallback is enabled the cache is loaded from
+//the last snapshot instead
+func BuildCache(ctx context.Context, cfg *Config) (cache *Cache, err error) {
+	ctx, span := tracing.Start(ctx, "cache.build")
+	defer func() { tracing.End(span, err) }()
+	connMgr := NewConnMgr(cfg)
+	redisPool := connMgr.MustConnectRedis()
+	snapCfg := cfg.Snapshot
+	db, err := connMgr.ConnectMysql()
+	if err != nil {
+		if !snapCfg.Fallback || snapCfg.File == "" {
+			return nil, err
+		}
+		log.Errorf("Mysql unavailable, loading cache snapshot %s: %s", snapCfg.File, err)
+		span.SetAttributes(attribute.Bool("snapshot_fallback", true))
+		return LoadCacheSnapshot(ctx, redisPool, cfg, snapCfg.File)
+	}
+	cache, err = MakeCache(ctx, db, redisPool, cfg)
+	if err != nil {
+		return nil, err
+	}
+	if snapCfg.Save && snapCfg.File != "" {
+		if err := SaveCacheSnapshot(cache, snapCfg.File); err != nil {
+			log.Errorf("Error saving cache snapshot %s: %s", snapCfg.File, err)
+		}
+	}
+	return cache, nil
+}
+
+//SaveCacheSnapshot writes a snapshot of the cache to file
+func SaveCacheSnapshot(cache *Cache, file string) error {
+	snap := NewSnapshot(cache)
+	if err := snap.WriteFile(file); err != nil {
+		return err
+	}
+	log.Infof("Saved cache snapshot %s: %d stores %d points", file, len(cache.LocCache), len(snap.Points))
+	return nil
+}
+
+//LoadCacheSnapshot reads a snapshot file and builds the cache from it
+func LoadCacheSnapshot(ctx context.Context, redisPool *radix.Pool, cfg *Config, file string) (*Cache, error) {
+	snap, err := ReadSnapshot(file)
+	if err != nil {
+		return nil, err
+	}
+	log.Infof("Loaded cache snapshot %s created %s", file, snap.Created.Format(time.Stamp))
+	return MakeCacheFromSnapshot(ctx, redisPool, cfg, snap)
+}
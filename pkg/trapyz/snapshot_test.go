@@ -0,0 +1,84 @@
+package trapyz
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/gob"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/bamarb/aws-pipeline-go/pkg/geofence"
+	"github.com/stretchr/testify/assert"
+)
+
+func fixtureSnapshot() *Snapshot {
+	cache := &Cache{
+		APIKeyMap: map[string]APIKeyID{"key-a": 1},
+		CatMap:    map[string]CatID{"grocery": 3},
+		ScatMap:   map[string]SubcatID{"supermarket": 31},
+		CityMap:   map[string]CityID{"Bangalore": 7},
+		PinMap:    map[int]PinID{560001: 11},
+		LocCache: map[string]GeoLocOutput{
+			"42": {UID: "42", Sname: "Corner Mart", Cat: 3, Subcat: 31, City: 7, Pin: 11},
+		},
+		Fences:   map[string]geofence.Fence{"42": {Radius: 120}},
+		MaxReach: 120,
+		Quality:  NewQualityReport(),
+	}
+	return &Snapshot{
+		Created: time.Date(2018, 9, 6, 1, 0, 0, 0, time.UTC),
+		Cache:   cache,
+		Points:  []GeoPoint{{ID: "42", Lat: "12.9716", Lng: "77.5946"}},
+	}
+}
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "snapshot")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+	file := path.Join(dir, "cache.gob.gz")
+
+	want := fixtureSnapshot()
+	assert.Nil(want.WriteFile(file))
+	got, err := ReadSnapshot(file)
+	assert.Nil(err)
+	assert.True(want.Created.Equal(got.Created))
+	assert.Equal(want.Points, got.Points)
+	assert.Equal(want.Cache.LocCache, got.Cache.LocCache)
+	assert.Equal(want.Cache.PinMap, got.Cache.PinMap)
+	assert.Equal(want.Cache.Fences, got.Cache.Fences)
+}
+
+func TestSaveCacheSnapshot(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "snapshot")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+	file := path.Join(dir, "cache.gob.gz")
+
+	//the points the cache was built from are saved, not read again
+	cache := fixtureSnapshot().Cache
+	cache.points = []GeoPoint{{ID: "42", Lat: "12.9716", Lng: "77.5946"}}
+	assert.Nil(SaveCacheSnapshot(cache, file))
+	got, err := ReadSnapshot(file)
+	assert.Nil(err)
+	assert.Equal(cache.points, got.Points)
+	assert.Equal(cache.LocCache, got.Cache.LocCache)
+}
+
+func TestSnapshotVersion(t *testing.T) {
+	assert := assert.New(t)
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	gob.NewEncoder(zw).Encode(snapshotHeader{snapshotMagic, SnapshotVersion + 1, time.Now()})
+	zw.Close()
+	_, err := DecodeSnapshot(&buf)
+	assert.Error(err)
+
+	_, err = DecodeSnapshot(bytes.NewBufferString("not a snapshot"))
+	assert.Equal(ErrorSnapshotFormat, err)
+}
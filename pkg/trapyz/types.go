@@ -3,18 +3,18 @@ package trapyz
 // GeoLocOutput the structure we will marshal to json and write
 // to log
 type GeoLocOutput struct {
-	Pin       string `json:"pin"`
-	Gid       string `json:"gid"`
-	Lat       string `json:"lat"`
-	UID       string `json:"uuid"`
-	Sname     string `json:"sname"`
-	Cat       string `json:"cat"`
-	Apikey    string `json:"apikey"`
-	Lng       string `json:"lng"`
-	Subcat    string `json:"subcat"`
-	Distance  int    `json:"distance"`
-	City      string `json:"city"`
-	Createdat string `json:"createdat"`
+	Pin       PinID    `json:"pin"`
+	Gid       string   `json:"gid"`
+	Lat       string   `json:"lat"`
+	UID       string   `json:"uuid"`
+	Sname     string   `json:"sname"`
+	Cat       CatID    `json:"cat"`
+	Apikey    APIKeyID `json:"apikey"`
+	Lng       string   `json:"lng"`
+	Subcat    SubcatID `json:"subcat"`
+	Distance  int      `json:"distance"`
+	City      CityID   `json:"city"`
+	Createdat string   `json:"createdat"`
 }
 
 // Database struct to hold db conn info
@@ -33,18 +33,108 @@ type DbTableName struct {
 	StoreUUIDTable string `toml:"store_uuid_table"`
 	PincodeTable   string `toml:"pincode_table"`
 	CityTable      string `toml:"city_table"`
+	//Optional MasterRecTable columns holding a per store radius
+	//in meters and a WKT or GeoJSON polygon geofence
+	RadiusColumn   string `toml:"radius_column"`
+	GeofenceColumn string `toml:"geofence_column"`
+}
+
+// PartitionInfo partitioned output config, by lists extra partition keys
+// after date and hour: city, apikey
+type PartitionInfo struct {
+	Directory string
+	By        []string
+	MaxBytes  int64 `toml:"max_bytes"`
+	MaxOpen   int   `toml:"max_open"`
+	Compress  bool
+}
+
+// UploadInfo where finished output partitions are copied to, a local
+// directory or an s3://bucket/prefix url. Files larger than part_size
+// are uploaded to s3 in parts
+type UploadInfo struct {
+	Destination string
+	PartSize    int64 `toml:"part_size"`
 }
 
 // OutputInfo struct to write output files and logs
 type OutputInfo struct {
-	Directory string
-	File      string
-	Logdir    string
-	Logfile   string
-	Redisdir  string
+	Directory     string
+	File          string
+	Sinks         []string
+	VisitsFile    string `toml:"visits_file"`
+	FootfallFile  string `toml:"footfall_file"`
+	DeadLetterDir string `toml:"dead_letter_dir"`
+	ReportDir     string `toml:"report_dir"`
+	Logdir        string
+	Logfile       string
+	Redisdir      string
+	Partition     PartitionInfo
+	Upload        UploadInfo
+	//FootfallRetentionDays days of footfall files kept, 0 keeps all
+	FootfallRetentionDays int `toml:"footfall_retention_days"`
+}
+
+// FilterInfo GPS quality filter config
+type FilterInfo struct {
+	AccuracyKey string   `toml:"accuracy_key"`
+	MaxAccuracy float64  `toml:"max_accuracy"`
+	MaxSpeed    float64  `toml:"max_speed"`
+	BogusCoords []string `toml:"bogus_coords"`
+}
+
+// DedupInfo ping dedup config, window is a go duration string
+type DedupInfo struct {
+	Enabled   bool
+	Precision int
+	Window    string
+	Size      int
+}
+
+// UniqueInfo unique device counting config, backend is memory or redis.
+// The memory backend is saved to file, ttl is a go duration string
+type UniqueInfo struct {
+	Backend string
+	File    string
+	TTL     string `toml:"ttl"`
+	DB      int    `toml:"db"`
+}
+
+// ElasticInfo elasticsearch bulk sink config, flush_interval is a go
+// duration string
+type ElasticInfo struct {
+	URL           string `toml:"url"`
+	Username      string
+	Password      string
+	IndexPrefix   string `toml:"index_prefix"`
+	DateFormat    string `toml:"date_format"`
+	DocType       string `toml:"doc_type"`
+	TemplateName  string `toml:"template_name"`
+	TemplateFile  string `toml:"template_file"`
+	MaxItems      uint   `toml:"max_items"`
+	MaxBytes      uint   `toml:"max_bytes"`
+	FlushInterval string `toml:"flush_interval"`
+	MaxRetries    int    `toml:"max_retries"`
 }
 
-// AwsS3Info holds aws s3 config
+// VisitInfo visit detection config, durations are go duration strings.
+// Visits still open at the end of a run are carried over to the next run
+// in OpenFile
+type VisitInfo struct {
+	Enabled  bool
+	MaxGap   string `toml:"max_gap"`
+	MinDwell string `toml:"min_dwell"`
+	OpenFile string `toml:"open_file"`
+}
+
+// SnapshotInfo on disk cache snapshot config
+type SnapshotInfo struct {
+	File     string
+	Save     bool
+	Fallback bool
+}
+
+// AwsS3Info holds aws s3 and dynamodb config
 type AwsS3Info struct {
 	Region       string
 	Profile      string
@@ -57,6 +147,60 @@ type AwsS3Info struct {
 	DateFormat   string `toml:"date_format"`
 	ScaleTime    bool   `toml:"scale_time"`
 	Unzip        bool
+	Endpoint     string
+	Table        string
+	HashKey      string `toml:"hash_key"`
+	RangeKey     string `toml:"range_key"`
+	Conditional  bool
+	VersionAttr  string `toml:"version_attr"`
+	Enabled      bool
+}
+
+// InputInfo input file formats, format is the default of ndjson, csv or
+// parquet. prefixes maps input file name prefixes to a format. Json lines
+// longer than max_line_bytes are rejected
+type InputInfo struct {
+	Format       string
+	Prefixes     map[string]string
+	CSV          CSVInfo
+	MaxLineBytes int `toml:"max_line_bytes"`
+}
+
+// CSVInfo csv input columns, without columns the first row is the header.
+// mapping renames csv columns to input keys
+type CSVInfo struct {
+	Delimiter string
+	Columns   []string
+	Mapping   map[string]string
+}
+
+// MetricsInfo http endpoint of the long running scheduler serving
+// /metrics, /healthz and /readyz, an empty listen address disables it
+type MetricsInfo struct {
+	Listen string
+}
+
+// TracingInfo span exporter, one of none, stdout, file or otlp. file is
+// the span output of the file exporter, endpoint the otlp http collector
+// host:port. sample_ratio is the fraction of runs traced, 1 traces all
+// and 0 none, unset traces all
+type TracingInfo struct {
+	Exporter    string
+	File        string
+	Endpoint    string
+	Insecure    bool
+	SampleRatio *float64 `toml:"sample_ratio"`
+}
+
+// StateInfo scheduler run state file keeping the last history runs. On
+// start the scheduler resumes after the latest window run, catching up
+// at most max_catchup of missed windows. Windows that didn't complete ok
+// inside max_catchup are run again, up to max_attempts runs each
+type StateInfo struct {
+	File        string
+	History     int
+	MaxCatchup  string `toml:"max_catchup"`
+	MaxAttempts int    `toml:"max_attempts"`
 }
 
 // Config config struct decoded from toml
@@ -66,11 +210,25 @@ type Config struct {
 	Nworkers             int
 	Inputdir             string
 	Schedule             string
-	TpzEnv               string `toml:"tpz_env"`
-	NumRecords           int    `toml:"num_records"`
-	RedisCacheKey        string `toml:"redis_cache_key"`
-	RedisRebuildCacheKey string `toml:"redis_rebuild_cache_key"`
+	TpzEnv               string  `toml:"tpz_env"`
+	NumRecords           int     `toml:"num_records"`
+	RedisCacheKey        string  `toml:"redis_cache_key"`
+	RedisRebuildCacheKey string  `toml:"redis_rebuild_cache_key"`
+	CacheRefresh         string  `toml:"cache_refresh"`
+	MaxBadStoreRatio     float64 `toml:"max_bad_store_ratio"`
+	ProfileTTL           string  `toml:"profile_ttl"`
+	ProfileDB            int     `toml:"profile_db"`
 	Output               OutputInfo
+	Input                InputInfo
+	Snapshot             SnapshotInfo
+	Visits               VisitInfo
+	Filter               FilterInfo
+	Dedup                DedupInfo
+	Uniques              UniqueInfo
+	Elastic              ElasticInfo
+	Metrics              MetricsInfo
+	Tracing              TracingInfo
+	State                StateInfo
 	Db                   map[string]Database
 	Aws                  map[string]AwsS3Info
 }
@@ -0,0 +1,307 @@
+package trapyz
+
+import (
+	"encoding/gob"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bamarb/aws-pipeline-go/pkg/hll"
+	radix "github.com/mediocregopher/radix.v3"
+)
+
+//Unique count dimensions
+const (
+	UniqueStoreDim = "store"
+	UniqueCityDim  = "city"
+	UniqueCatDim   = "cat"
+)
+
+//ErrorUniqueBackend is returned for an unknown uniques backend
+var ErrorUniqueBackend = errors.New("Unknown uniques backend, expected memory or redis")
+
+//ErrorUniqueDB is returned for the redis uniques backend without a db of its own
+var ErrorUniqueDB = errors.New("Error redis uniques need their own db, db 0 is flushed every run")
+
+//uniqueDayFormat day suffix of unique keys
+const uniqueDayFormat = "20060102"
+
+//uniqueFlushSize buffered members before the counter flushes
+const uniqueFlushSize = 1000
+
+//UniqueStore counts distinct members per key. Count over several
+//keys returns the distinct count of their union
+type UniqueStore interface {
+	Add(key string, members ...string) error
+	Count(keys ...string) (uint64, error)
+}
+
+//UniqueKey returns the key of a dimension value on a day
+func UniqueKey(dim, id string, day time.Time) string {
+	return "uniq:" + dim + ":" + id + ":" + day.UTC().Format(uniqueDayFormat)
+}
+
+//UniqueDayKeys returns the day keys of a dimension value from the day
+//of from to the day of to inclusive
+func UniqueDayKeys(dim, id string, from, to time.Time) []string {
+	var keys []string
+	from = from.UTC().Truncate(24 * time.Hour)
+	for d := from; !d.After(to.UTC()); d = d.Add(24 * time.Hour) {
+		keys = append(keys, UniqueKey(dim, id, d))
+	}
+	return keys
+}
+
+//CountUniques returns the distinct devices of a dimension value seen
+//between from and to, weekly and monthly counts are unions of day keys
+func CountUniques(us UniqueStore, dim, id string, from, to time.Time) (uint64, error) {
+	return us.Count(UniqueDayKeys(dim, id, from, to)...)
+}
+
+//MemoryUniqueStore an in process UniqueStore backed by HLL sketches,
+//sparse while a key has few devices so the many small store day keys
+//stay small. The sketches can be saved to a file and merged across runs
+type MemoryUniqueStore struct {
+	lock     sync.Mutex
+	sketches map[string]*hll.Sketch
+}
+
+//NewMemoryUniqueStore constructs an empty store
+func NewMemoryUniqueStore() *MemoryUniqueStore {
+	return &MemoryUniqueStore{sketches: make(map[string]*hll.Sketch)}
+}
+
+//Add adds members to the sketch of key
+func (ms *MemoryUniqueStore) Add(key string, members ...string) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	s, ok := ms.sketches[key]
+	if !ok {
+		s = hll.NewDefault()
+		ms.sketches[key] = s
+	}
+	for _, m := range members {
+		s.AddString(m)
+	}
+	return nil
+}
+
+//Count estimates the distinct members across keys, missing keys are empty
+func (ms *MemoryUniqueStore) Count(keys ...string) (uint64, error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	union := hll.NewDefault()
+	for _, k := range keys {
+		if err := union.Merge(ms.sketches[k]); err != nil {
+			return 0, err
+		}
+	}
+	return union.Count(), nil
+}
+
+//Merge folds the sketches of other into ms
+func (ms *MemoryUniqueStore) Merge(other *MemoryUniqueStore) error {
+	other.lock.Lock()
+	defer other.lock.Unlock()
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	for k, s := range other.sketches {
+		if cur, ok := ms.sketches[k]; ok {
+			if err := cur.Merge(s); err != nil {
+				return err
+			}
+		} else {
+			ms.sketches[k] = s.Clone()
+		}
+	}
+	return nil
+}
+
+//Expire drops the sketches of days before the given time
+func (ms *MemoryUniqueStore) Expire(before time.Time) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	cutoff := before.UTC().Format(uniqueDayFormat)
+	for k := range ms.sketches {
+		if len(k) > len(uniqueDayFormat) && k[len(k)-len(uniqueDayFormat):] < cutoff {
+			delete(ms.sketches, k)
+		}
+	}
+}
+
+//WriteFile saves the sketches as gob, the file is replaced atomically
+func (ms *MemoryUniqueStore) WriteFile(file string) error {
+	ms.lock.Lock()
+	enc := make(map[string][]byte, len(ms.sketches))
+	for k, s := range ms.sketches {
+		enc[k], _ = s.MarshalBinary()
+	}
+	ms.lock.Unlock()
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+	tmp := file + ".tmp"
+	fh, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	err = gob.NewEncoder(fh).Encode(enc)
+	if cerr := fh.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+//ReadMemoryUniqueStore loads sketches saved by WriteFile, a missing
+//file yields an empty store
+func ReadMemoryUniqueStore(file string) (*MemoryUniqueStore, error) {
+	ms := NewMemoryUniqueStore()
+	fh, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return ms, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+	var enc map[string][]byte
+	if err := gob.NewDecoder(fh).Decode(&enc); err != nil {
+		return nil, err
+	}
+	for k, data := range enc {
+		s := &hll.Sketch{}
+		if err := s.UnmarshalBinary(data); err != nil {
+			return nil, err
+		}
+		ms.sketches[k] = s
+	}
+	return ms, nil
+}
+
+//RedisUniqueStore a UniqueStore using redis PFADD and PFCOUNT,
+//keys expire TTL after their last update if TTL is set
+type RedisUniqueStore struct {
+	Client radix.Client
+	TTL    time.Duration
+}
+
+//NewRedisUniqueStore constructs a redis backed store
+func NewRedisUniqueStore(client radix.Client, ttl time.Duration) *RedisUniqueStore {
+	return &RedisUniqueStore{Client: client, TTL: ttl}
+}
+
+//Add adds members to the redis HLL at key
+func (rs *RedisUniqueStore) Add(key string, members ...string) error {
+	if len(members) == 0 {
+		return nil
+	}
+	cmds := []radix.CmdAction{radix.Cmd(nil, "PFADD", append([]string{key}, members...)...)}
+	if rs.TTL > 0 {
+		cmds = append(cmds, radix.Cmd(nil, "EXPIRE", key, strconv.Itoa(int(rs.TTL/time.Second))))
+	}
+	return rs.Client.Do(radix.Pipeline(cmds...))
+}
+
+//Count returns PFCOUNT over keys
+func (rs *RedisUniqueStore) Count(keys ...string) (uint64, error) {
+	if len(keys) == 0 {
+		return 0, nil
+	}
+	var count uint64
+	err := rs.Client.Do(radix.Cmd(&count, "PFCOUNT", keys...))
+	return count, err
+}
+
+//UniqueCounter adds the devices of matched pings to the store, city and
+//category day keys. Members are buffered, call Flush at the end of a run.
+//It is not safe for concurrent use
+type UniqueCounter struct {
+	Store    UniqueStore
+	buffered int
+	pending  map[string][]string
+}
+
+//NewUniqueCounter constructs a counter over a store
+func NewUniqueCounter(us UniqueStore) *UniqueCounter {
+	return &UniqueCounter{Store: us, pending: make(map[string][]string)}
+}
+
+//Add counts the device of a matched ping
+func (uc *UniqueCounter) Add(rec GeoLocOutput) error {
+	at, err := CreatedAtTime(rec.Createdat)
+	if err != nil || rec.Gid == "" {
+		return nil
+	}
+	for _, k := range []string{UniqueKey(UniqueStoreDim, rec.UID, at),
+		UniqueKey(UniqueCityDim, rec.City.String(), at),
+		UniqueKey(UniqueCatDim, rec.Cat.String(), at)} {
+		uc.pending[k] = append(uc.pending[k], rec.Gid)
+		uc.buffered++
+	}
+	if uc.buffered >= uniqueFlushSize {
+		return uc.Flush()
+	}
+	return nil
+}
+
+//Flush writes the buffered members to the store
+func (uc *UniqueCounter) Flush() error {
+	var firstErr error
+	for k, members := range uc.pending {
+		if err := uc.Store.Add(k, members...); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		delete(uc.pending, k)
+	}
+	uc.buffered = 0
+	return firstErr
+}
+
+//UniqueStoreFromConfig returns the unique store configured in the uniques
+//section, nil if unique counting is disabled. The memory store is loaded
+//from its file so counts carry over from earlier runs. The redis store
+//uses client, connected to the uniques db of the local redis
+func UniqueStoreFromConfig(cfg *Config, client radix.Client) (UniqueStore, error) {
+	ucfg := cfg.Uniques
+	var ttl time.Duration
+	if ucfg.TTL != "" {
+		var err error
+		if ttl, err = time.ParseDuration(ucfg.TTL); err != nil {
+			return nil, err
+		}
+	}
+	switch ucfg.Backend {
+	case "":
+		return nil, nil
+	case "memory":
+		if ucfg.File == "" {
+			return NewMemoryUniqueStore(), nil
+		}
+		return ReadMemoryUniqueStore(ucfg.File)
+	case "redis":
+		if ucfg.DB == 0 {
+			return nil, ErrorUniqueDB
+		}
+		return NewRedisUniqueStore(client, ttl), nil
+	}
+	return nil, ErrorUniqueBackend
+}
+
+//SaveUniqueStore persists a memory store to its configured file after
+//dropping days older than the ttl, other stores are left alone
+func SaveUniqueStore(cfg *Config, us UniqueStore) error {
+	ms, ok := us.(*MemoryUniqueStore)
+	if !ok || cfg.Uniques.File == "" {
+		return nil
+	}
+	if ttl, err := time.ParseDuration(cfg.Uniques.TTL); err == nil && ttl > 0 {
+		ms.Expire(time.Now().Add(-ttl))
+	}
+	return ms.WriteFile(cfg.Uniques.File)
+}
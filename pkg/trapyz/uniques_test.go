@@ -0,0 +1,101 @@
+package trapyz
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUniqueDayKeys(t *testing.T) {
+	assert := assert.New(t)
+	from := time.Date(2018, 9, 6, 10, 0, 0, 0, time.UTC)
+	keys := UniqueDayKeys(UniqueStoreDim, "s1", from, from.Add(48*time.Hour))
+	assert.Equal([]string{"uniq:store:s1:20180906", "uniq:store:s1:20180907",
+		"uniq:store:s1:20180908"}, keys)
+	assert.Len(UniqueDayKeys(UniqueCityDim, "1", from, from.Add(6*24*time.Hour)), 7)
+}
+
+func TestUniqueCounter(t *testing.T) {
+	assert := assert.New(t)
+	ms := NewMemoryUniqueStore()
+	uc := NewUniqueCounter(ms)
+	//100 devices a day for a week, half of them return every day
+	for day := 0; day < 7; day++ {
+		for i := 0; i < 100; i++ {
+			gid := "g" + strconv.Itoa(i)
+			if i >= 50 {
+				gid += "-" + strconv.Itoa(day)
+			}
+			rec := ping(gid, "s1", time.Duration(day)*24*time.Hour, 10)
+			rec.City, rec.Cat = 3, 7
+			assert.Nil(uc.Add(rec))
+		}
+	}
+	assert.Nil(uc.Flush())
+	day, err := CountUniques(ms, UniqueStoreDim, "s1", visitStart, visitStart)
+	assert.Nil(err)
+	assert.InDelta(100, day, 2)
+	week, err := CountUniques(ms, UniqueCityDim, "3", visitStart, visitStart.Add(6*24*time.Hour))
+	assert.Nil(err)
+	assert.InDelta(400, week, 8)
+	none, err := CountUniques(ms, UniqueCatDim, "8", visitStart, visitStart)
+	assert.Nil(err)
+	assert.Equal(uint64(0), none)
+}
+
+func TestMemoryUniqueStoreFile(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "uniques")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "uniques.hll")
+
+	run1 := NewMemoryUniqueStore()
+	run1.Add("uniq:store:s1:20180906", "g1", "g2")
+	run1.Add("uniq:store:s1:20180801", "g1")
+	assert.Nil(run1.WriteFile(file))
+
+	//an hourly run later in the day merges into the saved sketches
+	run2, err := ReadMemoryUniqueStore(file)
+	assert.Nil(err)
+	run2.Add("uniq:store:s1:20180906", "g2", "g3")
+	run2.Expire(time.Date(2018, 9, 1, 0, 0, 0, 0, time.UTC))
+	assert.Nil(run2.WriteFile(file))
+
+	loaded, err := ReadMemoryUniqueStore(file)
+	assert.Nil(err)
+	n, _ := loaded.Count("uniq:store:s1:20180906")
+	assert.Equal(uint64(3), n)
+	n, _ = loaded.Count("uniq:store:s1:20180801")
+	assert.Equal(uint64(0), n)
+
+	empty, err := ReadMemoryUniqueStore(filepath.Join(dir, "missing"))
+	assert.Nil(err)
+	assert.NotNil(empty)
+}
+
+func TestUniqueStoreFromConfig(t *testing.T) {
+	assert := assert.New(t)
+	cfg := &Config{}
+	us, err := UniqueStoreFromConfig(cfg, nil)
+	assert.Nil(err)
+	assert.Nil(us)
+
+	//db 0 holds the per run data flushed at the start of every run
+	cfg.Uniques = UniqueInfo{Backend: "redis", TTL: "24h"}
+	_, err = UniqueStoreFromConfig(cfg, nil)
+	assert.Equal(ErrorUniqueDB, err)
+	cfg.Uniques.DB = 2
+	us, err = UniqueStoreFromConfig(cfg, nil)
+	assert.Nil(err)
+	assert.NotNil(us)
+
+	cfg.Uniques.Backend = "cassandra"
+	_, err = UniqueStoreFromConfig(cfg, nil)
+	assert.Equal(ErrorUniqueBackend, err)
+}
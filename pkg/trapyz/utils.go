@@ -8,13 +8,20 @@ import (
 	"os/user"
 	"path"
 	"regexp"
+	"strconv"
 	"strings"
 	"time"
+
+	"github.com/bamarb/aws-pipeline-go/pkg/geostore"
+	"github.com/bamarb/aws-pipeline-go/pkg/tracing"
 )
 
 //ErrorInvalidDate an error passed to upstream modules
 var ErrorInvalidDate = errors.New("Invalid Date Time format")
 
+//ErrorInvalidRadius an error thrown when the radius cannot be parsed
+var ErrorInvalidRadius = errors.New("Invalid radius, expected a number with an optional ft, m, km or mi unit")
+
 //ErrorStartAfterEnd an error thrown when a from date falls after the to date
 var ErrorStartAfterEnd = errors.New("Invalid from and to dates from-date is after to-date")
 
@@ -50,6 +57,25 @@ func FindOrCreateDestDir(cfg *Config) string {
 	return dumpDir
 }
 
+//ParseRadius parses a radius with an optional unit into meters,
+//a bare number is in meters eg: "300", "250.5m", "0.3km", "1000ft"
+func ParseRadius(radius string) (float64, error) {
+	radius = strings.ToLower(strings.TrimSpace(radius))
+	unit := strings.TrimLeft(radius, "0123456789.")
+	d, ok := geostore.M, true
+	if unit != "" {
+		d, ok = geostore.ParseDistance(strings.TrimSpace(unit))
+	}
+	if !ok {
+		return 0, ErrorInvalidRadius
+	}
+	val, err := strconv.ParseFloat(radius[:len(radius)-len(unit)], 64)
+	if err != nil || val <= 0 {
+		return 0, ErrorInvalidRadius
+	}
+	return val * d.Meters(), nil
+}
+
 func expandTilde(path string) string {
 	if strings.HasPrefix(path, "~") {
 		usr, err := user.Current()
@@ -173,6 +199,19 @@ func datePrefixGenerator(fromDate time.Time, toDate time.Time, dateFormat string
 	return prefixes
 }
 
+//CreatedAtTime parses a createdat epoch timestamp in milliseconds,
+//values too small to be milliseconds are taken as seconds
+func CreatedAtTime(createdat string) (time.Time, error) {
+	ts, err := strconv.ParseInt(createdat, 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if ts < 1e11 {
+		return time.Unix(ts, 0), nil
+	}
+	return time.Unix(ts/1000, (ts%1000)*int64(time.Millisecond)), nil
+}
+
 //ParseDate parses a date, a date/hour or throws an error
 func ParseDate(dateStr string) (time.Time, error) {
 	if didMatch := dateRegex.MatchString(dateStr); didMatch {
@@ -238,3 +277,20 @@ func PrefixChan(ctx context.Context, start time.Time, end time.Time, topPrefixes
 	}()
 	return out
 }
+
+//TracingConfig returns the span exporter config of the service, an
+//unset sample ratio traces every run
+func TracingConfig(cfg *Config, service string) tracing.Config {
+	ratio := 1.0
+	if cfg.Tracing.SampleRatio != nil {
+		ratio = *cfg.Tracing.SampleRatio
+	}
+	return tracing.Config{
+		Exporter:    cfg.Tracing.Exporter,
+		File:        cfg.Tracing.File,
+		Endpoint:    cfg.Tracing.Endpoint,
+		Insecure:    cfg.Tracing.Insecure,
+		SampleRatio: ratio,
+		ServiceName: service,
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"math"
 	"reflect"
 	"testing"
 	"time"
@@ -140,3 +141,31 @@ func TestGetStartEndTime(t *testing.T) {
 		})
 	}
 }
+
+func TestParseRadius(t *testing.T) {
+	tests := []struct {
+		radius  string
+		want    float64
+		wantErr bool
+	}{
+		{"300", 300, false},
+		{"250.5m", 250.5, false},
+		{"0.3km", 300, false},
+		{" 1000 ft", 304.8, false},
+		{"1mi", 1609.344, false},
+		{"", 0, true},
+		{"300yd", 0, true},
+		{"-5", 0, true},
+		{"km", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseRadius(tt.radius)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseRadius(%q) error = %v, wantErr %v", tt.radius, err, tt.wantErr)
+			continue
+		}
+		if math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("ParseRadius(%q) = %v, want %v", tt.radius, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,216 @@
+package trapyz
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+//Default visit session parameters
+const (
+	DefaultMaxGap   = 10 * time.Minute
+	DefaultMinDwell = 2 * time.Minute
+)
+
+//Visit a session of consecutive pings from one device near one store
+type Visit struct {
+	Gid         string   `json:"gid"`
+	UID         string   `json:"uuid"`
+	Sname       string   `json:"sname"`
+	Cat         CatID    `json:"cat"`
+	Subcat      SubcatID `json:"subcat"`
+	City        CityID   `json:"city"`
+	Apikey      APIKeyID `json:"apikey"`
+	Entry       int64    `json:"entry"`
+	Exit        int64    `json:"exit"`
+	Dwell       int64    `json:"dwell"`
+	Pings       int      `json:"pings"`
+	MinDistance int      `json:"min_distance"`
+}
+
+//Duration returns the dwell time of the visit
+func (v *Visit) Duration() time.Duration {
+	return time.Duration(v.Exit-v.Entry) * time.Millisecond
+}
+
+//VisitBuilder groups matched pings per gid and store into visits.
+//Pings arrive in any order, they are buffered per gid and store and
+//sorted into sessions when the builder is flushed. A gap longer than
+//MaxGap starts a new session, visits shorter than MinDwell are treated
+//as walk pasts and dropped
+type VisitBuilder struct {
+	MaxGap   time.Duration
+	MinDwell time.Duration
+	pings    map[string]*visitPings
+	//the latest ping time seen, sessions ending within MaxGap of it may
+	//continue in the next run
+	watermark int64
+}
+
+//visitPings the buffered pings of a gid near a store, each span is a
+//ping or a session carried over from an earlier run
+type visitPings struct {
+	visit Visit
+	spans []visitSpan
+}
+
+type visitSpan struct {
+	Entry, Exit int64
+	Pings       int
+	MinDistance int
+}
+
+//NewVisitBuilder constructs a visit builder
+func NewVisitBuilder(maxGap, minDwell time.Duration) *VisitBuilder {
+	return &VisitBuilder{MaxGap: maxGap, MinDwell: minDwell, pings: make(map[string]*visitPings)}
+}
+
+//VisitBuilderFromConfig returns a visit builder configured from the
+//visits section, or nil if visit detection is disabled
+func VisitBuilderFromConfig(cfg *Config) (*VisitBuilder, error) {
+	vcfg := cfg.Visits
+	if !vcfg.Enabled {
+		return nil, nil
+	}
+	maxGap, minDwell := DefaultMaxGap, DefaultMinDwell
+	var err error
+	if vcfg.MaxGap != "" {
+		if maxGap, err = time.ParseDuration(vcfg.MaxGap); err != nil {
+			return nil, err
+		}
+	}
+	if vcfg.MinDwell != "" {
+		if minDwell, err = time.ParseDuration(vcfg.MinDwell); err != nil {
+			return nil, err
+		}
+	}
+	return NewVisitBuilder(maxGap, minDwell), nil
+}
+
+//Add buffers a matched ping
+func (vb *VisitBuilder) Add(rec GeoLocOutput) {
+	at, err := CreatedAtTime(rec.Createdat)
+	if err != nil {
+		return
+	}
+	ts := at.UnixNano() / int64(time.Millisecond)
+	vb.add(Visit{Gid: rec.Gid, UID: rec.UID, Sname: rec.Sname, Cat: rec.Cat,
+		Subcat: rec.Subcat, City: rec.City, Apikey: rec.Apikey},
+		visitSpan{Entry: ts, Exit: ts, Pings: 1, MinDistance: rec.Distance})
+}
+
+//Resume adds the open visits of an earlier run, pings of this run within
+//MaxGap of them extend them
+func (vb *VisitBuilder) Resume(open []Visit) {
+	for _, v := range open {
+		vb.add(v, visitSpan{Entry: v.Entry, Exit: v.Exit, Pings: v.Pings, MinDistance: v.MinDistance})
+	}
+}
+
+func (vb *VisitBuilder) add(v Visit, sp visitSpan) {
+	if sp.Exit > vb.watermark {
+		vb.watermark = sp.Exit
+	}
+	key := v.Gid + "|" + v.UID
+	vp, ok := vb.pings[key]
+	if !ok {
+		vp = &visitPings{visit: v}
+		vb.pings[key] = vp
+	}
+	vp.spans = append(vp.spans, sp)
+}
+
+//Flush closes and returns all visits, call it at the end of a run
+func (vb *VisitBuilder) Flush() []Visit {
+	done, open := vb.FlushOpen()
+	for _, v := range open {
+		done = vb.close(done, v)
+	}
+	return done
+}
+
+//FlushOpen returns the closed visits and the visits ending within MaxGap
+//of the latest ping, which may continue in the next run. Open visits are
+//returned whatever their dwell, pass them to Resume in the next run
+func (vb *VisitBuilder) FlushOpen() (done []Visit, open []Visit) {
+	gap := int64(vb.MaxGap / time.Millisecond)
+	for key, vp := range vb.pings {
+		sort.Slice(vp.spans, func(i, j int) bool { return vp.spans[i].Entry < vp.spans[j].Entry })
+		var cur *Visit
+		for _, sp := range vp.spans {
+			if cur != nil && sp.Entry <= cur.Exit+gap {
+				if sp.Exit > cur.Exit {
+					cur.Exit = sp.Exit
+				}
+				cur.Pings += sp.Pings
+				if sp.MinDistance < cur.MinDistance {
+					cur.MinDistance = sp.MinDistance
+				}
+				continue
+			}
+			if cur != nil {
+				done = vb.close(done, *cur)
+			}
+			v := vp.visit
+			v.Entry, v.Exit, v.Pings, v.MinDistance = sp.Entry, sp.Exit, sp.Pings, sp.MinDistance
+			cur = &v
+		}
+		if cur.Exit >= vb.watermark-gap {
+			open = append(open, *cur)
+		} else {
+			done = vb.close(done, *cur)
+		}
+		delete(vb.pings, key)
+	}
+	vb.watermark = 0
+	return done, open
+}
+
+func (vb *VisitBuilder) close(done []Visit, v Visit) []Visit {
+	if v.Duration() < vb.MinDwell {
+		return done
+	}
+	v.Dwell = int64(v.Duration() / time.Second)
+	return append(done, v)
+}
+
+//LoadOpenVisits reads the open visits carried over by the last run, a
+//missing file has none
+func LoadOpenVisits(file string) ([]Visit, error) {
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var open []Visit
+	if err := json.Unmarshal(data, &open); err != nil {
+		return nil, err
+	}
+	return open, nil
+}
+
+//SaveOpenVisits writes the open visits for the next run, the file is
+//replaced atomically
+func SaveOpenVisits(file string, open []Visit) error {
+	if open == nil {
+		open = []Visit{}
+	}
+	data, err := json.Marshal(open)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+	tmp := file + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, file)
+}
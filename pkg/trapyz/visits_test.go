@@ -0,0 +1,114 @@
+package trapyz
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var visitStart = time.Date(2018, 9, 6, 10, 0, 0, 0, time.UTC)
+
+func ping(gid, uid string, at time.Duration, dist int) GeoLocOutput {
+	ms := visitStart.Add(at).UnixNano() / int64(time.Millisecond)
+	return GeoLocOutput{Gid: gid, UID: uid, Distance: dist, Createdat: strconv.FormatInt(ms, 10)}
+}
+
+func TestVisitBuilder(t *testing.T) {
+	assert := assert.New(t)
+	vb := NewVisitBuilder(10*time.Minute, 2*time.Minute)
+	//a 40 minute visit with pings every 5 minutes, one arriving late
+	for _, m := range []int{0, 5, 10, 20, 15, 25, 30, 35, 40} {
+		vb.Add(ping("g1", "s1", time.Duration(m)*time.Minute, 100-m))
+	}
+	//a walk past another store
+	vb.Add(ping("g1", "s2", 12*time.Minute, 50))
+	//a ping an hour later is a new session
+	vb.Add(ping("g1", "s1", 100*time.Minute, 80))
+
+	//the walk past and the single ping session are below min dwell
+	done := vb.Flush()
+	assert.Len(done, 1)
+	v := done[0]
+	assert.Equal("s1", v.UID)
+	assert.Equal(40*time.Minute, v.Duration())
+	assert.Equal(int64(2400), v.Dwell)
+	assert.Equal(9, v.Pings)
+	assert.Equal(60, v.MinDistance)
+	assert.Empty(vb.Flush())
+}
+
+func TestVisitBuilderOutOfOrder(t *testing.T) {
+	assert := assert.New(t)
+	vb := NewVisitBuilder(10*time.Minute, 2*time.Minute)
+	//files are read in any order, the pings of one visit arrive
+	//interleaved with a later visit
+	for _, m := range []int{30, 100, 0, 105, 10, 110, 20, 40} {
+		vb.Add(ping("g1", "s1", time.Duration(m)*time.Minute, 100))
+	}
+	done := vb.Flush()
+	assert.Len(done, 2)
+	sort.Slice(done, func(i, j int) bool { return done[i].Entry < done[j].Entry })
+	assert.Equal(40*time.Minute, done[0].Duration())
+	assert.Equal(5, done[0].Pings)
+	assert.Equal(10*time.Minute, done[1].Duration())
+	assert.Equal(3, done[1].Pings)
+}
+
+func TestVisitBuilderCarryOver(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "visits")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "visits-open.json")
+
+	//the first run ends while g1 is still at s1, g2 left s2 long ago
+	vb := NewVisitBuilder(10*time.Minute, 2*time.Minute)
+	for _, m := range []int{50, 55, 59} {
+		vb.Add(ping("g1", "s1", time.Duration(m)*time.Minute, 40))
+	}
+	for _, m := range []int{0, 5, 10} {
+		vb.Add(ping("g2", "s2", time.Duration(m)*time.Minute, 40))
+	}
+	done, open := vb.FlushOpen()
+	assert.Len(done, 1)
+	assert.Equal("g2", done[0].Gid)
+	assert.Len(open, 1)
+	assert.Nil(SaveOpenVisits(file, open))
+
+	//the next run continues the visit
+	vb = NewVisitBuilder(10*time.Minute, 2*time.Minute)
+	open, err = LoadOpenVisits(file)
+	assert.Nil(err)
+	vb.Resume(open)
+	for _, m := range []int{62, 70} {
+		vb.Add(ping("g1", "s1", time.Duration(m)*time.Minute, 30))
+	}
+	done = vb.Flush()
+	assert.Len(done, 1)
+	assert.Equal(20*time.Minute, done[0].Duration())
+	assert.Equal(5, done[0].Pings)
+	assert.Equal(30, done[0].MinDistance)
+
+	open, err = LoadOpenVisits(filepath.Join(dir, "missing.json"))
+	assert.Nil(err)
+	assert.Empty(open)
+}
+
+func TestCreatedAtTime(t *testing.T) {
+	assert := assert.New(t)
+	ms, err := CreatedAtTime("1536228000123")
+	assert.Nil(err)
+	assert.Equal(int64(1536228000), ms.Unix())
+	assert.Equal(123*time.Millisecond, time.Duration(ms.Nanosecond()))
+	secs, err := CreatedAtTime("1536228000")
+	assert.Nil(err)
+	assert.Equal(int64(1536228000), secs.Unix())
+	_, err = CreatedAtTime("NULL")
+	assert.Error(err)
+}